@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/fatih/color"
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var colorNames = map[string]color.Attribute{
+	"black":     color.FgBlack,
+	"red":       color.FgRed,
+	"green":     color.FgGreen,
+	"yellow":    color.FgYellow,
+	"blue":      color.FgBlue,
+	"magenta":   color.FgMagenta,
+	"cyan":      color.FgCyan,
+	"white":     color.FgWhite,
+	"hiblack":   color.FgHiBlack,
+	"hired":     color.FgHiRed,
+	"higreen":   color.FgHiGreen,
+	"hiyellow":  color.FgHiYellow,
+	"hiblue":    color.FgHiBlue,
+	"himagenta": color.FgHiMagenta,
+	"hicyan":    color.FgHiCyan,
+	"hiwhite":   color.FgHiWhite,
+}
+
+// ColorScheme is a list of rules assigning colors to containers. The first
+// matching rule wins.
+type ColorScheme struct {
+	Rules []*ColorRule `json:"rules"`
+}
+
+// ColorRule matches containers by regular expressions on the pod name,
+// container name, or a label's value. All given expressions must match.
+type ColorRule struct {
+	Pod       string `json:"pod,omitempty"`
+	Container string `json:"container,omitempty"`
+	Label     string `json:"label,omitempty"`
+	Value     string `json:"value,omitempty"`
+	Color     string `json:"color"`
+
+	pod, container, value *regexp.Regexp
+	color                 *color.Color
+}
+
+// LoadColorScheme reads a color scheme from a YAML or JSON file.
+func LoadColorScheme(path string) (*ColorScheme, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var scheme ColorScheme
+	if err := yaml.Unmarshal(data, &scheme); err != nil {
+		return nil, fmt.Errorf("Invalid color scheme %s: %s", path, err)
+	}
+	for i, rule := range scheme.Rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("Invalid color scheme %s: rule %d: %s", path, i+1, err)
+		}
+	}
+	return &scheme, nil
+}
+
+func (r *ColorRule) compile() error {
+	attr, ok := colorNames[r.Color]
+	if !ok {
+		return fmt.Errorf("Unknown color %q", r.Color)
+	}
+	r.color = color.New(attr)
+
+	var err error
+	for _, p := range []struct {
+		expr string
+		re   **regexp.Regexp
+	}{{r.Pod, &r.pod}, {r.Container, &r.container}, {r.Value, &r.value}} {
+		if p.expr == "" {
+			continue
+		}
+		if *p.re, err = regexp.Compile(p.expr); err != nil {
+			return fmt.Errorf("Invalid regexp: %q: %s", p.expr, err)
+		}
+	}
+	if r.value != nil && r.Label == "" {
+		return fmt.Errorf("A value requires a label")
+	}
+	return nil
+}
+
+func (r *ColorRule) matches(pod *v1.Pod, container *v1.Container) bool {
+	if r.pod != nil && !r.pod.MatchString(pod.Name) {
+		return false
+	}
+	if r.container != nil && !r.container.MatchString(container.Name) {
+		return false
+	}
+	if r.Label != "" {
+		value, ok := pod.Labels[r.Label]
+		if !ok || (r.value != nil && !r.value.MatchString(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// colorFor returns the color of the first matching rule, or nil.
+func (s *ColorScheme) colorFor(pod *v1.Pod, container *v1.Container) *color.Color {
+	for _, rule := range s.Rules {
+		if rule.matches(pod, container) {
+			return rule.color
+		}
+	}
+	return nil
+}
+
+// colorForContainer returns the container's color from the color scheme,
+// falling back to one derived from its key.
+func (o FormatOptions) colorForContainer(pod *v1.Pod, container *v1.Container) *color.Color {
+	if o.ColorScheme != nil {
+		if c := o.ColorScheme.colorFor(pod, container); c != nil {
+			return c
+		}
+	}
+	return colorForKey(o.ColorMode, buildKey(pod, container))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestColorRule_Compile(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		rule    ColorRule
+		wantErr bool
+	}{
+		{"valid", ColorRule{Pod: "^web", Color: "red"}, false},
+		{"unknown color", ColorRule{Pod: "^web", Color: "mauve"}, true},
+		{"invalid regexp", ColorRule{Container: "(", Color: "red"}, true},
+		{"value without label", ColorRule{Value: "prod", Color: "red"}, true},
+	} {
+		if err := test.rule.compile(); (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+}
+
+func TestColorScheme_ColorFor(t *testing.T) {
+	scheme := &ColorScheme{Rules: []*ColorRule{
+		{Container: "^istio-proxy$", Color: "hiblack"},
+		{Label: "tier", Value: "^db$", Color: "blue"},
+		{Pod: "^web-", Color: "green"},
+		{Label: "canary", Color: "yellow"},
+	}}
+	for _, rule := range scheme.Rules {
+		if err := rule.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pod := func(name string, labels map[string]string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	}
+	for _, test := range []struct {
+		name      string
+		pod       *v1.Pod
+		container string
+		want      int // Index of the matching rule, or -1
+	}{
+		{"container", pod("web-1", nil), "istio-proxy", 0},
+		{"label value", pod("pg-0", map[string]string{"tier": "db"}), "postgres", 1},
+		{"other label value", pod("api-0", map[string]string{"tier": "api"}), "app", -1},
+		{"pod", pod("web-1", nil), "app", 2},
+		{"label present", pod("api-0", map[string]string{"canary": ""}), "app", 3},
+		{"no match", pod("api-0", nil), "app", -1},
+	} {
+		got := scheme.colorFor(test.pod, &v1.Container{Name: test.container})
+		if test.want < 0 {
+			if got != nil {
+				t.Errorf("%s: got a color, want none", test.name)
+			}
+		} else if got != scheme.Rules[test.want].color {
+			t.Errorf("%s: got the wrong rule's color, want rule %d", test.name, test.want+1)
+		}
+	}
+}
+
+func TestFormatOptions_ColorForContainer(t *testing.T) {
+	rule := &ColorRule{Pod: "^web-", Color: "green"}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+	options := FormatOptions{ColorMode: colorMode256, ColorScheme: &ColorScheme{Rules: []*ColorRule{rule}}}
+	web := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	api := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "api-1"}}
+	app := &v1.Container{Name: "app"}
+
+	if got := options.colorForContainer(web, app); got != rule.color {
+		t.Error("got a derived color for a pod matching the scheme, want the rule's")
+	}
+	want := colorForKey(colorMode256, buildKey(api, app))
+	if got := options.colorForContainer(api, app); !got.Equals(want) {
+		t.Error("got the wrong color for a pod matching no rule, want the one derived from its key")
+	}
+	options.ColorScheme = nil
+	if got := options.colorForContainer(web, app); got == rule.color {
+		t.Error("got the rule's color without a scheme")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// column is a field of a log event in the structured output formats.
+type column struct {
+	name      string
+	shortName string // Used by logfmt
+	value     func(event LogEvent) string
+}
+
+var allColumns = []column{
+	{"timestamp", "ts", func(event LogEvent) string {
+		if event.Timestamp == nil {
+			return ""
+		}
+		return event.Timestamp.Format(time.RFC3339Nano)
+	}},
+	{"cluster", "cluster", func(event LogEvent) string { return event.Cluster }},
+	{"namespace", "ns", func(event LogEvent) string { return event.Pod.Namespace }},
+	{"pod", "pod", func(event LogEvent) string { return event.Pod.Name }},
+	{"container", "container", func(event LogEvent) string { return event.Container.Name }},
+	{"node", "node", func(event LogEvent) string { return event.Node }},
+	{"image", "image", func(event LogEvent) string { return event.ContainerImage }},
+	{"imageID", "imageID", func(event LogEvent) string { return event.ContainerImageID }},
+	{"podIP", "ip", func(event LogEvent) string { return event.PodIP }},
+	{"message", "msg", func(event LogEvent) string { return event.Message }},
+}
+
+// defaultColumns are the columns of the CSV and logfmt formats unless
+// others are selected.
+var defaultColumns = []string{"timestamp", "namespace", "pod", "container", "message"}
+
+// parseColumns returns the columns with the given names, in order. Both
+// full and short names are accepted.
+func parseColumns(names []string) ([]column, error) {
+	var columns []column
+	for _, name := range names {
+		found := false
+		for _, c := range allColumns {
+			if strings.EqualFold(name, c.name) || strings.EqualFold(name, c.shortName) {
+				columns = append(columns, c)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown column %q", name)
+		}
+	}
+	return columns, nil
+}
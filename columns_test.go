@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestParseColumns(t *testing.T) {
+	for _, test := range []struct {
+		names   []string
+		want    string
+		wantErr bool
+	}{
+		{[]string{"timestamp", "pod", "message"}, "timestamp,pod,message", false},
+		{[]string{"ts", "NS", "msg"}, "timestamp,namespace,message", false},
+		{[]string{"pod", "bogus"}, "", true},
+	} {
+		columns, err := parseColumns(test.names)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: got error %v", test.names, err)
+			continue
+		}
+		var names []string
+		for _, c := range columns {
+			names = append(names, c.name)
+		}
+		if got := strings.Join(names, ","); got != test.want {
+			t.Errorf("%q: got columns %q, want %q", test.names, got, test.want)
+		}
+	}
+}
+
+func TestColumnFormatters(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	columns, err := parseColumns([]string{"timestamp", "pod", "node", "message"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []LogEvent{
+		testEvent(pod, "app", time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC), `said "hi", twice`),
+		testEvent(pod, "app", time.Date(2017, 6, 1, 12, 0, 1, 0, time.UTC), "bye"),
+	}
+	for _, test := range []struct {
+		name   string
+		format EventFormatter
+		want   string
+	}{
+		{"csv", newCSVFormatter(columns), "timestamp,pod,node,message\n" +
+			`2017-06-01T12:00:00Z,web-1,,"said ""hi"", twice"` + "\n" +
+			"2017-06-01T12:00:01Z,web-1,,bye\n"},
+		{"logfmt", newLogfmtFormatter(columns),
+			`ts=2017-06-01T12:00:00Z pod=web-1 msg="said \"hi\", twice"` + "\n" +
+				`ts=2017-06-01T12:00:01Z pod=web-1 msg="bye"` + "\n"},
+		{"json", newJSONFormatter(columns),
+			`{"timestamp":"2017-06-01T12:00:00Z","pod":"web-1","node":"","message":"said \"hi\", twice"}` + "\n" +
+				`{"timestamp":"2017-06-01T12:00:01Z","pod":"web-1","node":"","message":"bye"}` + "\n"},
+	} {
+		var buf bytes.Buffer
+		for _, event := range events {
+			if err := test.format(&buf, event); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if buf.String() != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, buf.String(), test.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// serviceAccountNamespaceFile contains the namespace of the pod ktail is
+// running in, when running in a cluster.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// shouldUseInClusterConfig returns true if ktail appears to be running in a
+// pod and has not been pointed at a kubeconfig, context or cluster.
+func shouldUseInClusterConfig(
+	kubeconfigPath, contextName, clusterName string,
+	getenv func(string) string,
+	fileExists func(string) bool) bool {
+	if getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return false
+	}
+	if kubeconfigPath != "" || contextName != "" || clusterName != "" ||
+		getenv("KUBECONFIG") != "" {
+		return false
+	}
+	return !fileExists(clientcmd.RecommendedHomeFile)
+}
+
+// loadConfig returns the client configuration and the default namespace,
+// using the in-cluster configuration when appropriate and kubeconfig
+// otherwise. The context and cluster, if given, override those selected by
+// the kubeconfig, and must exist in it.
+func loadConfig(kubeconfigPath, contextName, clusterName string) (*rest.Config, string, error) {
+	if shouldUseInClusterConfig(kubeconfigPath, contextName, clusterName, os.Getenv, fileExists) {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, "", err
+		}
+		namespace := v1.NamespaceDefault
+		if data, err := ioutil.ReadFile(serviceAccountNamespaceFile); err == nil {
+			if ns := strings.TrimSpace(string(data)); ns != "" {
+				namespace = ns
+			}
+		}
+		return config, namespace, nil
+	}
+
+	if kubeconfigPath == "" {
+		if os.Getenv("KUBECONFIG") != "" {
+			kubeconfigPath = os.Getenv("KUBECONFIG")
+		} else {
+			kubeconfigPath = clientcmd.RecommendedHomeFile
+		}
+	}
+
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{
+			ExplicitPath: kubeconfigPath,
+		},
+		&clientcmd.ConfigOverrides{
+			CurrentContext: contextName,
+			Context: clientcmdapi.Context{
+				Cluster: clusterName,
+			},
+		})
+
+	rawConfig, err := clientConfig.RawConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	if contextName != "" {
+		if _, ok := rawConfig.Contexts[contextName]; !ok {
+			return nil, "", fmt.Errorf("Context %q not found in %s", contextName, kubeconfigPath)
+		}
+	}
+	if clusterName != "" {
+		if _, ok := rawConfig.Clusters[clusterName]; !ok {
+			return nil, "", fmt.Errorf("Cluster %q not found in %s", clusterName, kubeconfigPath)
+		}
+	}
+
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", err
+	}
+	if namespace == "" {
+		namespace = v1.NamespaceDefault
+	}
+	return config, namespace, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
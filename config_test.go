@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func TestShouldUseInClusterConfig(t *testing.T) {
+	inPod := map[string]string{"KUBERNETES_SERVICE_HOST": "10.0.0.1"}
+	for _, test := range []struct {
+		name                                     string
+		env                                      map[string]string
+		kubeconfigPath, contextName, clusterName string
+		homeConfig                               bool
+		want                                     bool
+	}{
+		{"in a pod", inPod, "", "", "", false, true},
+		{"outside a pod", map[string]string{}, "", "", "", false, false},
+		{"--kubeconfig", inPod, "/tmp/config", "", "", false, false},
+		{"--context", inPod, "", "prod", "", false, false},
+		{"--cluster", inPod, "", "", "prod", false, false},
+		{"KUBECONFIG", map[string]string{"KUBERNETES_SERVICE_HOST": "10.0.0.1", "KUBECONFIG": "/tmp/config"},
+			"", "", "", false, false},
+		{"home kubeconfig", inPod, "", "", "", true, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			getenv := func(key string) string { return test.env[key] }
+			fileExists := func(path string) bool {
+				return test.homeConfig && path == clientcmd.RecommendedHomeFile
+			}
+			got := shouldUseInClusterConfig(test.kubeconfigPath, test.contextName, test.clusterName, getenv, fileExists)
+			if got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: staging
+clusters:
+- name: staging
+  cluster:
+    server: https://staging.example.com
+- name: prod-eu
+  cluster:
+    server: https://prod-eu.example.com
+- name: prod-us
+  cluster:
+    server: https://prod-us.example.com
+contexts:
+- name: staging
+  context:
+    cluster: staging
+    user: dev
+    namespace: web
+- name: prod
+  context:
+    cluster: prod-us
+    user: dev
+users:
+- name: dev
+  user:
+    token: secret
+`
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ktail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name                     string
+		contextName, clusterName string
+		host, namespace          string
+		wantErr                  string
+	}{
+		{"current context", "", "", "https://staging.example.com", "web", ""},
+		{"--context", "prod", "", "https://prod-us.example.com", "default", ""},
+		{"--context and --cluster", "staging", "prod-eu", "https://prod-eu.example.com", "web", ""},
+		{"--cluster", "", "prod-eu", "https://prod-eu.example.com", "web", ""},
+		{"missing context", "dev", "", "", "", `Context "dev" not found in ` + path},
+		{"missing cluster", "prod", "prod-ap", "", "", `Cluster "prod-ap" not found in ` + path},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config, namespace, err := loadConfig(path, test.contextName, test.clusterName)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Errorf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Host != test.host {
+				t.Errorf("got host %s, want %s", config.Host, test.host)
+			}
+			if config.BearerToken != "secret" {
+				t.Errorf("got token %q, want the context's user's", config.BearerToken)
+			}
+			if namespace != test.namespace {
+				t.Errorf("got namespace %s, want %s", namespace, test.namespace)
+			}
+		})
+	}
+}
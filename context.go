@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// contextSeparator is emitted between groups of lines that aren't
+// adjacent in a container's log.
+const contextSeparator = "--"
+
+// ContextFilter passes the lines matched by a LineFilter, along with up to
+// Lines lines before and after each from the same container, like grep -C.
+// If separators are enabled, a synthetic event is emitted between groups of
+// lines that aren't adjacent.
+type ContextFilter struct {
+	filter     LineFilter
+	lines      int
+	separators bool
+	containers map[string]*lineContext
+	sync.Mutex
+}
+
+type lineContext struct {
+	before  []LogEvent
+	after   int
+	emitted bool // Whether any line has been emitted
+	gap     bool // Whether a line was skipped since the last emitted one
+}
+
+func NewContextFilter(filter LineFilter, lines int, separators bool) *ContextFilter {
+	return &ContextFilter{
+		filter:     filter,
+		lines:      lines,
+		separators: separators,
+		containers: map[string]*lineContext{},
+	}
+}
+
+// Filter passes the event, and any lines before it, to emit if they should
+// be shown.
+func (f *ContextFilter) Filter(event LogEvent, emit LogEventFunc) {
+	key := buildKey(event.Pod, event.Container)
+
+	f.Lock()
+	defer f.Unlock()
+
+	c, ok := f.containers[key]
+	if !ok {
+		c = &lineContext{}
+		f.containers[key] = c
+	}
+
+	if f.filter.Match(event.Message) {
+		if c.emitted && c.gap && f.separators {
+			separator := event
+			separator.Message = contextSeparator
+			separator.Synthetic = true
+			emit(separator)
+		}
+		for _, before := range c.before {
+			emit(before)
+		}
+		emit(event)
+		c.before, c.after, c.emitted, c.gap = c.before[:0], f.lines, true, false
+		return
+	}
+
+	if c.after > 0 {
+		c.after--
+		emit(event)
+		return
+	}
+	c.before = append(c.before, event)
+	if len(c.before) > f.lines {
+		c.before = c.before[1:]
+		c.gap = true
+	}
+}
+
+// CloseContainer forgets the lines held for a container.
+func (f *ContextFilter) CloseContainer(pod *v1.Pod, container *v1.Container) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.containers, buildKey(pod, container))
+}
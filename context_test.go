@@ -0,0 +1,46 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestContextFilter(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	filter := LineFilter{Include: []*regexp.Regexp{regexp.MustCompile("^match")}}
+	for _, test := range []struct {
+		name       string
+		lines      int
+		separators bool
+		input      string
+		want       string
+	}{
+		{"before and after", 1, true, "a b match1 c d", "b match1 c"},
+		{"adjacent groups", 1, true, "match1 a match2", "match1 a match2"},
+		{"separated groups", 1, true, "match1 a b c match2", "match1 a -- c match2"},
+		{"without separators", 1, false, "match1 a b c match2", "match1 a c match2"},
+		{"no separator before the first group", 1, true, "a b match1", "b match1"},
+		{"overlapping context", 2, true, "a match1 b match2 c d e", "a match1 b match2 c d"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			f := NewContextFilter(filter, test.lines, test.separators)
+			var got []string
+			for _, message := range strings.Fields(test.input) {
+				f.Filter(testEvent(pod, "app", time.Now(), message), func(event LogEvent) {
+					if event.Synthetic != (event.Message == contextSeparator) {
+						t.Errorf("got Synthetic %t for %q", event.Synthetic, event.Message)
+					}
+					got = append(got, event.Message)
+				})
+			}
+			if strings.Join(got, " ") != test.want {
+				t.Errorf("got %q, want %q", strings.Join(got, " "), test.want)
+			}
+		})
+	}
+}
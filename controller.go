@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/tools/cache"
@@ -24,6 +29,14 @@ type (
 
 	ContainerErrorFunc func(pod *v1.Pod,
 		container *v1.Container, err error)
+
+	ContainerReconnectFunc func(pod *v1.Pod,
+		container *v1.Container)
+
+	ContainerFilterFunc func(pod *v1.Pod,
+		container *v1.Container) bool
+
+	PodFilterFunc func(pod *v1.Pod) bool
 )
 
 type Callbacks struct {
@@ -31,34 +44,210 @@ type Callbacks struct {
 	OnEnter ContainerEnterFunc
 	OnExit  ContainerExitFunc
 	OnError ContainerErrorFunc
+
+	// OnStopped, if set, is called once a container's tailer has returned,
+	// after OnExit. No more events are delivered for the container by it.
+	OnStopped ContainerExitFunc
+
+	// OnReconnect, if set, is called when a container's log stream has been
+	// opened again after an error.
+	OnReconnect ContainerReconnectFunc
+
+	// OnQueued, if set, is called when a container is queued because the
+	// maximum number of containers are already being tailed (see
+	// WithMaxTailers). OnEnter is called once it is dequeued.
+	OnQueued ContainerExitFunc
+
+	// OnReady, if set, is called once the pods existing at startup have been
+	// processed, with the number of containers being tailed.
+	OnReady func(tailing int)
+
+	// OnDrop, if set, is called for each line dropped because the
+	// container's buffer was full (see TailOptions.BufferSize).
+	OnDrop func(pod *v1.Pod, container *v1.Container)
+
+	// OnWatchError, if set, is called when listing or watching pods has kept
+	// failing for a while, and periodically while it continues to fail.
+	// OnWatchRecover is then called once it succeeds again.
+	OnWatchError   func(err error, failingFor time.Duration)
+	OnWatchRecover func(downtime time.Duration)
+
+	// OnFilteredOut, if set, is called when a pod is added that matches the
+	// selectors and the pod filter, but none of whose containers pass the
+	// filter.
+	OnFilteredOut func(pod *v1.Pod)
+
+	// OnPodEvent, if set, is called for each pod event from the watch,
+	// before it is handled.
+	OnPodEvent func(event PodEventType, pod *v1.Pod)
+}
+
+// PodEventType is the kind of a pod event from the watch.
+type PodEventType string
+
+const (
+	PodAdded   PodEventType = "added"
+	PodUpdated PodEventType = "updated"
+	PodDeleted PodEventType = "deleted"
+)
+
+// ContainerRef identifies a container of a pod.
+type ContainerRef struct {
+	Pod       *v1.Pod
+	Container *v1.Container
+}
+
+// ContainerError is an error that occurred while tailing a container.
+type ContainerError struct {
+	Pod       *v1.Pod
+	Container *v1.Container
+	Err       error
 }
 
+// informerFunc creates the informer that watches pods; it has the signature
+// of cache.NewIndexerInformer.
+type informerFunc func(lw cache.ListerWatcher, objType runtime.Object, resyncPeriod time.Duration,
+	h cache.ResourceEventHandler, indexers cache.Indexers) (cache.Indexer, cache.Controller)
+
 type Controller struct {
-	clientset     *kubernetes.Clientset
-	tailers       map[string]*ContainerTailer
-	namespace     string
-	labelSelector labels.Selector
-	callbacks     Callbacks
+	droppedErrors         int64 // First for 64-bit alignment of atomic ops
+	clientset             kubernetes.Interface
+	cluster               string
+	tailers               map[string]*ContainerTailer
+	restartCounts         map[string]int32
+	waitingReasons        map[string]string
+	namespace             string
+	labelSelectors        []labels.Selector
+	fieldSelector         fields.Selector
+	podFilter             PodFilterFunc
+	filter                ContainerFilterFunc
+	includeInitContainers bool
+	includeSucceeded      bool
+	includeFailed         bool
+	resyncPeriod          time.Duration
+	restartMarkers        bool
+	waitingMarkers        bool
+	maxTailers            int
+	idleTimeout           time.Duration
+	startPosition         func(pod *v1.Pod, container *v1.Container) *time.Time
+	running               int
+	queue                 []queuedTailer
+	tailOptions           TailOptions
+	logStream             logStreamFunc // Replaces the clientset's, if set
+	newInformer           informerFunc  // Replaces cache.NewIndexerInformer, if set
+	callbacks             Callbacks
+	errors                chan ContainerError
+	errorsClosed          bool
+	errorsMutex           sync.RWMutex
+	stopCh                chan struct{}
+	stopOnce              sync.Once
+	wg                    sync.WaitGroup
 	sync.Mutex
 }
 
+// queuedTailer is a tailer waiting for fewer than the maximum number of
+// tailers to be running.
+type queuedTailer struct {
+	tailer     *ContainerTailer
+	initialAdd bool
+}
+
+// NewController returns a controller configured from positional arguments.
+// It is equivalent to NewControllerWithOptions with the corresponding
+// options.
 func NewController(
-	clientset *kubernetes.Clientset,
+	clientset kubernetes.Interface,
 	namespace string,
 	labelSelector labels.Selector,
+	fieldSelector fields.Selector,
+	filter ContainerFilterFunc,
+	includeInitContainers bool,
+	resyncPeriod time.Duration,
+	tailOptions TailOptions,
 	callbacks Callbacks) *Controller {
-	return &Controller{
-		clientset:     clientset,
-		tailers:       map[string]*ContainerTailer{},
-		namespace:     namespace,
-		labelSelector: labelSelector,
-		callbacks:     callbacks,
+	return NewControllerWithOptions(clientset,
+		WithNamespace(namespace),
+		WithLabelSelector(labelSelector),
+		WithFieldSelector(fieldSelector),
+		WithFilter(filter),
+		WithInitContainers(includeInitContainers),
+		WithResyncPeriod(resyncPeriod),
+		WithTailOptions(tailOptions),
+		WithCallbacks(callbacks))
+}
+
+// NewControllerWithOptions returns a controller for the clientset. By
+// default it watches all pods in all namespaces, including init containers.
+func NewControllerWithOptions(clientset kubernetes.Interface, options ...Option) *Controller {
+	ctl := &Controller{
+		clientset:             clientset,
+		tailers:               map[string]*ContainerTailer{},
+		restartCounts:         map[string]int32{},
+		waitingReasons:        map[string]string{},
+		namespace:             v1.NamespaceAll,
+		labelSelectors:        []labels.Selector{labels.Everything()},
+		fieldSelector:         fields.Everything(),
+		includeInitContainers: true,
+		stopCh:                make(chan struct{}),
+	}
+	for _, option := range options {
+		option(ctl)
+	}
+	if ctl.callbacks.OnEvent == nil {
+		ctl.callbacks.OnEvent = func(LogEvent) {}
+	}
+	if ctl.callbacks.OnEnter == nil {
+		ctl.callbacks.OnEnter = func(*v1.Pod, *v1.Container, bool) bool { return true }
+	}
+	if ctl.callbacks.OnExit == nil {
+		ctl.callbacks.OnExit = func(*v1.Pod, *v1.Container) {}
+	}
+	if ctl.callbacks.OnError == nil {
+		ctl.callbacks.OnError = func(*v1.Pod, *v1.Container, error) {}
+	}
+	if ctl.callbacks.OnStopped == nil {
+		ctl.callbacks.OnStopped = func(*v1.Pod, *v1.Container) {}
 	}
+	if ctl.callbacks.OnReconnect == nil {
+		ctl.callbacks.OnReconnect = func(*v1.Pod, *v1.Container) {}
+	}
+	if ctl.callbacks.OnQueued == nil {
+		ctl.callbacks.OnQueued = func(*v1.Pod, *v1.Container) {}
+	}
+	if ctl.callbacks.OnReady == nil {
+		ctl.callbacks.OnReady = func(int) {}
+	}
+	if ctl.callbacks.OnDrop == nil {
+		ctl.callbacks.OnDrop = func(*v1.Pod, *v1.Container) {}
+	}
+	if ctl.callbacks.OnWatchError == nil {
+		ctl.callbacks.OnWatchError = func(error, time.Duration) {}
+	}
+	if ctl.callbacks.OnWatchRecover == nil {
+		ctl.callbacks.OnWatchRecover = func(time.Duration) {}
+	}
+	if ctl.callbacks.OnFilteredOut == nil {
+		ctl.callbacks.OnFilteredOut = func(*v1.Pod) {}
+	}
+	if ctl.callbacks.OnPodEvent == nil {
+		ctl.callbacks.OnPodEvent = func(PodEventType, *v1.Pod) {}
+	}
+	if ctl.cluster != "" {
+		onEvent := ctl.callbacks.OnEvent
+		ctl.callbacks.OnEvent = func(event LogEvent) {
+			event.Cluster = ctl.cluster
+			onEvent(event)
+		}
+	}
+	return ctl
 }
 
-func (ctl *Controller) Run() {
-	podListWatcher := cache.NewListWatchFromClient(
-		ctl.clientset.CoreV1Client.RESTClient(), "pods", ctl.namespace, fields.Everything())
+// Run watches pods and tails their containers until the context is
+// cancelled or Stop is called, at which point all tailers are stopped. In
+// no-follow mode, Run instead returns once the containers running at
+// startup have been read to the end.
+func (ctl *Controller) Run(ctx context.Context) {
+	podListWatcher := ctl.newPodListWatch()
 
 	obj, err := podListWatcher.List(metav1.ListOptions{})
 	if err != nil {
@@ -69,53 +258,187 @@ func (ctl *Controller) Run() {
 			ctl.onInitialAdd(&pod)
 		}
 	}
+	ctl.callbacks.OnReady(ctl.TailerCount())
 
-	_, informer := cache.NewIndexerInformer(
-		podListWatcher, &v1.Pod{}, 0, cache.ResourceEventHandlerFuncs{
+	if ctl.tailOptions.NoFollow {
+		done := make(chan struct{})
+		go func() {
+			ctl.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-ctx.Done():
+			ctl.Stop()
+		case <-done:
+		}
+		return
+	}
+
+	watchdog := &watchdog{
+		threshold: watchdogThreshold,
+		onError:   ctl.callbacks.OnWatchError,
+		onRecover: ctl.callbacks.OnWatchRecover,
+	}
+	newInformer := ctl.newInformer
+	if newInformer == nil {
+		newInformer = cache.NewIndexerInformer
+	}
+	indexer, informer := newInformer(
+		watchdog.wrap(podListWatcher), &v1.Pod{}, ctl.resyncPeriod, cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
 				if pod, ok := obj.(*v1.Pod); ok {
+					ctl.callbacks.OnPodEvent(PodAdded, pod)
 					ctl.onAdd(pod)
 				}
 			},
 			UpdateFunc: func(old interface{}, new interface{}) {
 				if pod, ok := new.(*v1.Pod); ok {
+					ctl.callbacks.OnPodEvent(PodUpdated, pod)
 					ctl.onUpdate(pod)
 				}
 			},
 			DeleteFunc: func(obj interface{}) {
 				if pod, ok := obj.(*v1.Pod); ok {
+					ctl.callbacks.OnPodEvent(PodDeleted, pod)
 					ctl.onDelete(pod)
 				}
 			},
 		}, cache.Indexers{})
 
-	stopCh := make(chan struct{}, 1)
-	go informer.Run(stopCh)
-	<-stopCh
+	go informer.Run(ctl.stopCh)
+	if ctl.idleTimeout > 0 {
+		go ctl.reapIdleTailers(indexer)
+	}
+	select {
+	case <-ctx.Done():
+		ctl.Stop()
+	case <-ctl.stopCh:
+	}
 }
 
-func (ctl *Controller) onInitialAdd(pod *v1.Pod) {
-	for _, container := range pod.Spec.InitContainers {
-		if ctl.shouldIncludeContainer(pod, &container) {
-			ctl.addContainer(pod, &container, true)
+// Stop stops the informer and all tailers, and waits for the tailers to
+// exit. The error channel, if any, is then closed. It is safe to call more
+// than once.
+func (ctl *Controller) Stop() {
+	ctl.stopOnce.Do(func() {
+		close(ctl.stopCh)
+	})
+
+	ctl.Lock()
+	ctl.queue = nil
+	for key, tailer := range ctl.tailers {
+		delete(ctl.tailers, key)
+		tailer.Stop()
+		ctl.callbacks.OnExit(&tailer.pod, &tailer.container)
+	}
+	ctl.Unlock()
+
+	ctl.wg.Wait()
+
+	ctl.errorsMutex.Lock()
+	defer ctl.errorsMutex.Unlock()
+	if ctl.errors != nil && !ctl.errorsClosed {
+		ctl.errorsClosed = true
+		close(ctl.errors)
+	}
+}
+
+// reapIdleTailers periodically stops tailers that have received nothing
+// for the idle timeout and whose container is no longer running, according
+// to the informer. This recovers from missed deletions, and from streams
+// that hang without the connection failing.
+func (ctl *Controller) reapIdleTailers(indexer cache.Indexer) {
+	ticker := time.NewTicker(ctl.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctl.stopCh:
+			return
+		case now := <-ticker.C:
+			ctl.Lock()
+			for key, tailer := range ctl.tailers {
+				if tailer.idleTime(now) < ctl.idleTimeout || containerRunning(indexer, tailer) {
+					continue
+				}
+				delete(ctl.tailers, key)
+				tailer.Stop()
+				ctl.callbacks.OnExit(&tailer.pod, &tailer.container)
+			}
+			ctl.Unlock()
 		}
 	}
-	for _, container := range pod.Spec.Containers {
-		if ctl.shouldIncludeContainer(pod, &container) {
-			ctl.addContainer(pod, &container, true)
+}
+
+// containerRunning returns true if the informer knows the tailer's pod, and
+// its container is running.
+func containerRunning(indexer cache.Indexer, tailer *ContainerTailer) bool {
+	obj, exists, err := indexer.GetByKey(tailer.pod.Namespace + "/" + tailer.pod.Name)
+	if err != nil || !exists {
+		return false
+	}
+	pod, ok := obj.(*v1.Pod)
+	if !ok || pod.UID != tailer.pod.UID {
+		return false
+	}
+	status := findContainerStatus(pod, &tailer.container)
+	return status != nil && status.State.Running != nil
+}
+
+// MatchingContainers lists the pods once, and returns the containers that
+// Run would start tailing at this point, without tailing them.
+func (ctl *Controller) MatchingContainers() ([]ContainerRef, error) {
+	obj, err := ctl.newPodListWatch().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var refs []ContainerRef
+	if podList, ok := obj.(*v1.PodList); ok {
+		for i := range podList.Items {
+			pod := &podList.Items[i]
+			for _, container := range ctl.podContainers(pod) {
+				if ctl.shouldIncludeContainer(pod, container) || ctl.shouldIncludeExited(pod, container) {
+					refs = append(refs, ContainerRef{Pod: pod, Container: container})
+				}
+			}
 		}
 	}
+	return refs, nil
 }
 
-func (ctl *Controller) onAdd(pod *v1.Pod) {
-	for _, container := range pod.Spec.InitContainers {
-		if ctl.shouldIncludeContainer(pod, &container) {
-			ctl.addContainer(pod, &container, false)
+// newPodListWatch returns a list-watch for the pods in the namespace that
+// match the field selector.
+func (ctl *Controller) newPodListWatch() *cache.ListWatch {
+	pods := ctl.clientset.CoreV1().Pods(ctl.namespace)
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = ctl.fieldSelector.String()
+			return pods.List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = ctl.fieldSelector.String()
+			return pods.Watch(options)
+		},
+	}
+}
+
+func (ctl *Controller) onInitialAdd(pod *v1.Pod) {
+	ctl.recordRestartCounts(pod)
+	ctl.noteFilteredOut(pod)
+	for _, container := range ctl.podContainers(pod) {
+		ctl.noteWaiting(pod, container, findContainerStatus(pod, container))
+		if ctl.shouldIncludeContainer(pod, container) || ctl.shouldIncludeExited(pod, container) {
+			ctl.addContainer(pod, container, true)
 		}
 	}
-	for _, container := range pod.Spec.Containers {
-		if ctl.shouldIncludeContainer(pod, &container) {
-			ctl.addContainer(pod, &container, false)
+}
+
+func (ctl *Controller) onAdd(pod *v1.Pod) {
+	ctl.recordRestartCounts(pod)
+	ctl.noteFilteredOut(pod)
+	for _, container := range ctl.podContainers(pod) {
+		ctl.noteWaiting(pod, container, findContainerStatus(pod, container))
+		if ctl.shouldIncludeContainer(pod, container) || ctl.shouldIncludeExited(pod, container) {
+			ctl.addContainer(pod, container, false)
 		}
 	}
 }
@@ -123,8 +446,10 @@ func (ctl *Controller) onAdd(pod *v1.Pod) {
 func (ctl *Controller) onUpdate(pod *v1.Pod) {
 	ctl.onUpdateWithContainers(pod, pod.Spec.Containers,
 		pod.Status.ContainerStatuses)
-	ctl.onUpdateWithContainers(pod, pod.Spec.InitContainers,
-		pod.Status.InitContainerStatuses)
+	if ctl.includeInitContainers {
+		ctl.onUpdateWithContainers(pod, pod.Spec.InitContainers,
+			pod.Status.InitContainerStatuses)
+	}
 }
 
 func (ctl *Controller) onUpdateWithContainers(pod *v1.Pod,
@@ -144,29 +469,218 @@ func (ctl *Controller) onUpdateWithContainers(pod *v1.Pod,
 			continue
 		}
 
+		ctl.noteRestart(pod, container, &containerStatus)
+		ctl.noteWaiting(pod, container, &containerStatus)
 		if ctl.shouldIncludeContainer(pod, container) {
 			ctl.addContainer(pod, container, false)
-		} else {
+		} else if !ctl.isReadingExited(pod, container) {
 			ctl.deleteContainer(pod, container)
 		}
 	}
 }
 
 func (ctl *Controller) onDelete(pod *v1.Pod) {
-	for _, container := range pod.Spec.Containers {
-		ctl.deleteContainer(pod, &container)
+	for _, container := range ctl.podContainers(pod) {
+		ctl.deleteContainer(pod, container)
+
+		ctl.Lock()
+		delete(ctl.restartCounts, buildKey(pod, container))
+		delete(ctl.waitingReasons, buildKey(pod, container))
+		ctl.Unlock()
+	}
+}
+
+// noteFilteredOut calls the filtered-out callback if the pod matches the
+// selectors and the pod filter, but the filter rejects all of its
+// containers.
+func (ctl *Controller) noteFilteredOut(pod *v1.Pod) {
+	if ctl.filter == nil || !ctl.shouldIncludePod(pod) {
+		return
+	}
+	for _, container := range ctl.podContainers(pod) {
+		if ctl.filter(pod, container) {
+			return
+		}
+	}
+	ctl.callbacks.OnFilteredOut(pod)
+}
+
+// recordRestartCounts remembers the restart counts of a newly seen pod, so
+// that only restarts after this point are reported.
+func (ctl *Controller) recordRestartCounts(pod *v1.Pod) {
+	if !ctl.restartMarkers {
+		return
+	}
+
+	ctl.Lock()
+	defer ctl.Unlock()
+	for _, container := range ctl.podContainers(pod) {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name == container.Name {
+				ctl.restartCounts[buildKey(pod, container)] = status.RestartCount
+			}
+		}
+	}
+}
+
+// noteRestart emits a marker event through the event callback when a
+// container's restart count has increased since it was last seen.
+func (ctl *Controller) noteRestart(pod *v1.Pod, container *v1.Container,
+	status *v1.ContainerStatus) {
+	if !ctl.restartMarkers {
+		return
+	}
+
+	key := buildKey(pod, container)
+	ctl.Lock()
+	previous, seen := ctl.restartCounts[key]
+	ctl.restartCounts[key] = status.RestartCount
+	ctl.Unlock()
+
+	if !seen || status.RestartCount <= previous {
+		return
+	}
+	if !ctl.shouldIncludePod(pod) || (ctl.filter != nil && !ctl.filter(pod, container)) {
+		return
+	}
+	ctl.emitMarker(pod, container,
+		fmt.Sprintf("=== container restarted (restart #%d) ===", status.RestartCount))
+}
+
+// noteWaiting emits a marker event when a container is waiting to start
+// for a reason other than the usual ones, such as ImagePullBackOff. Each
+// reason is emitted once, until it changes.
+func (ctl *Controller) noteWaiting(pod *v1.Pod, container *v1.Container,
+	status *v1.ContainerStatus) {
+	if !ctl.waitingMarkers {
+		return
 	}
+
+	var reason, message string
+	if status != nil && status.State.Waiting != nil {
+		reason, message = status.State.Waiting.Reason, status.State.Waiting.Message
+	}
+	switch reason {
+	case "ContainerCreating", "PodInitializing":
+		reason = ""
+	}
+
+	key := buildKey(pod, container)
+	ctl.Lock()
+	previous := ctl.waitingReasons[key]
+	if reason == "" {
+		delete(ctl.waitingReasons, key)
+	} else {
+		ctl.waitingReasons[key] = reason
+	}
+	ctl.Unlock()
+
+	if reason == "" || reason == previous {
+		return
+	}
+	if !ctl.shouldIncludePod(pod) || (ctl.filter != nil && !ctl.filter(pod, container)) {
+		return
+	}
+	text := fmt.Sprintf("=== container waiting: %s ===", reason)
+	if message != "" {
+		text = fmt.Sprintf("=== container waiting: %s: %s ===", reason, message)
+	}
+	ctl.emitMarker(pod, container, text)
+}
+
+// emitMarker sends a synthetic event, not originating from the container's
+// logs, through the event callback.
+func (ctl *Controller) emitMarker(pod *v1.Pod, container *v1.Container, message string) {
+	targetPod, targetContainer := *pod, *container
+	now := time.Now()
+	ctl.callbacks.OnEvent(LogEvent{
+		Pod:            &targetPod,
+		Container:      &targetContainer,
+		Timestamp:      &now,
+		Message:        message,
+		Node:           targetPod.Spec.NodeName,
+		Labels:         targetPod.Labels,
+		PodIP:          targetPod.Status.PodIP,
+		ContainerImage: targetContainer.Image,
+		Synthetic:      true,
+
+		ContainerImageID: containerImageID(&targetPod, &targetContainer),
+	})
+}
+
+// podContainers returns pointers to the pod's containers that are
+// candidates for tailing, including init containers if enabled.
+func (ctl *Controller) podContainers(pod *v1.Pod) []*v1.Container {
+	var containers []*v1.Container
+	if ctl.includeInitContainers {
+		for i := range pod.Spec.InitContainers {
+			containers = append(containers, &pod.Spec.InitContainers[i])
+		}
+	}
+	for i := range pod.Spec.Containers {
+		containers = append(containers, &pod.Spec.Containers[i])
+	}
+	return containers
 }
 
 func (ctl *Controller) shouldIncludePod(pod *v1.Pod) bool {
-	if !ctl.labelSelector.Matches(labels.Set(pod.Labels)) {
+	if !ctl.matchesLabelSelectors(pod) {
 		return false
 	}
-	if pod.Status.Phase != v1.PodRunning &&
-		pod.Status.Phase != v1.PodPending {
+	if ctl.podFilter != nil && !ctl.podFilter(pod) {
 		return false
 	}
-	return true
+	switch pod.Status.Phase {
+	case v1.PodRunning, v1.PodPending:
+		return true
+	case v1.PodSucceeded:
+		return ctl.includeSucceeded
+	case v1.PodFailed:
+		return ctl.includeFailed
+	}
+	return false
+}
+
+// shouldIncludeExited returns true if the container belongs to a completed
+// pod that should be included, and has terminated. Such containers are only
+// picked up when their pod is first seen, and their logs are read once.
+func (ctl *Controller) shouldIncludeExited(pod *v1.Pod, container *v1.Container) bool {
+	if pod.Status.Phase != v1.PodSucceeded && pod.Status.Phase != v1.PodFailed {
+		return false
+	}
+	if !ctl.shouldIncludePod(pod) {
+		return false
+	}
+	if ctl.filter != nil && !ctl.filter(pod, container) {
+		return false
+	}
+	status := findContainerStatus(pod, container)
+	return status != nil && status.State.Terminated != nil
+}
+
+// isReadingExited returns true if the container is being tailed by a tailer
+// that reads the logs of an exited container once. Such tailers are left to
+// finish rather than being stopped when their pod is updated.
+func (ctl *Controller) isReadingExited(pod *v1.Pod, container *v1.Container) bool {
+	ctl.Lock()
+	defer ctl.Unlock()
+	key := buildKey(pod, container)
+	if i := ctl.findQueued(key); i >= 0 {
+		return ctl.queue[i].tailer.exited
+	}
+	tailer, ok := ctl.tailers[key]
+	return ok && tailer.exited
+}
+
+// matchesLabelSelectors returns true if the pod matches any of the label
+// selectors. The watch can't express this, so it is checked here.
+func (ctl *Controller) matchesLabelSelectors(pod *v1.Pod) bool {
+	for _, selector := range ctl.labelSelectors {
+		if selector.Matches(labels.Set(pod.Labels)) {
+			return true
+		}
+	}
+	return false
 }
 
 func (ctl *Controller) shouldIncludeContainer(
@@ -174,23 +688,12 @@ func (ctl *Controller) shouldIncludeContainer(
 	if !ctl.shouldIncludePod(pod) {
 		return false
 	}
-	var status *v1.ContainerStatus
-	for _, s := range pod.Status.ContainerStatuses {
-		if s.Name == container.Name {
-			status = &s
-			break
-		}
+	if ctl.filter != nil && !ctl.filter(pod, container) {
+		return false
 	}
+	status := findContainerStatus(pod, container)
 	if status == nil {
-		for _, s := range pod.Status.InitContainerStatuses {
-			if s.Name == container.Name {
-				status = &s
-				break
-			}
-		}
-		if status == nil {
-			return false
-		}
+		return false
 	}
 	if status.State.Waiting != nil || status.State.Terminated != nil ||
 		status.State.Running == nil {
@@ -199,6 +702,31 @@ func (ctl *Controller) shouldIncludeContainer(
 	return true
 }
 
+// containerImageID returns the image ID of the container from the pod's
+// status, or the empty string if it is not known yet.
+func containerImageID(pod *v1.Pod, container *v1.Container) string {
+	if status := findContainerStatus(pod, container); status != nil {
+		return status.ImageID
+	}
+	return ""
+}
+
+// findContainerStatus returns the status of a container or init container,
+// or nil if the pod has no status for it.
+func findContainerStatus(pod *v1.Pod, container *v1.Container) *v1.ContainerStatus {
+	for i, s := range pod.Status.ContainerStatuses {
+		if s.Name == container.Name {
+			return &pod.Status.ContainerStatuses[i]
+		}
+	}
+	for i, s := range pod.Status.InitContainerStatuses {
+		if s.Name == container.Name {
+			return &pod.Status.InitContainerStatuses[i]
+		}
+	}
+	return nil
+}
+
 func (ctl *Controller) addContainer(
 	pod *v1.Pod,
 	container *v1.Container,
@@ -206,23 +734,37 @@ func (ctl *Controller) addContainer(
 	ctl.Lock()
 	defer ctl.Unlock()
 
-	key := buildKey(pod, container)
-	if _, ok := ctl.tailers[key]; ok {
+	select {
+	case <-ctl.stopCh:
 		return
+	default:
 	}
 
-	if !ctl.callbacks.OnEnter(pod, container, initialAdd) {
+	key := buildKey(pod, container)
+	if _, ok := ctl.tailers[key]; ok || ctl.findQueued(key) >= 0 {
 		return
 	}
 
 	targetPod, targetContainer := *pod, *container // Copy to avoid mutation
 
 	var fromTimestamp *time.Time
-	if initialAdd {
-		// Don't show any history, but add a small amount of buffer to
-		// account for clock skew
-		now := time.Now().Add(time.Second * -5)
-		fromTimestamp = &now
+	if status := findContainerStatus(pod, container); status != nil && status.State.Terminated != nil {
+		// Read the logs of an exited container from the start
+		if ctl.tailOptions.SinceTime != nil {
+			sinceTime := *ctl.tailOptions.SinceTime
+			fromTimestamp = &sinceTime
+		}
+	} else if initialAdd {
+		if ctl.tailOptions.SinceTime != nil {
+			sinceTime := *ctl.tailOptions.SinceTime
+			fromTimestamp = &sinceTime
+		} else if ctl.tailOptions.SinceSeconds == nil && ctl.tailOptions.TailLines == nil &&
+			!ctl.tailOptions.NoFollow {
+			// Don't show any history, but add a small amount of buffer to
+			// account for clock skew
+			now := time.Now().Add(time.Second * -5)
+			fromTimestamp = &now
+		}
 	} else {
 		for _, status := range pod.Status.ContainerStatuses {
 			if status.Name == container.Name && status.State.Running != nil {
@@ -233,17 +775,192 @@ func (ctl *Controller) addContainer(
 		}
 	}
 
+	var resumeFrom *time.Time
+	if ctl.startPosition != nil {
+		if resumeFrom = ctl.startPosition(pod, container); resumeFrom != nil {
+			fromTimestamp = resumeFrom
+		}
+	}
+
 	tailer := NewContainerTailer(ctl.clientset, targetPod, targetContainer,
-		ctl.callbacks.OnEvent, fromTimestamp)
-	ctl.tailers[key] = tailer
+		ctl.callbacks.OnEvent, fromTimestamp, ctl.tailOptions)
+	if resumeFrom != nil {
+		// Skip the lines up to and including the one we resume after
+		tailer.lastTimestamp, tailer.atLast = resumeFrom, 1
+	}
+	if ctl.logStream != nil {
+		tailer.openStream = ctl.logStream
+	}
+	tailer.onDrop = func() {
+		ctl.callbacks.OnDrop(&targetPod, &targetContainer)
+	}
+	tailer.onReconnect = func() {
+		ctl.callbacks.OnReconnect(&targetPod, &targetContainer)
+	}
+
+	if ctl.maxTailers > 0 && ctl.running >= ctl.maxTailers {
+		ctl.queue = append(ctl.queue, queuedTailer{tailer: tailer, initialAdd: initialAdd})
+		ctl.callbacks.OnQueued(&targetPod, &targetContainer)
+		return
+	}
+	ctl.enterTailer(tailer, initialAdd)
+}
+
+// enterTailer adds and starts the tailer, if the enter callback accepts its
+// container. The caller must hold the lock.
+func (ctl *Controller) enterTailer(tailer *ContainerTailer, initialAdd bool) {
+	if !ctl.callbacks.OnEnter(&tailer.pod, &tailer.container, initialAdd) {
+		return
+	}
+	ctl.tailers[buildKey(&tailer.pod, &tailer.container)] = tailer
+	ctl.startTailer(tailer)
+}
 
+// startTailer runs the tailer in a goroutine. When it returns on its own,
+// such as after reading an exited container's logs, the tailer is removed
+// and the exit callback called. The next queued tailer is then started, and
+// the stopped callback called. The caller must hold the lock.
+func (ctl *Controller) startTailer(tailer *ContainerTailer) {
+	ctl.running++
+	ctl.wg.Add(1)
 	go func() {
+		defer ctl.wg.Done()
 		tailer.Run(func(err error) {
-			ctl.callbacks.OnError(&targetPod, &targetContainer, err)
+			ctl.callbacks.OnError(&tailer.pod, &tailer.container, err)
+			ctl.sendError(ContainerError{
+				Pod:       &tailer.pod,
+				Container: &tailer.container,
+				Err:       err,
+			})
 		})
+
+		ctl.Lock()
+		key := buildKey(&tailer.pod, &tailer.container)
+		if ctl.tailers[key] == tailer {
+			delete(ctl.tailers, key)
+			ctl.callbacks.OnExit(&tailer.pod, &tailer.container)
+		}
+		ctl.running--
+		ctl.startQueued()
+		ctl.Unlock()
+
+		ctl.callbacks.OnStopped(&tailer.pod, &tailer.container)
 	}()
 }
 
+// startQueued starts queued tailers while fewer than the maximum are
+// running. The caller must hold the lock.
+func (ctl *Controller) startQueued() {
+	for len(ctl.queue) > 0 && ctl.running < ctl.maxTailers {
+		select {
+		case <-ctl.stopCh:
+			ctl.queue = nil
+			return
+		default:
+		}
+		next := ctl.queue[0]
+		ctl.queue = ctl.queue[1:]
+		ctl.enterTailer(next.tailer, next.initialAdd)
+	}
+}
+
+// findQueued returns the position of the container's tailer in the queue,
+// or -1 if it isn't queued. The caller must hold the lock.
+func (ctl *Controller) findQueued(key string) int {
+	for i, queued := range ctl.queue {
+		if buildKey(&queued.tailer.pod, &queued.tailer.container) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// TailerInfo describes a container being tailed. AgeSeconds is how long it
+// has been tailed. LinesRead and BytesRead count what was read from its
+// logs, whether or not it was then written.
+type TailerInfo struct {
+	Key        string    `json:"key"`
+	Cluster    string    `json:"cluster,omitempty"`
+	Namespace  string    `json:"namespace"`
+	Pod        string    `json:"pod"`
+	Container  string    `json:"container"`
+	StartedAt  time.Time `json:"startedAt"`
+	AgeSeconds float64   `json:"ageSeconds"`
+	Dropped    int64     `json:"dropped"`
+	LinesRead  int64     `json:"linesRead"`
+	BytesRead  int64     `json:"bytesRead"`
+}
+
+// ListTailers returns a snapshot of the containers currently being tailed,
+// sorted by key.
+func (ctl *Controller) ListTailers() []TailerInfo {
+	ctl.Lock()
+	defer ctl.Unlock()
+
+	now := time.Now()
+	infos := make([]TailerInfo, 0, len(ctl.tailers))
+	for key, tailer := range ctl.tailers {
+		linesRead, bytesRead := tailer.Counts()
+		infos = append(infos, TailerInfo{
+			Key:        key,
+			Cluster:    ctl.cluster,
+			Namespace:  tailer.pod.Namespace,
+			Pod:        tailer.pod.Name,
+			Container:  tailer.container.Name,
+			StartedAt:  tailer.startedAt,
+			AgeSeconds: now.Sub(tailer.startedAt).Seconds(),
+			Dropped:    tailer.DroppedLines(),
+			LinesRead:  linesRead,
+			BytesRead:  bytesRead,
+		})
+	}
+	sort.Sort(tailerInfosByKey(infos))
+	return infos
+}
+
+type tailerInfosByKey []TailerInfo
+
+func (t tailerInfosByKey) Len() int           { return len(t) }
+func (t tailerInfosByKey) Less(i, j int) bool { return t[i].Key < t[j].Key }
+func (t tailerInfosByKey) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// TailerCount returns the number of containers currently being tailed, not
+// counting those queued.
+func (ctl *Controller) TailerCount() int {
+	ctl.Lock()
+	defer ctl.Unlock()
+	return len(ctl.tailers)
+}
+
+// Errors returns the channel that tailing errors are sent to, or nil if
+// the controller was not created with WithErrorChannel. The channel is
+// closed once Stop has stopped all tailers.
+func (ctl *Controller) Errors() <-chan ContainerError {
+	return ctl.errors
+}
+
+// DroppedErrors returns the number of errors that were discarded because
+// the error channel was full.
+func (ctl *Controller) DroppedErrors() int64 {
+	return atomic.LoadInt64(&ctl.droppedErrors)
+}
+
+func (ctl *Controller) sendError(err ContainerError) {
+	if ctl.errors == nil {
+		return
+	}
+	ctl.errorsMutex.RLock()
+	defer ctl.errorsMutex.RUnlock()
+	if ctl.errorsClosed {
+		return
+	}
+	select {
+	case ctl.errors <- err:
+	default:
+		atomic.AddInt64(&ctl.droppedErrors, 1)
+	}
+}
+
 func (ctl *Controller) deleteContainer(pod *v1.Pod, container *v1.Container) {
 	ctl.Lock()
 	defer ctl.Unlock()
@@ -253,9 +970,16 @@ func (ctl *Controller) deleteContainer(pod *v1.Pod, container *v1.Container) {
 		delete(ctl.tailers, key)
 		tailer.Stop()
 		ctl.callbacks.OnExit(pod, container)
+	} else if i := ctl.findQueued(key); i >= 0 {
+		// It was never entered, so it doesn't exit either
+		ctl.queue = append(ctl.queue[:i], ctl.queue[i+1:]...)
 	}
 }
 
+// buildKey returns a key unique to a container. The pod UID is included so
+// that a pod recreated under the same name gets a fresh tailer. Init
+// containers share the key space with regular containers, which is safe
+// because Kubernetes requires container names to be unique across both.
 func buildKey(pod *v1.Pod, container *v1.Container) string {
-	return fmt.Sprintf("%s/%s/%s", pod.Namespace, pod.Name, container.Name)
+	return fmt.Sprintf("%s/%s/%s/%s", pod.Namespace, pod.Name, pod.UID, container.Name)
 }
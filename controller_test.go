@@ -0,0 +1,1183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	ktesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+// newFakeClientset returns a clientset holding the pods, and the watch
+// through which the test sends pod events.
+func newFakeClientset(pods ...v1.Pod) (*fake.Clientset, *watch.FakeWatcher) {
+	var objects []runtime.Object
+	for i := range pods {
+		objects = append(objects, &pods[i])
+	}
+	clientset := fake.NewSimpleClientset(objects...)
+	watcher := watch.NewFake()
+	clientset.PrependWatchReactor("pods", ktesting.DefaultWatchReactor(watcher, nil))
+	return clientset, watcher
+}
+
+// runController runs the controller in the background, returning a
+// function that stops it and waits for Run to return.
+func runController(ctl *Controller) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctl.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// containerRecorder records the names of containers passed to callbacks.
+type containerRecorder struct {
+	names []string
+	sync.Mutex
+}
+
+func (r *containerRecorder) record(pod *v1.Pod, container *v1.Container) {
+	r.Lock()
+	defer r.Unlock()
+	r.names = append(r.names, container.Name)
+}
+
+func (r *containerRecorder) enter(pod *v1.Pod, container *v1.Container, initialAdd bool) bool {
+	r.record(pod, container)
+	return true
+}
+
+func (r *containerRecorder) String() string {
+	r.Lock()
+	defer r.Unlock()
+	return strings.Join(r.names, ",")
+}
+
+// podEvents records the names of the pods in events seen by a controller,
+// so that a test can wait for the events it sent to be handled.
+type podEvents struct {
+	names []string
+	syncs int
+	sync.Mutex
+}
+
+func (e *podEvents) record(event PodEventType, pod *v1.Pod) {
+	e.Lock()
+	defer e.Unlock()
+	e.names = append(e.names, pod.Name)
+}
+
+// sync sends a marker pod through the watch, and waits for the controller
+// to see it. Events are handled in order, so those sent before it have then
+// been handled.
+func (e *podEvents) sync(t *testing.T, watcher *watch.FakeWatcher) {
+	e.Lock()
+	e.syncs++
+	name := fmt.Sprintf("sync-%d", e.syncs)
+	e.Unlock()
+	watcher.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}})
+	waitFor(t, "the watch to be handled", func() bool {
+		e.Lock()
+		defer e.Unlock()
+		return len(e.names) > 0 && e.names[len(e.names)-1] == name
+	})
+}
+
+// podWithContainers returns a running pod with running containers of the
+// given names.
+func podWithContainers(names ...string) v1.Pod {
+	pod := testPod(0)
+	pod.Spec.Containers, pod.Status.ContainerStatuses = nil, nil
+	for _, name := range names {
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Name: name})
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, v1.ContainerStatus{
+			Name:  name,
+			State: v1.ContainerState{Running: &v1.ContainerStateRunning{}},
+		})
+	}
+	return pod
+}
+
+func TestController_ErrorsClosedOnStop(t *testing.T) {
+	ctl := NewControllerWithOptions(nil, WithErrorChannel(1))
+	ctl.sendError(ContainerError{Err: fmt.Errorf("first")})
+	ctl.Stop()
+	ctl.Stop()
+	ctl.sendError(ContainerError{Err: fmt.Errorf("after stop")})
+
+	var errs []string
+	for err := range ctl.Errors() {
+		errs = append(errs, err.Err.Error())
+	}
+	if len(errs) != 1 || errs[0] != "first" {
+		t.Errorf("got errors %q, want [first]", errs)
+	}
+	if n := ctl.DroppedErrors(); n != 0 {
+		t.Errorf("got %d dropped errors, want 0", n)
+	}
+}
+
+func TestController_RemovesFinishedTailers(t *testing.T) {
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name     string
+		noFollow bool
+		exited   bool
+	}{
+		{"no-follow", true, false},
+		{"exited container", false, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var exits int
+			var calls []string
+			ctl := NewControllerWithOptions(nil,
+				WithTailOptions(TailOptions{NoFollow: test.noFollow}),
+				WithCallbacks(Callbacks{
+					OnExit: func(*v1.Pod, *v1.Container) {
+						exits++
+						calls = append(calls, "exit")
+					},
+					OnStopped: func(*v1.Pod, *v1.Container) { calls = append(calls, "stopped") },
+				}))
+			ctl.logStream = (&fakeLogs{current: []string{logLine(start, "done")}}).stream
+
+			pod := testPod(0)
+			if test.exited {
+				pod.Status.Phase = v1.PodSucceeded
+				pod.Status.ContainerStatuses[0].State = v1.ContainerState{
+					Terminated: &v1.ContainerStateTerminated{},
+				}
+			}
+			ctl.addContainer(&pod, &pod.Spec.Containers[0], true)
+			ctl.wg.Wait()
+
+			if n := ctl.TailerCount(); n != 0 {
+				t.Errorf("got %d tailers after Run returned, want 0", n)
+			}
+			if exits != 1 {
+				t.Errorf("got %d exit callbacks, want 1", exits)
+			}
+			if strings.Join(calls, ",") != "exit,stopped" {
+				t.Errorf("got callbacks %q, want exit then stopped", calls)
+			}
+			ctl.Stop()
+			if exits != 1 {
+				t.Errorf("got %d exit callbacks after Stop, want 1", exits)
+			}
+		})
+	}
+}
+
+func TestController_ListTailersJSON(t *testing.T) {
+	ctl := NewControllerWithOptions(nil)
+	pod := testPod(0)
+	tailer := NewContainerTailer(nil, pod, pod.Spec.Containers[0], nil, nil, TailOptions{})
+	tailer.startedAt = time.Now().Add(-90 * time.Second)
+	ctl.tailers[buildKey(&pod, &pod.Spec.Containers[0])] = tailer
+
+	data, err := json.Marshal(ctl.ListTailers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var infos []map[string]interface{}
+	if err := json.Unmarshal(data, &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("got %d tailers, want 1", len(infos))
+	}
+	age, ok := infos[0]["ageSeconds"].(float64)
+	if !ok || age < 90 || age > 100 {
+		t.Errorf("got ageSeconds %v in %s, want about 90", infos[0]["ageSeconds"], data)
+	}
+}
+
+// blockingLogs serves streams that have no data until they are closed.
+func blockingLogs(pod *v1.Pod, options *v1.PodLogOptions) (io.ReadCloser, error) {
+	r, _ := io.Pipe()
+	return r, nil
+}
+
+// waitFor polls the condition until it holds, failing the test after a
+// second.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestController_MaxTailers(t *testing.T) {
+	var mu sync.Mutex
+	var entered, queued, errors []string
+	record := func(list *[]string) ContainerExitFunc {
+		return func(pod *v1.Pod, container *v1.Container) {
+			mu.Lock()
+			defer mu.Unlock()
+			*list = append(*list, container.Name)
+		}
+	}
+	recorded := func(list *[]string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.Join(*list, ",")
+	}
+	ctl := NewControllerWithOptions(nil,
+		WithMaxTailers(2),
+		WithCallbacks(Callbacks{
+			OnEnter: func(pod *v1.Pod, container *v1.Container, initialAdd bool) bool {
+				record(&entered)(pod, container)
+				return true
+			},
+			OnQueued: record(&queued),
+			OnError: func(pod *v1.Pod, container *v1.Container, err error) {
+				record(&errors)(pod, container)
+			},
+		}))
+	ctl.logStream = blockingLogs
+	defer ctl.Stop()
+
+	pod := testPod(0)
+	pod.Spec.Containers = []v1.Container{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}
+	for _, container := range pod.Spec.Containers[:3] {
+		ctl.addContainer(&pod, &container, true)
+	}
+	if got := recorded(&entered); got != "a,b" {
+		t.Errorf("got %q entered, want a,b", got)
+	}
+	if got := recorded(&queued); got != "c" {
+		t.Errorf("got %q queued, want c", got)
+	}
+	if n := ctl.TailerCount(); n != 2 {
+		t.Errorf("got %d tailers, want 2", n)
+	}
+	if n := len(ctl.ListTailers()); n != 2 {
+		t.Errorf("got %d tailers listed, want 2", n)
+	}
+
+	// A queued container that goes away is never tailed
+	ctl.addContainer(&pod, &pod.Spec.Containers[3], false)
+	ctl.deleteContainer(&pod, &pod.Spec.Containers[3])
+
+	ctl.deleteContainer(&pod, &pod.Spec.Containers[0])
+	waitFor(t, "the queued container to start", func() bool { return recorded(&entered) == "a,b,c" })
+	if n := ctl.TailerCount(); n != 2 {
+		t.Errorf("got %d tailers, want 2", n)
+	}
+	if got := recorded(&errors); got != "" {
+		t.Errorf("got errors for %q, want none", got)
+	}
+}
+
+func TestController_AddsEachContainer(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		initialAdd bool
+	}{
+		{"initial add", true},
+		{"add", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var entered []*v1.Container
+			ctl := NewControllerWithOptions(nil,
+				WithInitContainers(true),
+				WithCallbacks(Callbacks{
+					OnEnter: func(pod *v1.Pod, container *v1.Container, initialAdd bool) bool {
+						mu.Lock()
+						defer mu.Unlock()
+						entered = append(entered, container)
+						return true
+					},
+				}))
+			ctl.logStream = blockingLogs
+			defer ctl.Stop()
+
+			pod := testPod(0)
+			running := v1.ContainerState{Running: &v1.ContainerStateRunning{}}
+			pod.Spec.InitContainers = []v1.Container{{Name: "init"}}
+			pod.Spec.Containers = []v1.Container{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+			pod.Status.InitContainerStatuses = []v1.ContainerStatus{{Name: "init", State: running}}
+			pod.Status.ContainerStatuses = []v1.ContainerStatus{
+				{Name: "a", State: running}, {Name: "b", State: running}, {Name: "c", State: running},
+			}
+			if test.initialAdd {
+				ctl.onInitialAdd(&pod)
+			} else {
+				ctl.onAdd(&pod)
+			}
+
+			mu.Lock()
+			var names []string
+			for _, container := range entered {
+				names = append(names, container.Name)
+			}
+			mu.Unlock()
+			if got := strings.Join(names, ","); got != "init,a,b,c" {
+				t.Errorf("got %q entered, want init,a,b,c", got)
+			}
+			if n := ctl.TailerCount(); n != 4 {
+				t.Errorf("got %d tailers, want 4", n)
+			}
+			ctl.onDelete(&pod)
+			if n := ctl.TailerCount(); n != 0 {
+				t.Errorf("got %d tailers after the pod was deleted, want 0", n)
+			}
+		})
+	}
+}
+
+func TestController_ReapIdleTailers(t *testing.T) {
+	running := v1.ContainerState{Running: &v1.ContainerStateRunning{}}
+	terminated := v1.ContainerState{Terminated: &v1.ContainerStateTerminated{}}
+	for _, test := range []struct {
+		name       string
+		known      bool
+		uid        string
+		state      v1.ContainerState
+		wantReaped bool
+	}{
+		{"still running", true, "uid-1", running, false},
+		{"terminated", true, "uid-1", terminated, true},
+		{"pod gone", false, "", running, true},
+		{"pod recreated", true, "uid-2", running, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var exits int32
+			ctl := NewControllerWithOptions(nil,
+				WithIdleTimeout(20*time.Millisecond),
+				WithCallbacks(Callbacks{
+					OnExit: func(*v1.Pod, *v1.Container) { atomic.AddInt32(&exits, 1) },
+				}))
+			ctl.logStream = blockingLogs
+			pod := testPod(0)
+			ctl.addContainer(&pod, &pod.Spec.Containers[0], true)
+
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			if test.known {
+				known := testPod(0)
+				known.UID = types.UID(test.uid)
+				known.Status.ContainerStatuses[0].State = test.state
+				_ = indexer.Add(&known)
+			}
+			go ctl.reapIdleTailers(indexer)
+			defer ctl.Stop()
+
+			if test.wantReaped {
+				waitFor(t, "the tailer to be reaped", func() bool { return ctl.TailerCount() == 0 })
+				if n := atomic.LoadInt32(&exits); n != 1 {
+					t.Errorf("got %d exit callbacks, want 1", n)
+				}
+			} else {
+				time.Sleep(100 * time.Millisecond)
+				if n := ctl.TailerCount(); n != 1 {
+					t.Errorf("got %d tailers, want the running one kept", n)
+				}
+			}
+		})
+	}
+}
+
+func TestController_RunStopsOnCancel(t *testing.T) {
+	web1, web2 := testPod(0), testPod(0)
+	web2.Name, web2.UID = "web-2", "uid-2"
+	var stopped int32
+	ctl := NewControllerWithOptions(fake.NewSimpleClientset(&web1, &web2),
+		WithCallbacks(Callbacks{
+			OnStopped: func(*v1.Pod, *v1.Container) { atomic.AddInt32(&stopped, 1) },
+		}))
+	ctl.logStream = blockingLogs
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctl.Run(ctx)
+	}()
+	waitFor(t, "both pods to be tailed", func() bool { return ctl.TailerCount() == 2 })
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+	if n := ctl.TailerCount(); n != 0 {
+		t.Errorf("got %d tailers after Run returned, want 0", n)
+	}
+	if n := atomic.LoadInt32(&stopped); n != 2 {
+		t.Errorf("got %d tailers stopped, want 2", n)
+	}
+}
+
+func TestController_MultipleClusters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ktail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sink, err := NewFileSink(dir, 0, false, messageFormatter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same pod runs in both clusters
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	tagged := map[string]string{}
+	var wg sync.WaitGroup
+	for _, cluster := range []string{"prod-eu", "prod-us"} {
+		pod := testPod(0)
+		cluster := cluster
+		ctl := NewControllerWithOptions(fake.NewSimpleClientset(&pod),
+			WithCluster(cluster),
+			WithTailOptions(TailOptions{NoFollow: true}),
+			WithCallbacks(Callbacks{
+				OnEvent: func(event LogEvent) {
+					mu.Lock()
+					tagged[event.Message] = event.Cluster
+					mu.Unlock()
+					if err := sink.Write(event); err != nil {
+						t.Error(err)
+					}
+				},
+				OnStopped: func(pod *v1.Pod, container *v1.Container) {
+					_ = closeContainer(sink, cluster, pod, container)
+				},
+			}))
+		ctl.logStream = (&fakeLogs{current: []string{logLine(start, "from "+cluster)}}).stream
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctl.Run(context.Background())
+		}()
+	}
+	wg.Wait()
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cluster := range []string{"prod-eu", "prod-us"} {
+		if got := tagged["from "+cluster]; got != cluster {
+			t.Errorf("got line from %s tagged %q", cluster, got)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, cluster+"_default_web-1_app.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "from " + cluster + "\n"; string(data) != want {
+			t.Errorf("got %q in the %s file, want %q", data, cluster, want)
+		}
+	}
+}
+
+func TestController_FilteredOut(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		filter     ContainerFilter
+		wantCalled bool
+	}{
+		{"container filtered out", ContainerFilter{Include: patterns("^sidecar$")}, true},
+		{"namespace excluded", ContainerFilter{ExcludeNamespaces: map[string]bool{"default": true}}, false},
+		{"pod excluded", ContainerFilter{ExcludePods: patterns("^web")}, false},
+		{"other pod IP", ContainerFilter{PodIPs: map[string]bool{"10.0.0.6": true}}, false},
+		{"tailed", ContainerFilter{Include: patterns("^app$")}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var called bool
+			ctl := NewControllerWithOptions(nil,
+				WithPodFilter(test.filter.MatchPod),
+				WithFilter(test.filter.Match),
+				WithCallbacks(Callbacks{
+					OnFilteredOut: func(*v1.Pod) { called = true },
+				}))
+			ctl.logStream = blockingLogs
+			defer ctl.Stop()
+
+			pod := testPod(0)
+			ctl.onAdd(&pod)
+			if called != test.wantCalled {
+				t.Errorf("got filtered-out callback %v, want %v", called, test.wantCalled)
+			}
+		})
+	}
+}
+
+func TestController_TailsOnlyMatchingContainers(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		initial bool
+	}{
+		{"existing pod", true},
+		{"added pod", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pod := podWithContainers("app", "sidecar", "proxy")
+			var initialPods []v1.Pod
+			if test.initial {
+				initialPods = append(initialPods, pod)
+			}
+			clientset, watcher := newFakeClientset(initialPods...)
+			entered, events := &containerRecorder{}, &podEvents{}
+			ctl := NewControllerWithOptions(clientset,
+				WithFilter(ContainerFilter{Include: patterns("^sidecar$")}.Match),
+				WithCallbacks(Callbacks{OnEnter: entered.enter, OnPodEvent: events.record}))
+			ctl.logStream = blockingLogs
+			defer runController(ctl)()
+
+			if !test.initial {
+				watcher.Add(&pod)
+			}
+			events.sync(t, watcher)
+			if got := entered.String(); got != "sidecar" {
+				t.Errorf("got %q tailed, want only sidecar", got)
+			}
+		})
+	}
+}
+
+func TestController_StartsContainersOnUpdate(t *testing.T) {
+	clientset, watcher := newFakeClientset()
+	entered, events := &containerRecorder{}, &podEvents{}
+	ctl := NewControllerWithOptions(clientset,
+		WithCallbacks(Callbacks{OnEnter: entered.enter, OnPodEvent: events.record}))
+	ctl.logStream = blockingLogs
+	defer runController(ctl)()
+
+	pod := podWithContainers("app", "sidecar")
+	pod.Status.Phase = v1.PodPending
+	for i := range pod.Status.ContainerStatuses {
+		pod.Status.ContainerStatuses[i].State = v1.ContainerState{
+			Waiting: &v1.ContainerStateWaiting{Reason: "ContainerCreating"},
+		}
+	}
+	watcher.Add(&pod)
+	events.sync(t, watcher)
+	if got := entered.String(); got != "" {
+		t.Fatalf("got %q tailed while pending, want none", got)
+	}
+
+	running := podWithContainers("app", "sidecar")
+	watcher.Modify(&running)
+	watcher.Modify(&running)
+	events.sync(t, watcher)
+	if got := entered.String(); got != "app,sidecar" {
+		t.Errorf("got %q tailed once running, want app,sidecar once each", got)
+	}
+	if n := ctl.TailerCount(); n != 2 {
+		t.Errorf("got %d tailers, want 2", n)
+	}
+}
+
+func TestController_AllNamespaces(t *testing.T) {
+	web, dns := testPod(0), testPod(0)
+	dns.Namespace, dns.Name, dns.UID = "kube-system", "dns-1", "uid-2"
+	clientset, _ := newFakeClientset(web, dns)
+	ctl := NewControllerWithOptions(clientset, WithNamespace(v1.NamespaceAll))
+	ctl.logStream = blockingLogs
+	defer runController(ctl)()
+
+	waitFor(t, "both pods to be tailed", func() bool { return ctl.TailerCount() == 2 })
+	var namespaces []string
+	for _, info := range ctl.ListTailers() {
+		namespaces = append(namespaces, info.Namespace)
+	}
+	if got := strings.Join(namespaces, ","); got != "default,kube-system" {
+		t.Errorf("got tailers in %q, want default and kube-system", got)
+	}
+}
+
+func TestController_NoErrorsWhilePending(t *testing.T) {
+	clientset, watcher := newFakeClientset()
+	errors, entered, events := &containerRecorder{}, &containerRecorder{}, &podEvents{}
+	ctl := NewControllerWithOptions(clientset,
+		WithCallbacks(Callbacks{
+			OnEnter:    entered.enter,
+			OnError:    func(pod *v1.Pod, container *v1.Container, err error) { errors.record(pod, container) },
+			OnPodEvent: events.record,
+		}))
+	// Like the API server, refuse logs of containers that haven't started
+	ctl.logStream = func(pod *v1.Pod, options *v1.PodLogOptions) (io.ReadCloser, error) {
+		if status := findContainerStatus(pod, &pod.Spec.Containers[0]); status.State.Running == nil {
+			return nil, fmt.Errorf("container %q is waiting to start", options.Container)
+		}
+		return blockingLogs(pod, options)
+	}
+	defer runController(ctl)()
+
+	pod := testPod(0)
+	pod.Status.Phase = v1.PodPending
+	pod.Status.ContainerStatuses[0].State = v1.ContainerState{
+		Waiting: &v1.ContainerStateWaiting{Reason: "ContainerCreating"},
+	}
+	watcher.Add(&pod)
+	events.sync(t, watcher)
+
+	running := testPod(0)
+	watcher.Modify(&running)
+	events.sync(t, watcher)
+	if got := entered.String(); got != "app" {
+		t.Errorf("got %q tailed, want app", got)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := errors.String(); got != "" {
+		t.Errorf("got errors for %q, want none", got)
+	}
+}
+
+func TestController_TailsOnlyRunningContainers(t *testing.T) {
+	pod := podWithContainers("app", "sidecar")
+	pod.Status.ContainerStatuses[1].State = v1.ContainerState{
+		Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff"},
+	}
+	clientset, watcher := newFakeClientset(pod)
+	entered, events := &containerRecorder{}, &podEvents{}
+	ctl := NewControllerWithOptions(clientset,
+		WithCallbacks(Callbacks{OnEnter: entered.enter, OnPodEvent: events.record}))
+	ctl.logStream = blockingLogs
+	defer runController(ctl)()
+
+	events.sync(t, watcher)
+	if got := entered.String(); got != "app" {
+		t.Fatalf("got %q tailed, want only the running app", got)
+	}
+
+	started := podWithContainers("app", "sidecar")
+	watcher.Modify(&started)
+	events.sync(t, watcher)
+	if got := entered.String(); got != "app,sidecar" {
+		t.Errorf("got %q tailed, want sidecar too once it started", got)
+	}
+}
+
+func TestController_FieldSelector(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		selector fields.Selector
+		want     string
+	}{
+		{"default", nil, ""},
+		{"node", fields.OneTermEqualSelector("spec.nodeName", "node-1"), "spec.nodeName=node-1"},
+		{"running", fields.OneTermEqualSelector("status.phase", "Running"), "status.phase=Running"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clientset, _ := newFakeClientset()
+			var listed, watched []string
+			clientset.PrependReactor("list", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+				listed = append(listed, action.(ktesting.ListAction).GetListRestrictions().Fields.String())
+				return false, nil, nil
+			})
+			clientset.PrependWatchReactor("pods", func(action ktesting.Action) (bool, watch.Interface, error) {
+				watched = append(watched, action.(ktesting.WatchAction).GetWatchRestrictions().Fields.String())
+				return false, nil, nil
+			})
+			ctl := NewControllerWithOptions(clientset, WithFieldSelector(test.selector))
+			listWatch := ctl.newPodListWatch()
+			if _, err := listWatch.List(metav1.ListOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := listWatch.Watch(metav1.ListOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if len(listed) != 1 || listed[0] != test.want {
+				t.Errorf("got list field selectors %q, want %q", listed, test.want)
+			}
+			if len(watched) != 1 || watched[0] != test.want {
+				t.Errorf("got watch field selectors %q, want %q", watched, test.want)
+			}
+		})
+	}
+}
+
+// logOptionsRecorder serves streams that have no data until they are
+// closed, recording the options of each request.
+type logOptionsRecorder struct {
+	requests []v1.PodLogOptions
+	sync.Mutex
+}
+
+func (r *logOptionsRecorder) stream(pod *v1.Pod, options *v1.PodLogOptions) (io.ReadCloser, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.requests = append(r.requests, *options)
+	return blockingLogs(pod, options)
+}
+
+// first waits for the first request, and returns its options.
+func (r *logOptionsRecorder) first(t *testing.T) v1.PodLogOptions {
+	waitFor(t, "the logs to be requested", func() bool {
+		r.Lock()
+		defer r.Unlock()
+		return len(r.requests) > 0
+	})
+	r.Lock()
+	defer r.Unlock()
+	return r.requests[0]
+}
+
+func TestController_LogOptions(t *testing.T) {
+	seconds := int64(600)
+	sinceTime := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	tailLines := int64(5)
+	for _, test := range []struct {
+		name    string
+		options TailOptions
+		check   func(t *testing.T, options v1.PodLogOptions)
+	}{
+		{"from now", TailOptions{}, func(t *testing.T, options v1.PodLogOptions) {
+			if options.SinceSeconds != nil {
+				t.Errorf("got SinceSeconds %d, want none", *options.SinceSeconds)
+			}
+			if options.TailLines != nil {
+				t.Errorf("got TailLines %d, want none", *options.TailLines)
+			}
+			// Only a few seconds back, for clock skew
+			if options.SinceTime == nil {
+				t.Fatal("got no SinceTime, want about now")
+			}
+			if ago := time.Since(options.SinceTime.Time); ago < 0 || ago > 10*time.Second {
+				t.Errorf("got SinceTime %s, want about now", options.SinceTime)
+			}
+		}},
+		{"since", TailOptions{SinceSeconds: &seconds}, func(t *testing.T, options v1.PodLogOptions) {
+			if options.SinceSeconds == nil || *options.SinceSeconds != seconds {
+				t.Errorf("got SinceSeconds %v, want %d", options.SinceSeconds, seconds)
+			}
+			if options.SinceTime != nil {
+				t.Errorf("got SinceTime %s, want none", options.SinceTime)
+			}
+		}},
+		{"since time", TailOptions{SinceTime: &sinceTime}, func(t *testing.T, options v1.PodLogOptions) {
+			if options.SinceTime == nil || !options.SinceTime.Time.Equal(sinceTime) {
+				t.Errorf("got SinceTime %v, want %s", options.SinceTime, sinceTime)
+			}
+			if options.SinceSeconds != nil {
+				t.Errorf("got SinceSeconds %d, want none", *options.SinceSeconds)
+			}
+		}},
+		{"tail", TailOptions{TailLines: &tailLines}, func(t *testing.T, options v1.PodLogOptions) {
+			if options.TailLines == nil || *options.TailLines != tailLines {
+				t.Errorf("got TailLines %v, want %d", options.TailLines, tailLines)
+			}
+			// The last lines are shown however old they are
+			if options.SinceTime != nil || options.SinceSeconds != nil {
+				t.Errorf("got SinceTime %v and SinceSeconds %v, want neither", options.SinceTime, options.SinceSeconds)
+			}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctl := NewControllerWithOptions(nil, WithTailOptions(test.options))
+			logs := &logOptionsRecorder{}
+			ctl.logStream = logs.stream
+			defer ctl.Stop()
+
+			pod := testPod(0)
+			ctl.addContainer(&pod, &pod.Spec.Containers[0], true)
+			test.check(t, logs.first(t))
+		})
+	}
+}
+
+func TestController_Stop(t *testing.T) {
+	var exits, stopped int32
+	clientset, _ := newFakeClientset(podWithContainers("a", "b", "c"))
+	ctl := NewControllerWithOptions(clientset,
+		WithCallbacks(Callbacks{
+			OnExit:    func(*v1.Pod, *v1.Container) { atomic.AddInt32(&exits, 1) },
+			OnStopped: func(*v1.Pod, *v1.Container) { atomic.AddInt32(&stopped, 1) },
+		}))
+	ctl.logStream = blockingLogs
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctl.Run(context.Background())
+	}()
+	waitFor(t, "the containers to be tailed", func() bool { return ctl.TailerCount() == 3 })
+
+	ctl.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+	if n := ctl.TailerCount(); n != 0 {
+		t.Errorf("got %d tailers after Stop, want 0", n)
+	}
+	if n := atomic.LoadInt32(&exits); n != 3 {
+		t.Errorf("got %d exit callbacks, want 3", n)
+	}
+	if n := atomic.LoadInt32(&stopped); n != 3 {
+		t.Errorf("got %d tailers stopped, want 3", n)
+	}
+
+	ctl.Stop()
+	if n := atomic.LoadInt32(&exits); n != 3 {
+		t.Errorf("got %d exit callbacks after stopping again, want 3", n)
+	}
+}
+
+func TestController_ResyncPeriod(t *testing.T) {
+	for _, period := range []time.Duration{0, 30 * time.Second} {
+		clientset, _ := newFakeClientset()
+		ctl := NewControllerWithOptions(clientset, WithResyncPeriod(period))
+		got := make(chan time.Duration, 1)
+		ctl.newInformer = func(lw cache.ListerWatcher, objType runtime.Object, resyncPeriod time.Duration,
+			h cache.ResourceEventHandler, indexers cache.Indexers) (cache.Indexer, cache.Controller) {
+			got <- resyncPeriod
+			return cache.NewIndexerInformer(lw, objType, resyncPeriod, h, indexers)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ctl.Run(context.Background())
+		}()
+		select {
+		case p := <-got:
+			if p != period {
+				t.Errorf("got resync period %s, want %s", p, period)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("got no informer created")
+		}
+		ctl.Stop()
+		<-done
+	}
+}
+
+func TestController_StopWaitsForTailers(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	var events int32
+	ctl := NewControllerWithOptions(nil, WithEventFunc(func(event LogEvent) {
+		if atomic.AddInt32(&events, 1) == 1 {
+			close(received)
+			<-release
+		}
+	}))
+	ctl.logStream = func(pod *v1.Pod, options *v1.PodLogOptions) (io.ReadCloser, error) {
+		r, w := io.Pipe()
+		go func() {
+			_, _ = io.WriteString(w, logLine(time.Now(), "slow")+logLine(time.Now(), "after"))
+		}()
+		return r, nil
+	}
+	pod := testPod(0)
+	ctl.addContainer(&pod, &pod.Spec.Containers[0], true)
+	<-received
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ctl.Stop()
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned while the tailer was still handling an event")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop did not return after the tailer exited")
+	}
+	n := atomic.LoadInt32(&events)
+	time.Sleep(10 * time.Millisecond)
+	if after := atomic.LoadInt32(&events); after != n {
+		t.Errorf("got %d events after Stop returned", after-n)
+	}
+}
+
+func TestController_RecreatedPod(t *testing.T) {
+	var mu sync.Mutex
+	var stopped []string
+	ctl := NewControllerWithOptions(nil, WithCallbacks(Callbacks{
+		OnStopped: func(pod *v1.Pod, container *v1.Container) {
+			mu.Lock()
+			defer mu.Unlock()
+			stopped = append(stopped, string(pod.UID))
+		},
+	}))
+	ctl.logStream = blockingLogs
+
+	old := testPod(0)
+	recreated := testPod(0)
+	recreated.UID = "uid-2"
+	ctl.onAdd(&old)
+	// The new pod may be seen before the old one's deletion
+	ctl.onAdd(&recreated)
+	if n := ctl.TailerCount(); n != 2 {
+		t.Fatalf("got %d tailers, want one per pod", n)
+	}
+
+	ctl.onDelete(&old)
+	waitFor(t, "the old pod's tailer to stop", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(stopped) == 1
+	})
+	if stopped[0] != "uid-1" {
+		t.Errorf("got the tailer of %s stopped, want uid-1", stopped[0])
+	}
+	ctl.Lock()
+	_, ok := ctl.tailers[buildKey(&recreated, &recreated.Spec.Containers[0])]
+	ctl.Unlock()
+	if n := ctl.TailerCount(); n != 1 || !ok {
+		t.Errorf("got %d tailers, want only the recreated pod's", n)
+	}
+
+	// Deleting and re-adding the same name again starts a fresh tailer
+	ctl.onDelete(&recreated)
+	again := testPod(0)
+	again.UID = "uid-3"
+	ctl.onAdd(&again)
+	ctl.Lock()
+	_, ok = ctl.tailers[buildKey(&again, &again.Spec.Containers[0])]
+	ctl.Unlock()
+	if n := ctl.TailerCount(); n != 1 || !ok {
+		t.Errorf("got %d tailers, want only the pod added again", n)
+	}
+	ctl.Stop()
+}
+
+func TestController_RestartMarkers(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		var mu sync.Mutex
+		var markers []string
+		ctl := NewControllerWithOptions(nil, WithRestartMarkers(enabled), WithEventFunc(func(event LogEvent) {
+			if event.Synthetic {
+				mu.Lock()
+				defer mu.Unlock()
+				markers = append(markers, event.Message)
+			}
+		}))
+		ctl.logStream = blockingLogs
+
+		for _, restarts := range []int32{2, 2, 3, 3, 3, 5} {
+			pod := testPod(restarts)
+			if restarts == 2 && ctl.TailerCount() == 0 {
+				ctl.onAdd(&pod)
+			} else {
+				ctl.onUpdate(&pod)
+			}
+		}
+		ctl.Stop()
+
+		var want []string
+		if enabled {
+			// Restarts from before the pod was first seen aren't reported
+			want = []string{
+				"=== container restarted (restart #3) ===",
+				"=== container restarted (restart #5) ===",
+			}
+		}
+		mu.Lock()
+		if strings.Join(markers, "\n") != strings.Join(want, "\n") {
+			t.Errorf("enabled %v: got markers %q, want %q", enabled, markers, want)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestController_LabelSelectors(t *testing.T) {
+	s, err := parseSettings([]string{"-l", "app=web", "-l", "env in (prod,staging),tier!=cache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.labelSelectors) != 2 {
+		t.Fatalf("got selectors %v, want 2", s.labelSelectors)
+	}
+
+	clientset, watcher := newFakeClientset()
+	var mu sync.Mutex
+	var listed []string
+	clientset.PrependReactor("list", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		listed = append(listed, action.(ktesting.ListAction).GetListRestrictions().Labels.String())
+		return false, nil, nil
+	})
+	ctl := NewControllerWithOptions(clientset, WithLabelSelectors(s.labelSelectors...))
+	ctl.logStream = blockingLogs
+	go ctl.Run(context.Background())
+	defer ctl.Stop()
+
+	uid := 0
+	pod := func(name string, set map[string]string) v1.Pod {
+		p := podWithContainers("app")
+		uid++
+		p.Name, p.UID, p.Labels = name, types.UID(fmt.Sprintf("uid-%d", uid)), set
+		return p
+	}
+	for _, p := range []v1.Pod{
+		pod("web-1", map[string]string{"app": "web"}),
+		pod("api-1", map[string]string{"app": "api", "env": "prod"}),
+		pod("api-2", map[string]string{"app": "api", "env": "staging", "tier": "backend"}),
+		pod("api-3", map[string]string{"app": "api", "env": "dev"}),
+		pod("cache-1", map[string]string{"app": "cache", "env": "prod", "tier": "cache"}),
+		pod("db-1", map[string]string{"app": "db"}),
+	} {
+		p := p
+		watcher.Add(&p)
+	}
+	waitFor(t, "the matching pods to be tailed", func() bool { return ctl.TailerCount() == 3 })
+	// Let any wrongly matched pods be added too
+	time.Sleep(50 * time.Millisecond)
+
+	var names []string
+	ctl.Lock()
+	for _, tailer := range ctl.tailers {
+		names = append(names, tailer.pod.Name)
+	}
+	ctl.Unlock()
+	sort.Strings(names)
+	if got, want := strings.Join(names, ","), "api-1,api-2,web-1"; got != want {
+		t.Errorf("got pods %s tailed, want %s", got, want)
+	}
+	// The selectors can't be OR'd on the server
+	mu.Lock()
+	defer mu.Unlock()
+	if len(listed) == 0 || listed[0] != "" {
+		t.Errorf("got pods listed with label selectors %q, want none", listed)
+	}
+}
+
+func TestController_WaitingMarkers(t *testing.T) {
+	waiting := func(reason, message string) v1.Pod {
+		pod := testPod(0)
+		pod.Status.Phase = v1.PodPending
+		pod.Status.ContainerStatuses[0].State = v1.ContainerState{
+			Waiting: &v1.ContainerStateWaiting{Reason: reason, Message: message},
+		}
+		return pod
+	}
+	pods := []v1.Pod{
+		waiting("ContainerCreating", ""),
+		waiting("ErrImagePull", "pull access denied"),
+		waiting("ImagePullBackOff", `Back-off pulling image "web:1.2"`),
+		waiting("ImagePullBackOff", `Back-off pulling image "web:1.2"`),
+		waiting("ErrImagePull", "pull access denied"),
+		waiting("ErrImagePull", "pull access denied"),
+		testPod(0),
+		waiting("CreateContainerError", ""),
+	}
+	for _, enabled := range []bool{true, false} {
+		var mu sync.Mutex
+		var markers []string
+		ctl := NewControllerWithOptions(nil, WithWaitingMarkers(enabled), WithEventFunc(func(event LogEvent) {
+			if event.Synthetic {
+				mu.Lock()
+				defer mu.Unlock()
+				markers = append(markers, event.Message)
+			}
+		}))
+		ctl.logStream = blockingLogs
+		for i := range pods {
+			if i == 0 {
+				ctl.onAdd(&pods[i])
+			} else {
+				ctl.onUpdate(&pods[i])
+			}
+		}
+		ctl.Stop()
+
+		var want []string
+		if enabled {
+			want = []string{
+				"=== container waiting: ErrImagePull: pull access denied ===",
+				`=== container waiting: ImagePullBackOff: Back-off pulling image "web:1.2" ===`,
+				"=== container waiting: ErrImagePull: pull access denied ===",
+				"=== container waiting: CreateContainerError ===",
+			}
+		}
+		mu.Lock()
+		if strings.Join(markers, "\n") != strings.Join(want, "\n") {
+			t.Errorf("enabled %v: got markers %q, want %q", enabled, markers, want)
+		}
+		mu.Unlock()
+	}
+}
+
+// errorReader fails every read.
+type errorReader struct{ err error }
+
+func (r errorReader) Read(p []byte) (int, error) { return 0, r.err }
+
+func TestController_Reconnects(t *testing.T) {
+	t0 := time.Now()
+	var mu sync.Mutex
+	var requests int
+	responses := []func() (io.ReadCloser, error){
+		func() (io.ReadCloser, error) { return nil, fmt.Errorf("connection refused") },
+		// Reconnected, until the stream breaks
+		func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(io.MultiReader(strings.NewReader(logLine(t0, "a")),
+				errorReader{fmt.Errorf("connection reset")})), nil
+		},
+		func() (io.ReadCloser, error) { return nil, fmt.Errorf("connection refused") },
+		func() (io.ReadCloser, error) { return nil, fmt.Errorf("connection refused") },
+		// Reconnected, and the stream ends normally
+		func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(logLine(t0.Add(time.Second), "b"))), nil
+		},
+	}
+	var reconnects, errs int32
+	ctl := NewControllerWithOptions(nil,
+		WithTailOptions(TailOptions{RetryMin: time.Millisecond, RetryMax: 10 * time.Millisecond}),
+		WithCallbacks(Callbacks{
+			OnReconnect: func(*v1.Pod, *v1.Container) { atomic.AddInt32(&reconnects, 1) },
+			OnError:     func(*v1.Pod, *v1.Container, error) { atomic.AddInt32(&errs, 1) },
+		}))
+	ctl.logStream = func(pod *v1.Pod, options *v1.PodLogOptions) (io.ReadCloser, error) {
+		mu.Lock()
+		n := requests
+		requests++
+		mu.Unlock()
+		if n < len(responses) {
+			return responses[n]()
+		}
+		return blockingLogs(pod, options)
+	}
+	pod := testPod(0)
+	ctl.addContainer(&pod, &pod.Spec.Containers[0], true)
+	waitFor(t, "the logs to be followed again", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests > len(responses)
+	})
+	ctl.Stop()
+
+	if n := atomic.LoadInt32(&reconnects); n != 2 {
+		t.Errorf("got %d reconnects, want 2", n)
+	}
+	if n := atomic.LoadInt32(&errs); n != 4 {
+		t.Errorf("got %d errors, want 4", n)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// gzipFlushInterval is how often compressed files are flushed, so that
+// their contents so far can be read even if ktail is killed.
+const gzipFlushInterval = time.Second
+
+// FileSink writes each container's events to its own file in a directory,
+// named namespace_pod_container.log, or cluster_namespace_pod_container.log
+// for events tagged with a cluster. Files are appended to, and rotated
+// when they would exceed a maximum size.
+type FileSink struct {
+	dir         string
+	maxFileSize int64
+	compress    bool
+	format      EventFormatter
+	files       map[string]*sinkFile
+	buf         bytes.Buffer
+	stopCh      chan struct{}
+	doneCh      chan struct{}
+	sync.Mutex
+}
+
+type sinkFile struct {
+	path     string
+	f        *os.File
+	gz       *gzip.Writer // Set if compressing
+	compress bool
+	size     int64 // Bytes in the file, compressed if compressing
+}
+
+// countingWriter adds the number of bytes written through it to n.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// NewFileSink returns a sink writing to files in dir, which is created if
+// necessary. A maxFileSize of zero disables rotation. If compress is set,
+// files are gzipped and named with a .log.gz suffix instead; appending to
+// an existing file adds a gzip member to it, which gzip reads as one.
+func NewFileSink(dir string, maxFileSize int64, compress bool, format EventFormatter) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &FileSink{
+		dir:         dir,
+		maxFileSize: maxFileSize,
+		compress:    compress,
+		format:      format,
+		files:       map[string]*sinkFile{},
+	}
+	if compress {
+		s.stopCh = make(chan struct{})
+		s.doneCh = make(chan struct{})
+		go s.run()
+	}
+	return s, nil
+}
+
+func (s *FileSink) run() {
+	defer close(s.doneCh)
+
+	ticker := time.NewTicker(gzipFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			s.Lock()
+			for _, file := range s.files {
+				_ = file.gz.Flush()
+			}
+			s.Unlock()
+		}
+	}
+}
+
+func (s *FileSink) Write(event LogEvent) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.buf.Reset()
+	if err := s.format(&s.buf, event); err != nil {
+		return err
+	}
+
+	file, err := s.open(event.Cluster, event.Pod, event.Container)
+	if err != nil {
+		return err
+	}
+	next := int64(s.buf.Len())
+	if file.gz != nil {
+		// How much an event adds to a compressed file isn't known in advance
+		next = 0
+	}
+	if s.maxFileSize > 0 && file.size > 0 && file.size+next > s.maxFileSize {
+		if err := file.rotate(); err != nil {
+			return err
+		}
+	}
+	return file.write(s.buf.Bytes())
+}
+
+// CloseContainer closes the file of a container that is no longer tailed.
+// If the container is written to again, its file is reopened.
+func (s *FileSink) CloseContainer(cluster string, pod *v1.Pod, container *v1.Container) error {
+	s.Lock()
+	defer s.Unlock()
+
+	name := fileSinkName(cluster, pod, container)
+	if file, ok := s.files[name]; ok {
+		delete(s.files, name)
+		return file.close()
+	}
+	return nil
+}
+
+func (s *FileSink) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, file := range s.files {
+		if file.gz != nil {
+			if err := file.gz.Flush(); err != nil {
+				return err
+			}
+		}
+		if err := file.f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileSink) Close() error {
+	if s.stopCh != nil {
+		close(s.stopCh)
+		<-s.doneCh
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var firstErr error
+	for name, file := range s.files {
+		if err := file.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.files, name)
+	}
+	return firstErr
+}
+
+func (s *FileSink) open(cluster string, pod *v1.Pod, container *v1.Container) (*sinkFile, error) {
+	name := fileSinkName(cluster, pod, container)
+	if file, ok := s.files[name]; ok {
+		return file, nil
+	}
+
+	path := filepath.Join(s.dir, name)
+	if s.compress {
+		path += ".gz"
+	}
+	file := &sinkFile{path: path, compress: s.compress}
+	if err := file.open(); err != nil {
+		return nil, err
+	}
+	s.files[name] = file
+	return file, nil
+}
+
+func (file *sinkFile) open() error {
+	f, err := os.OpenFile(file.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	file.f, file.size = f, info.Size()
+	if file.compress {
+		file.gz = gzip.NewWriter(countingWriter{f, &file.size})
+	}
+	return nil
+}
+
+func (file *sinkFile) write(p []byte) error {
+	if file.gz != nil {
+		_, err := file.gz.Write(p)
+		return err
+	}
+	n, err := file.f.Write(p)
+	file.size += int64(n)
+	return err
+}
+
+// close closes the file, first writing the end of the gzip stream if
+// compressing.
+func (file *sinkFile) close() error {
+	if file.gz != nil {
+		if err := file.gz.Close(); err != nil {
+			_ = file.f.Close()
+			return err
+		}
+	}
+	return file.f.Close()
+}
+
+// rotate moves the current file aside to a ".1" suffix, replacing any
+// earlier rotated file, and starts a new one. Compressed files keep their
+// .gz extension, as in "ns_pod_container.log.1.gz".
+func (file *sinkFile) rotate() error {
+	if err := file.close(); err != nil {
+		return err
+	}
+	rotated := file.path + ".1"
+	if file.compress {
+		rotated = strings.TrimSuffix(file.path, ".gz") + ".1.gz"
+	}
+	if err := os.Rename(file.path, rotated); err != nil {
+		return err
+	}
+	return file.open()
+}
+
+func fileSinkName(cluster string, pod *v1.Pod, container *v1.Container) string {
+	name := fmt.Sprintf("%s_%s_%s.log", pod.Namespace, pod.Name, container.Name)
+	if cluster != "" {
+		name = cluster + "_" + name
+	}
+	return name
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func messageFormatter(w io.Writer, event LogEvent) error {
+	_, err := io.WriteString(w, event.Message+"\n")
+	return err
+}
+
+func TestFileSink_CloseContainer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ktail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	now := time.Now()
+	sink, err := NewFileSink(dir, 0, false, messageFormatter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = sink.Write(testEvent(pod, "app", now, "one"))
+	if err := sink.CloseContainer("", pod, &v1.Container{Name: "app"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sink.files); n != 0 {
+		t.Errorf("got %d open files after CloseContainer, want 0", n)
+	}
+	_ = sink.Write(testEvent(pod, "app", now, "two"))
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "default_web-1_app.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "one\ntwo\n" {
+		t.Errorf("got %q, want the lines written before and after closing", data)
+	}
+}
+
+func TestFileSink_GzipRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ktail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const maxFileSize = 200
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	now := time.Now()
+	sink, err := NewFileSink(dir, maxFileSize, true, messageFormatter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want string
+	for i := 0; i < 100; i++ {
+		message := fmt.Sprintf("line %d", i)
+		want += message + "\n"
+		_ = sink.Write(testEvent(pod, "app", now, message))
+		// Flush as the sink's ticker would, so that compressed bytes reach the file
+		if err := sink.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	for _, name := range []string{"default_web-1_app.log.gz", "default_web-1_app.log.1.gz"} {
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 2*maxFileSize {
+			t.Errorf("%s is %d bytes, want about %d", name, info.Size(), maxFileSize)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		_ = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = string(data) + got
+	}
+	if !strings.HasSuffix(want, got) || got == "" {
+		t.Errorf("rotated files hold %q, want the end of %q", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// ContainerFilter selects containers by pod and container name.
+type ContainerFilter struct {
+	// Patterns match either the pod name or the container name.
+	Patterns []*regexp.Regexp
+
+	// Include and Exclude match the container name only.
+	Include []*regexp.Regexp
+	Exclude []*regexp.Regexp
+
+	// ExcludePods match the pod name only.
+	ExcludePods []*regexp.Regexp
+
+	// ExcludeNamespaces are namespaces whose pods are never tailed.
+	ExcludeNamespaces map[string]bool
+
+	// IncludeNamespaces, if not empty, match the only namespaces whose pods
+	// are tailed. ExcludeNamespaces takes precedence.
+	IncludeNamespaces []*regexp.Regexp
+
+	// PodIPs, if not empty, are the only pod IPs whose pods are tailed.
+	PodIPs map[string]bool
+}
+
+// Match returns true if the container should be tailed. Empty pattern lists
+// match everything.
+func (f ContainerFilter) Match(pod *v1.Pod, container *v1.Container) bool {
+	if !f.MatchPod(pod) {
+		return false
+	}
+	if len(f.Patterns) > 0 &&
+		!matchAny(f.Patterns, pod.Name) && !matchAny(f.Patterns, container.Name) {
+		return false
+	}
+	if len(f.Include) > 0 && !matchAny(f.Include, container.Name) {
+		return false
+	}
+	return !matchAny(f.Exclude, container.Name)
+}
+
+// MatchPod returns true if the pod passes the rules that don't depend on
+// the container: namespaces, pod IPs and excluded pod names.
+func (f ContainerFilter) MatchPod(pod *v1.Pod) bool {
+	if f.ExcludeNamespaces[pod.Namespace] {
+		return false
+	}
+	if len(f.IncludeNamespaces) > 0 && !matchAny(f.IncludeNamespaces, pod.Namespace) {
+		return false
+	}
+	if len(f.PodIPs) > 0 && !f.PodIPs[pod.Status.PodIP] {
+		return false
+	}
+	return !matchAny(f.ExcludePods, pod.Name)
+}
+
+// LineFilter decides which log lines are written, based on regular
+// expressions matched against the message.
+type LineFilter struct {
+	Include []*regexp.Regexp
+	Exclude []*regexp.Regexp
+}
+
+// Match returns true if the message matches any include pattern (or there
+// are none), and does not match any exclude pattern.
+func (f LineFilter) Match(message string) bool {
+	if len(f.Include) > 0 && !matchAny(f.Include, message) {
+		return false
+	}
+	return !matchAny(f.Exclude, message)
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, r := range patterns {
+		if r.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func compilePatterns(exprs []string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, expr := range exprs {
+		r, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regexp: %q: %s", expr, err)
+		}
+		patterns = append(patterns, r)
+	}
+	return patterns, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func patterns(exprs ...string) []*regexp.Regexp {
+	var p []*regexp.Regexp
+	for _, expr := range exprs {
+		p = append(p, regexp.MustCompile(expr))
+	}
+	return p
+}
+
+func TestContainerFilter(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "web-1"},
+		Status:     v1.PodStatus{PodIP: "10.0.0.5"},
+	}
+	for _, test := range []struct {
+		name      string
+		filter    ContainerFilter
+		container string
+		want      bool
+	}{
+		{"no patterns", ContainerFilter{}, "app", true},
+		{"pattern matches pod", ContainerFilter{Patterns: patterns("^web")}, "app", true},
+		{"pattern matches container", ContainerFilter{Patterns: patterns("^app$")}, "app", true},
+		{"pattern matches neither", ContainerFilter{Patterns: patterns("db")}, "app", false},
+		{"included", ContainerFilter{Include: patterns("app")}, "app", true},
+		{"not included", ContainerFilter{Include: patterns("app")}, "sidecar", false},
+		{"excluded", ContainerFilter{Exclude: patterns("sidecar")}, "sidecar", false},
+		{"pod excluded", ContainerFilter{ExcludePods: patterns("^web")}, "app", false},
+		{"namespace excluded", ContainerFilter{ExcludeNamespaces: map[string]bool{"prod": true}}, "app", false},
+		{"namespace included", ContainerFilter{IncludeNamespaces: patterns("^pro")}, "app", true},
+		{"namespace not included", ContainerFilter{IncludeNamespaces: patterns("^staging$")}, "app", false},
+		{"pod IP", ContainerFilter{PodIPs: map[string]bool{"10.0.0.5": true}}, "app", true},
+		{"other pod IP", ContainerFilter{PodIPs: map[string]bool{"10.0.0.6": true}}, "app", false},
+	} {
+		if got := test.filter.Match(pod, &v1.Container{Name: test.container}); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLineFilter(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		filter  LineFilter
+		message string
+		want    bool
+	}{
+		{"no patterns", LineFilter{}, "anything", true},
+		{"included", LineFilter{Include: patterns("error", "warn")}, "a warning", true},
+		{"not included", LineFilter{Include: patterns("error")}, "all good", false},
+		{"excluded", LineFilter{Exclude: patterns("healthz")}, "GET /healthz", false},
+		{"exclude wins", LineFilter{Include: patterns("GET"), Exclude: patterns("healthz")}, "GET /healthz", false},
+	} {
+		if got := test.filter.Match(test.message); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCompilePatterns(t *testing.T) {
+	if _, err := compilePatterns([]string{"ok", "("}); err == nil {
+		t.Errorf("got no error for an invalid pattern")
+	}
+	patterns, err := compilePatterns([]string{"a", "b"})
+	if err != nil || len(patterns) != 2 {
+		t.Errorf("got %d patterns and error %v, want 2 and none", len(patterns), err)
+	}
+}
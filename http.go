@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serveHTTP serves Prometheus metrics on /metrics and the controller's
+// current tailers on /tailers.
+func serveHTTP(addr string, controllers []*Controller) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/tailers", tailersHandler(controllers))
+	return http.ListenAndServe(addr, mux)
+}
+
+// tailersHandler lists the tailers of all the controllers as a JSON array.
+func tailersHandler(controllers []*Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		infos := []TailerInfo{}
+		for _, controller := range controllers {
+			infos = append(infos, controller.ListTailers()...)
+		}
+		_ = json.NewEncoder(w).Encode(infos)
+	}
+}
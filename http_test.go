@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTailersHandler(t *testing.T) {
+	withTailer := NewControllerWithOptions(nil, WithCluster("prod"))
+	pod := testPod(0)
+	withTailer.tailers[buildKey(&pod, &pod.Spec.Containers[0])] =
+		NewContainerTailer(nil, pod, pod.Spec.Containers[0], nil, nil, TailOptions{})
+	for _, test := range []struct {
+		name        string
+		controllers []*Controller
+		want        int
+	}{
+		{"no controllers", nil, 0},
+		{"no tailers", []*Controller{NewControllerWithOptions(nil)}, 0},
+		{"one tailer", []*Controller{withTailer, NewControllerWithOptions(nil)}, 1},
+	} {
+		rec := httptest.NewRecorder()
+		tailersHandler(test.controllers)(rec, httptest.NewRequest("GET", "/tailers", nil))
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: got content type %q", test.name, ct)
+		}
+		// An empty list must be an array, not null
+		var infos []TailerInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil || infos == nil {
+			t.Fatalf("%s: got %q, want a JSON array", test.name, rec.Body.String())
+		}
+		if len(infos) != test.want {
+			t.Errorf("%s: got %d tailers, want %d", test.name, len(infos), test.want)
+		}
+	}
+}
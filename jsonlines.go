@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// JSONMessageFormatter rewrites messages that are JSON objects, for
+// applications that log structured JSON. Other messages are left as is.
+type JSONMessageFormatter struct {
+	// Fields, if given, selects the keys to show, in order, as key=value
+	// pairs. Objects with none of the keys are left as is. Otherwise the
+	// object is pretty-printed.
+	Fields []string
+}
+
+// Format returns the rewritten message.
+func (f JSONMessageFormatter) Format(message string) string {
+	trimmed := strings.TrimSpace(message)
+	if !strings.HasPrefix(trimmed, "{") {
+		return message
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(trimmed), &obj); err != nil {
+		return message
+	}
+
+	if len(f.Fields) == 0 {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, []byte(trimmed), "", "  "); err != nil {
+			return message
+		}
+		return buf.String()
+	}
+
+	var pairs []string
+	for _, field := range f.Fields {
+		value, ok := obj[field]
+		if !ok {
+			continue
+		}
+		s, ok := value.(string)
+		if !ok {
+			b, err := json.Marshal(value)
+			if err != nil {
+				continue
+			}
+			s = string(b)
+		}
+		pairs = append(pairs, field+"="+logfmtValue(s))
+	}
+	if len(pairs) == 0 {
+		return message
+	}
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestJSONMessageFormatter(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		fields  []string
+		message string
+		want    string
+	}{
+		{"not JSON", nil, "plain text", "plain text"},
+		{"invalid JSON", nil, "{oops", "{oops"},
+		{"pretty-printed", nil, `{"a":1}`, "{\n  \"a\": 1\n}"},
+		{"fields in order", []string{"msg", "level"}, `{"level":"info","msg":"hello world","n":1}`,
+			`msg="hello world" level=info`},
+		{"non-string field", []string{"n"}, `{"n":{"x":1}}`, `n="{\"x\":1}"`},
+		{"missing field skipped", []string{"level", "missing"}, `{"level":"warn"}`, "level=warn"},
+		{"no fields present", []string{"level"}, `{"msg":"hi"}`, `{"msg":"hi"}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := JSONMessageFormatter{Fields: test.fields}.Format(test.message)
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
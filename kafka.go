@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// defaultKafkaKey is the default message key template. It keeps each pod's
+// lines in one partition, and so in order.
+const defaultKafkaKey = "{{.Pod.Namespace}}/{{.Pod.Name}}"
+
+// errKafkaSinkClosed is returned by writes to a closed KafkaSink.
+var errKafkaSinkClosed = fmt.Errorf("Kafka sink is closed")
+
+// KafkaOptions configures a KafkaSink.
+type KafkaOptions struct {
+	Brokers []string
+	Topic   string
+
+	// Key renders the message key of each event. Events with the same key
+	// are produced to the same partition.
+	Key *template.Template
+
+	// BatchSize is the number of events that triggers sending a batch.
+	BatchSize int
+
+	// FlushInterval is the longest an event is held before being sent.
+	FlushInterval time.Duration
+
+	// MaxQueue bounds the number of events waiting for the producer. When
+	// full, new events are dropped rather than blocking the writer.
+	MaxQueue int
+
+	// OnError, if set, is called with the error of each event that could
+	// not be produced. Calls are made from one goroutine.
+	OnError func(err error)
+}
+
+// KafkaSink produces events to a Kafka topic, as JSON objects like those of
+// the JSON output format.
+type KafkaSink struct {
+	producer sarama.AsyncProducer
+	topic    string
+	key      *template.Template
+	buf      bytes.Buffer
+	queue    chan *sarama.ProducerMessage
+	dropped  int64
+	closed   bool
+	onError  func(err error)
+	failed   int64
+	lastErr  error
+	errMu    sync.Mutex // Guards failed and lastErr
+	doneCh   chan struct{}
+	sync.Mutex
+}
+
+func NewKafkaSink(options KafkaOptions) (*KafkaSink, error) {
+	config := sarama.NewConfig()
+	config.ClientID = "ktail"
+	config.Producer.RequiredAcks = sarama.WaitForLocal
+	config.Producer.Retry.Max = 5
+	config.Producer.Return.Errors = true
+	config.Producer.Flush.Messages = options.BatchSize
+	config.Producer.Flush.Frequency = options.FlushInterval
+	producer, err := sarama.NewAsyncProducer(options.Brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	return newKafkaSinkWithProducer(producer, options), nil
+}
+
+// newKafkaSinkWithProducer returns a sink producing with the producer,
+// which it takes ownership of.
+func newKafkaSinkWithProducer(producer sarama.AsyncProducer, options KafkaOptions) *KafkaSink {
+	if options.MaxQueue <= 0 {
+		options.MaxQueue = 10000
+	}
+	s := &KafkaSink{
+		producer: producer,
+		topic:    options.Topic,
+		key:      options.Key,
+		queue:    make(chan *sarama.ProducerMessage, options.MaxQueue),
+		onError:  options.OnError,
+		doneCh:   make(chan struct{}),
+	}
+	go s.forward()
+	go s.collectErrors()
+	return s
+}
+
+// Write queues the event for the producer, which sends it in the
+// background. It never blocks on the producer: if the queue is full, the
+// event is dropped and counted, as reported by Dropped. Failures to send are
+// counted, and reported by Failed.
+func (s *KafkaSink) Write(event LogEvent) error {
+	value, err := json.Marshal(newJSONEvent(event))
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return errKafkaSinkClosed
+	}
+	s.buf.Reset()
+	if err := s.key.Execute(&s.buf, event); err != nil {
+		return err
+	}
+	msg := &sarama.ProducerMessage{
+		Topic: s.topic,
+		Key:   sarama.StringEncoder(s.buf.String()),
+		Value: sarama.ByteEncoder(value),
+	}
+	select {
+	case s.queue <- msg:
+	default:
+		s.dropped++
+	}
+	return nil
+}
+
+// Dropped returns the number of events dropped because the queue was full.
+func (s *KafkaSink) Dropped() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.dropped
+}
+
+// Failed returns the number of events that could not be produced, and the
+// last error.
+func (s *KafkaSink) Failed() (int64, error) {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.failed, s.lastErr
+}
+
+// forward hands queued events to the producer, which may block while it is
+// busy sending, and closes the producer once the queue has been closed and
+// drained.
+func (s *KafkaSink) forward() {
+	for msg := range s.queue {
+		s.producer.Input() <- msg
+	}
+	s.producer.AsyncClose()
+}
+
+func (s *KafkaSink) collectErrors() {
+	defer close(s.doneCh)
+	for perr := range s.producer.Errors() {
+		s.errMu.Lock()
+		s.failed++
+		s.lastErr = perr.Err
+		s.errMu.Unlock()
+		if s.onError != nil {
+			s.onError(perr.Err)
+		}
+	}
+}
+
+func (s *KafkaSink) Flush() error {
+	return nil
+}
+
+// Close sends any queued events, and waits for the producer to finish.
+func (s *KafkaSink) Close() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.Unlock()
+
+	<-s.doneCh
+	return nil
+}
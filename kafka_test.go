@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/Shopify/sarama"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// fakeProducer records the messages given to it, failing those whose value
+// contains fail.
+type fakeProducer struct {
+	input    chan *sarama.ProducerMessage
+	errors   chan *sarama.ProducerError
+	fail     string
+	messages []*sarama.ProducerMessage
+	done     chan struct{}
+}
+
+func newFakeProducer(fail string) *fakeProducer {
+	p := &fakeProducer{
+		input:  make(chan *sarama.ProducerMessage),
+		errors: make(chan *sarama.ProducerError, 10),
+		fail:   fail,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		defer close(p.errors)
+		for msg := range p.input {
+			value, _ := msg.Value.Encode()
+			var event jsonEvent
+			_ = json.Unmarshal(value, &event)
+			if p.fail != "" && event.Message == p.fail {
+				p.errors <- &sarama.ProducerError{Msg: msg, Err: fmt.Errorf("failed %s", event.Message)}
+				continue
+			}
+			p.messages = append(p.messages, msg)
+		}
+	}()
+	return p
+}
+
+func (p *fakeProducer) AsyncClose()                               { close(p.input) }
+func (p *fakeProducer) Close() error                              { p.AsyncClose(); <-p.done; return nil }
+func (p *fakeProducer) Input() chan<- *sarama.ProducerMessage     { return p.input }
+func (p *fakeProducer) Successes() <-chan *sarama.ProducerMessage { return nil }
+func (p *fakeProducer) Errors() <-chan *sarama.ProducerError      { return p.errors }
+
+func TestKafkaSink(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	now := time.Now()
+	for _, test := range []struct {
+		name       string
+		fail       string
+		wantKeys   []string
+		wantFailed int64
+	}{
+		{"produced", "", []string{"default/web-1", "default/web-1"}, 0},
+		{"failed", "two", []string{"default/web-1"}, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			producer := newFakeProducer(test.fail)
+			var mu sync.Mutex
+			var errors []error
+			sink := newKafkaSinkWithProducer(producer, KafkaOptions{
+				Topic: "logs",
+				Key:   template.Must(template.New("key").Parse(defaultKafkaKey)),
+				OnError: func(err error) {
+					mu.Lock()
+					defer mu.Unlock()
+					errors = append(errors, err)
+				},
+			})
+			for _, message := range []string{"one", "two"} {
+				if err := sink.Write(testEvent(pod, "app", now, message)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := sink.Write(testEvent(pod, "app", now, "late")); err != errKafkaSinkClosed {
+				t.Errorf("got %v writing after Close, want %v", err, errKafkaSinkClosed)
+			}
+
+			var keys []string
+			for _, msg := range producer.messages {
+				if msg.Topic != "logs" {
+					t.Errorf("got topic %q, want logs", msg.Topic)
+				}
+				key, _ := msg.Key.Encode()
+				keys = append(keys, string(key))
+			}
+			if fmt.Sprint(keys) != fmt.Sprint(test.wantKeys) {
+				t.Errorf("got keys %q, want %q", keys, test.wantKeys)
+			}
+			failed, _ := sink.Failed()
+			if failed != test.wantFailed || int64(len(errors)) != test.wantFailed {
+				t.Errorf("got %d failed and %d errors reported, want %d", failed, len(errors), test.wantFailed)
+			}
+		})
+	}
+}
+
+func TestKafkaSink_Backpressure(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	release := make(chan struct{})
+	producer := newFakeProducer("fail")
+	sink := newKafkaSinkWithProducer(producer, KafkaOptions{
+		Topic:    "logs",
+		Key:      template.Must(template.New("key").Parse(defaultKafkaKey)),
+		MaxQueue: 5,
+		// Reporting the first error stalls until released, so the
+		// producer backs up
+		OnError: func(err error) { <-release },
+	})
+
+	const total = 50
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := 0; i < total; i++ {
+			if err := sink.Write(testEvent(pod, "app", time.Now(), "fail")); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("writes blocked while the producer was backed up")
+	}
+	if n := sink.Dropped(); n == 0 {
+		t.Error("got no lines dropped, want some")
+	}
+	if n, _ := sink.Failed(); n > 1 {
+		t.Errorf("got %d failed before the error was reported, want at most 1", n)
+	}
+
+	close(release)
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	failed, _ := sink.Failed()
+	if failed+sink.Dropped() != total {
+		t.Errorf("got %d failed and %d dropped, want %d in all", failed, sink.Dropped(), total)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// callbackLogger logs what the controller does to stderr, through logf.
+// Containers entered, queued and left are logged unless quiet. With
+// verbosity 1, reconnects and pods whose containers were all filtered out
+// are logged too, and with verbosity 2, every pod event.
+type callbackLogger struct {
+	quiet      bool
+	verbosity  int
+	maxTailers int
+	formatPod  func(pod *v1.Pod) string
+	logf       func(format string, args ...interface{})
+}
+
+// Instrument returns the callbacks with logging added.
+func (l *callbackLogger) Instrument(callbacks Callbacks) Callbacks {
+	onEnter, onQueued, onExit := callbacks.OnEnter, callbacks.OnQueued, callbacks.OnExit
+	onReconnect, onPodEvent, onFilteredOut := callbacks.OnReconnect, callbacks.OnPodEvent, callbacks.OnFilteredOut
+	callbacks.OnEnter = func(pod *v1.Pod, container *v1.Container, initialAddPhase bool) bool {
+		if onEnter != nil && !onEnter(pod, container, initialAddPhase) {
+			return false
+		}
+		if !l.quiet {
+			if initialAddPhase {
+				l.logf("Detected running container [%s]", l.formatContainer(pod, container))
+			} else {
+				l.logf("New container [%s]", l.formatContainer(pod, container))
+			}
+		}
+		return true
+	}
+	callbacks.OnQueued = func(pod *v1.Pod, container *v1.Container) {
+		if onQueued != nil {
+			onQueued(pod, container)
+		}
+		if !l.quiet {
+			l.logf("Waiting to tail container [%s], as the maximum of %d containers are being tailed",
+				l.formatContainer(pod, container), l.maxTailers)
+		}
+	}
+	callbacks.OnExit = func(pod *v1.Pod, container *v1.Container) {
+		if onExit != nil {
+			onExit(pod, container)
+		}
+		if !l.quiet {
+			l.logf("Container left (%s) [%s]", containerState(pod, container), l.formatContainer(pod, container))
+		}
+	}
+	callbacks.OnReconnect = func(pod *v1.Pod, container *v1.Container) {
+		if onReconnect != nil {
+			onReconnect(pod, container)
+		}
+		if l.verbosity >= 1 {
+			l.logf("Reconnected to container [%s]", l.formatContainer(pod, container))
+		}
+	}
+	callbacks.OnPodEvent = func(event PodEventType, pod *v1.Pod) {
+		if l.verbosity >= 2 {
+			l.logf("Pod %s (%s) [%s]", event, pod.Status.Phase, l.formatPod(pod))
+		}
+		if onPodEvent != nil {
+			onPodEvent(event, pod)
+		}
+	}
+	callbacks.OnFilteredOut = func(pod *v1.Pod) {
+		if onFilteredOut != nil {
+			onFilteredOut(pod)
+		}
+		if l.verbosity >= 1 {
+			l.logf("Pod [%s] matched selector but no containers matched filter", l.formatPod(pod))
+		}
+	}
+	return callbacks
+}
+
+func (l *callbackLogger) formatContainer(pod *v1.Pod, container *v1.Container) string {
+	return l.formatPod(pod) + ":" + container.Name
+}
+
+// containerState returns whether the container is running, waiting or
+// terminated, or "unknown" if the pod has no status for it.
+func containerState(pod *v1.Pod, container *v1.Container) string {
+	status := findContainerStatus(pod, container)
+	switch {
+	case status == nil:
+		return "unknown"
+	case status.State.Running != nil:
+		return "running"
+	case status.State.Waiting != nil:
+		return "waiting"
+	case status.State.Terminated != nil:
+		return "terminated"
+	}
+	return "unknown"
+}
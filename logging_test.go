@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestCallbackLogger(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		quiet     bool
+		verbosity int
+		want      []string
+	}{
+		{"quiet", true, 0, nil},
+		{"default", false, 0, []string{
+			"Detected running container [web-1:app]",
+			"New container [web-2:app]",
+			"Container left (running) [web-2:app]",
+		}},
+		{"verbose", false, 1, []string{
+			"Detected running container [web-1:app]",
+			"Pod [filtered-1] matched selector but no containers matched filter",
+			"New container [web-2:app]",
+			"Container left (running) [web-2:app]",
+		}},
+		// Existing pods are tailed before the informer reports them
+		{"very verbose", false, 2, []string{
+			"Detected running container [web-1:app]",
+			"Pod added (Running) [web-1]",
+			"Pod added (Running) [filtered-1]",
+			"Pod [filtered-1] matched selector but no containers matched filter",
+			"Pod added (Running) [web-2]",
+			"New container [web-2:app]",
+			"Pod deleted (Running) [web-2]",
+			"Container left (running) [web-2:app]",
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var logged []string
+			logger := &callbackLogger{
+				quiet:     test.quiet,
+				verbosity: test.verbosity,
+				formatPod: func(pod *v1.Pod) string { return pod.Name },
+				logf: func(format string, args ...interface{}) {
+					mu.Lock()
+					defer mu.Unlock()
+					logged = append(logged, fmt.Sprintf(format, args...))
+				},
+			}
+			pod := func(name string) v1.Pod {
+				p := podWithContainers("app")
+				p.Name = name
+				p.UID = "uid-" + types.UID(name)
+				return p
+			}
+			existing, filtered, added := pod("web-1"), pod("filtered-1"), pod("web-2")
+			clientset, watcher := newFakeClientset(existing)
+			events := &podEvents{}
+			callbacks := logger.Instrument(Callbacks{OnPodEvent: events.record})
+			ctl := NewControllerWithOptions(clientset,
+				WithFilter(func(pod *v1.Pod, container *v1.Container) bool { return pod.Name != "filtered-1" }),
+				WithCallbacks(callbacks))
+			ctl.logStream = blockingLogs
+			defer runController(ctl)()
+
+			events.sync(t, watcher)
+			watcher.Add(&filtered)
+			watcher.Add(&added)
+			watcher.Delete(&added)
+			events.sync(t, watcher)
+			waitFor(t, "the deleted pod's tailer to stop", func() bool { return ctl.TailerCount() == 1 })
+
+			mu.Lock()
+			defer mu.Unlock()
+			var got []string
+			for _, line := range logged {
+				// Leave out the pods used to sync with the controller
+				if !strings.Contains(line, "[sync-") {
+					got = append(got, line)
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got logged\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestContainerState(t *testing.T) {
+	pod := podWithContainers("running", "waiting", "terminated")
+	pod.Status.ContainerStatuses[1].State = v1.ContainerState{Waiting: &v1.ContainerStateWaiting{}}
+	pod.Status.ContainerStatuses[2].State = v1.ContainerState{Terminated: &v1.ContainerStateTerminated{}}
+	for _, name := range []string{"running", "waiting", "terminated"} {
+		if got := containerState(&pod, &v1.Container{Name: name}); got != name {
+			t.Errorf("got %s, want %s", got, name)
+		}
+	}
+	if got := containerState(&pod, &v1.Container{Name: "other"}); got != "unknown" {
+		t.Errorf("got %s for a container without a status, want unknown", got)
+	}
+}
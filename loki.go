@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lokiPushPath is the path of Loki's push API, relative to its base URL.
+const lokiPushPath = "/loki/api/v1/push"
+
+type lokiPushRequest struct {
+	Streams []lokiStream `json:"streams"`
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// NewLokiSink returns a sink pushing events to the Loki instance at baseURL.
+// Each container is sent as a stream labeled with its namespace, pod and
+// container, and its cluster if the event has one.
+func NewLokiSink(baseURL string, options WebhookOptions) *WebhookSink {
+	options.URL = strings.TrimRight(baseURL, "/") + lokiPushPath
+	options.Encode = encodeLokiPush
+	return NewWebhookSink(options)
+}
+
+type lokiEntry struct {
+	time    time.Time
+	message string
+}
+
+type lokiEntriesByTime []lokiEntry
+
+func (e lokiEntriesByTime) Len() int           { return len(e) }
+func (e lokiEntriesByTime) Less(i, j int) bool { return e[i].time.Before(e[j].time) }
+func (e lokiEntriesByTime) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+func encodeLokiPush(events []LogEvent) ([]byte, error) {
+	var keys []string
+	labels := map[string]map[string]string{}
+	entries := map[string][]lokiEntry{}
+	for _, event := range events {
+		key := event.Cluster + "/" + buildKey(event.Pod, event.Container)
+		if _, ok := labels[key]; !ok {
+			keys = append(keys, key)
+			labels[key] = map[string]string{
+				"namespace": event.Pod.Namespace,
+				"pod":       event.Pod.Name,
+				"container": event.Container.Name,
+			}
+			if event.Cluster != "" {
+				labels[key]["cluster"] = event.Cluster
+			}
+		}
+		t := time.Now()
+		if event.Timestamp != nil {
+			t = *event.Timestamp
+		}
+		entries[key] = append(entries[key], lokiEntry{time: t, message: event.Message})
+	}
+
+	req := lokiPushRequest{Streams: make([]lokiStream, 0, len(keys))}
+	for _, key := range keys {
+		streamEntries := entries[key]
+
+		// Loki rejects out-of-order entries within a stream
+		sort.Stable(lokiEntriesByTime(streamEntries))
+
+		stream := lokiStream{Stream: labels[key]}
+		for _, e := range streamEntries {
+			stream.Values = append(stream.Values,
+				[2]string{strconv.FormatInt(e.time.UnixNano(), 10), e.message})
+		}
+		req.Streams = append(req.Streams, stream)
+	}
+	return json.Marshal(req)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestEncodeLokiPush(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	at := func(seconds int64) time.Time { return time.Unix(seconds, 0) }
+	body, err := encodeLokiPush([]LogEvent{
+		testEvent(pod, "app", at(2), "a2"),
+		testEvent(pod, "sidecar", at(1), "s1"),
+		testEvent(pod, "app", at(1), "a1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req lokiPushRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	want := lokiPushRequest{Streams: []lokiStream{
+		{
+			Stream: map[string]string{"namespace": "default", "pod": "web-1", "container": "app"},
+			Values: [][2]string{{"1000000000", "a1"}, {"2000000000", "a2"}},
+		},
+		{
+			Stream: map[string]string{"namespace": "default", "pod": "web-1", "container": "sidecar"},
+			Values: [][2]string{{"1000000000", "s1"}},
+		},
+	}}
+	if !reflect.DeepEqual(req, want) {
+		t.Errorf("got %+v, want %+v", req, want)
+	}
+}
+
+func TestEncodeLokiPush_Clusters(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	eu, us := testEvent(pod, "app", time.Unix(1, 0), "eu"), testEvent(pod, "app", time.Unix(1, 0), "us")
+	eu.Cluster, us.Cluster = "prod-eu", "prod-us"
+	body, err := encodeLokiPush([]LogEvent{eu, us})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req lokiPushRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	want := lokiPushRequest{Streams: []lokiStream{
+		{
+			Stream: map[string]string{"cluster": "prod-eu", "namespace": "default", "pod": "web-1", "container": "app"},
+			Values: [][2]string{{"1000000000", "eu"}},
+		},
+		{
+			Stream: map[string]string{"cluster": "prod-us", "namespace": "default", "pod": "web-1", "container": "app"},
+			Values: [][2]string{{"1000000000", "us"}},
+		},
+	}}
+	if !reflect.DeepEqual(req, want) {
+		t.Errorf("got %+v, want %+v", req, want)
+	}
+}
@@ -1,209 +1,693 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"regexp"
+	"os/signal"
+	"sort"
+	"strings"
 	"sync"
-	"text/template"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/fatih/color"
-	"github.com/spf13/pflag"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/api/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
-    _ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
-	"k8s.io/client-go/tools/clientcmd"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
 )
 
+// noWaitGracePeriod is how long --no-wait waits for matching containers to
+// start before giving up.
+const noWaitGracePeriod = 5 * time.Second
+
+// terminationGracePeriod is how long --exit-on-pod-termination waits for
+// the last lines of terminated pods before exiting.
+const terminationGracePeriod = 2 * time.Second
+
+// kafkaErrorReportInterval is how often failures to produce to Kafka are
+// reported, as each line fails on its own.
+const kafkaErrorReportInterval = 10 * time.Second
+
 func main() {
+	s, err := parseSettings(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if s.noColor {
+		color.NoColor = true
+	}
+
+	clusters, err := connectClusters(s)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// The selectors only differ between clusters in the workload's or pod's
+	// own selector, so the first cluster's describe them all.
+	labelSelectors := clusters[0].labelSelectors
+
+	yellow := color.New(color.FgYellow)
+	red := color.New(color.FgRed)
+
+	formatPod := func(pod *v1.Pod) string {
+		if s.allNamespaces {
+			return fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
+		}
+		return pod.Name
+	}
+
+	formatPodAndContainer := func(pod *v1.Pod, container *v1.Container) string {
+		return fmt.Sprintf("%s:%s", formatPod(pod), container.Name)
+	}
+
+	ctx, cancel := runContext(s.timeout)
+	defer cancel()
+
 	var (
-		contextName       string
-		kubeconfigPath    string
-		labelSelectorExpr string
-		namespace         string
-		allNamespaces     bool
-		quiet             bool
-		timestamps        bool
-		tmplString        string
-		containerPatterns []*regexp.Regexp
+		exitCode          int32
+		enteredContainers int64
 	)
-
-	flags := pflag.NewFlagSet("ktail", pflag.ExitOnError)
-	flags.Usage = func() {
-		flags.PrintDefaults()
+	var limit *lineLimit
+	if s.maxLines > 0 {
+		limit = &lineLimit{max: s.maxLines, stop: cancel}
 	}
 
-	flags.StringVar(&contextName, "context", "", "Kubernetes context name")
-	flags.StringVar(&kubeconfigPath, "kubeconfig", "", "Path to kubeconfig (only required out-of-cluster)")
-	flags.StringVarP(&namespace, "namespace", "n", "", "Kubernetes namespace")
-	flags.StringVarP(&labelSelectorExpr, "selector", "l", "", "Match pods by label (see 'kubectl get -h' for syntax)")
-	flags.StringVarP(&tmplString, "template", "t", "", "Template to format each line. For example, for"+
-		" just the message, use --template '{{ .Message }}'.")
-	flags.BoolVar(&allNamespaces, "all-namespaces", false, "Apply to all Kubernetes namespaces")
-	flags.BoolVar(&timestamps, "timestamps", false, "Include timestamps on each line")
-	flags.BoolVarP(&quiet, "quiet", "q", false, "Don't print events about new/deleted pods")
+	// The sinks are created once --list has been handled
+	var sink Sink
 
-	if err := flags.Parse(os.Args[1:]); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	stats := NewStats()
+	write := func(event LogEvent) {
+		if limit != nil && !event.Synthetic && !limit.allow() {
+			return
+		}
+		if !event.Synthetic {
+			stats.AddLine()
+		}
+		_ = sink.Write(event)
 	}
 
-	for _, arg := range flags.Args() {
-		r, err := regexp.Compile(arg)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid regexp: %q: %s\n", arg, err)
-			os.Exit(1)
+	var contextFilter *ContextFilter
+	if s.contextLines > 0 {
+		// Separators are only meaningful between lines of text
+		contextFilter = NewContextFilter(s.lineFilter, s.contextLines, s.outputFormat == "")
+	}
+	var sampler *Sampler
+	if s.sampleRate > 0 && s.sampleRate < 1 {
+		sampler = NewSampler(s.sampleRate)
+	}
+	emit := func(event LogEvent) {
+		if sampler != nil && !event.Synthetic && !sampler.Sample(event) {
+			return
+		}
+		if isBinary(event.Message) {
+			if s.skipBinary {
+				return
+			}
+			event.Message = escapeBinary(event.Message)
+		}
+		if s.stripColors {
+			event.Message = stripANSI(event.Message)
+		}
+		if s.parseJSON {
+			event.Message = s.jsonMessages.Format(event.Message)
+		}
+		if s.maxLineLength > 0 {
+			event.Message = truncateMessage(event.Message, s.maxLineLength)
 		}
-		containerPatterns = append(containerPatterns, r)
+		if contextFilter != nil {
+			contextFilter.Filter(event, write)
+		} else if s.lineFilter.Match(event.Message) {
+			write(event)
+		}
+	}
+
+	// Lines are joined before filtering, so that filters see whole records
+	var joiner *MultilineJoiner
+	if s.multilinePattern != nil {
+		joiner = NewMultilineJoiner(s.multilinePattern, s.multilineTimeout, emit)
 	}
 
-	if tmplString == "" {
-		tmplString = "{{.Pod.Name}}:{{.Container.Name}} {{.Message}}"
-		if allNamespaces {
-			tmplString = "{{.Pod.Namespace}}/" + tmplString
+	var stateFile *StateFile
+	if s.stateFilePath != "" {
+		if stateFile, err = OpenStateFile(s.stateFilePath); err != nil {
+			_, _ = red.Fprintf(os.Stderr, "==> Warning: %s\n", err)
 		}
-		if timestamps {
-			tmplString = "{{.Timestamp}} " + tmplString
+	}
+
+	var terminations *terminationWatcher
+	if s.exitOnTermination {
+		terminations = newTerminationWatcher()
+	}
+	terminated := func(done, failed bool) {
+		if !done {
+			return
 		}
+		go func() {
+			time.Sleep(terminationGracePeriod)
+			if terminations.remaining() > 0 {
+				// Another pod was picked up in the meantime
+				return
+			}
+			if !s.quiet {
+				_, _ = yellow.Fprintf(os.Stderr, "==> All pods have terminated\n")
+			}
+			if failed {
+				atomic.StoreInt32(&exitCode, 1)
+			}
+			cancel()
+		}()
 	}
-	tmplString += "\n"
 
-	if kubeconfigPath == "" {
-		if os.Getenv("KUBECONFIG") != "" {
-			kubeconfigPath = os.Getenv("KUBECONFIG")
-		} else {
-			kubeconfigPath = clientcmd.RecommendedHomeFile
+	waiter := &startupWaiter{
+		wait:        s.wait && !s.quiet,
+		noWait:      s.noWait,
+		gracePeriod: noWaitGracePeriod,
+		entered:     func() int64 { return atomic.LoadInt64(&enteredContainers) },
+		notify: func(message string) {
+			_, _ = yellow.Fprintf(os.Stderr, "==> %s\n", message)
+		},
+		fail: func(message string) {
+			_, _ = red.Fprintf(os.Stderr, "==> %s\n", message)
+			atomic.StoreInt32(&exitCode, 1)
+			cancel()
+		},
+	}
+
+	callbacks := Callbacks{
+		OnEvent: func(event LogEvent) {
+			if event.Synthetic && s.outputDir == "" {
+				// Keep stdout for the containers' own output
+				_, _ = yellow.Fprintf(os.Stderr, "==> %s [%s]\n",
+					strings.Trim(event.Message, "= "), formatPodAndContainer(event.Pod, event.Container))
+				return
+			}
+			if stateFile != nil && !event.Synthetic {
+				stateFile.Record(event)
+			}
+			if joiner != nil {
+				joiner.Add(event)
+			} else {
+				emit(event)
+			}
+		},
+		OnEnter: func(
+			pod *v1.Pod,
+			container *v1.Container,
+			initialAddPhase bool) bool {
+			atomic.AddInt64(&enteredContainers, 1)
+			if terminations != nil {
+				terminated(terminations.add(pod))
+			}
+			return true
+		},
+		OnExit: func(pod *v1.Pod, container *v1.Container) {
+			if joiner != nil {
+				joiner.FlushContainer(pod, container)
+			}
+			if contextFilter != nil {
+				contextFilter.CloseContainer(pod, container)
+			}
+			if sampler != nil {
+				sampler.CloseContainer(pod, container)
+			}
+		},
+		OnError: func(pod *v1.Pod, container *v1.Container, err error) {
+			_, _ = red.Fprintf(os.Stderr,
+				"==> Warning: Error while tailing container [%s]: %s\n",
+				formatPodAndContainer(pod, container), err)
+		},
+		OnWatchError: func(err error, failingFor time.Duration) {
+			_, _ = red.Fprintf(os.Stderr,
+				"==> Warning: Unable to watch pods for %s, retrying: %s\n", failingFor-failingFor%time.Second, err)
+		},
+		OnWatchRecover: func(downtime time.Duration) {
+			_, _ = yellow.Fprintf(os.Stderr, "==> Watching pods again after %s\n", downtime-downtime%time.Second)
+		},
+		OnPodEvent: func(event PodEventType, pod *v1.Pod) {
+			if stateFile != nil && event == PodDeleted {
+				stateFile.Forget(pod)
+			}
+			if terminations != nil {
+				terminated(terminations.observe(event, pod))
+			}
+		},
+		OnReady: func(tailing int) {
+			waiter.ready(tailing, describeSelectors(labelSelectors))
+		},
+	}
+	logger := &callbackLogger{
+		quiet:      s.quiet,
+		verbosity:  s.verbosity,
+		maxTailers: s.maxTailers,
+		formatPod:  formatPod,
+		logf: func(format string, args ...interface{}) {
+			_, _ = yellow.Fprintf(os.Stderr, "==> "+format+"\n", args...)
+		},
+	}
+	callbacks = logger.Instrument(callbacks)
+	callbacks = stats.Instrument(callbacks)
+	if s.httpAddr != "" {
+		callbacks = instrumentCallbacks(callbacks)
+	}
+
+	var startPosition func(pod *v1.Pod, container *v1.Container) *time.Time
+	if stateFile != nil {
+		startPosition = stateFile.Position
+	}
+
+	controllers := make([]*Controller, len(clusters))
+	for i, c := range clusters {
+		clusterCallbacks, name := callbacks, c.name
+		clusterCallbacks.OnStopped = func(pod *v1.Pod, container *v1.Container) {
+			// Only now can no more lines arrive for a container's file
+			_ = closeContainer(sink, name, pod, container)
 		}
+		controllers[i] = NewControllerWithOptions(c.clientset,
+			WithCluster(c.name),
+			WithNamespace(c.namespace),
+			WithLabelSelectors(c.labelSelectors...),
+			WithFieldSelector(s.fieldSelector),
+			WithPodFilter(s.containerFilter.MatchPod),
+			WithFilter(s.containerFilter.Match),
+			WithInitContainers(s.initContainers),
+			WithCompletedPods(!s.skipCompleted, !s.skipFailed),
+			WithResyncPeriod(s.resyncPeriod),
+			WithTailOptions(s.tailOptions),
+			WithRestartMarkers(!s.quiet),
+			WithWaitingMarkers(s.containerStatus),
+			WithMaxTailers(s.maxTailers),
+			WithIdleTimeout(s.idleTimeout),
+			WithStartPositions(startPosition),
+			WithCallbacks(clusterCallbacks))
 	}
 
-	labelSelector := labels.Everything()
-	if labelSelectorExpr != "" {
-		if sel, err := labels.Parse(labelSelectorExpr); err != nil {
+	if s.list {
+		names, err := listContainers(clusters, controllers)
+		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
-		} else {
-			labelSelector = sel
 		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return
 	}
 
-	tmpl, err := template.New("line").Parse(tmplString)
+	chain, err := newSinkChain(s, red)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, fmt.Sprintf("Invalid template: %s", err))
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	sink = chain.sink
 
-	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
-		&clientcmd.ClientConfigLoadingRules{
-			ExplicitPath: kubeconfigPath,
-		},
-		&clientcmd.ConfigOverrides{
-			CurrentContext: contextName,
-		})
+	if s.httpAddr != "" {
+		go func() {
+			if err := serveHTTP(s.httpAddr, controllers); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}()
+	}
 
-	config, err := clientConfig.ClientConfig()
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go handleSignals(signals, cancel, os.Exit)
+
+	var wg sync.WaitGroup
+	for _, controller := range controllers {
+		wg.Add(1)
+		go func(controller *Controller) {
+			defer wg.Done()
+			controller.Run(ctx)
+		}(controller)
 	}
+	tailersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(tailersDone)
+	}()
 
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	drain(ctx, tailersDone, s.drainTimeout, func() {
+		if stateFile != nil {
+			if err := stateFile.Close(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+		if joiner != nil {
+			joiner.Close()
+		}
+		if err := sink.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}, func(warning string) {
+		_, _ = red.Fprintf(os.Stderr, "==> Warning: %s\n", warning)
+	})
+	chain.reportFailures(red)
+	if !s.quiet && s.outputFormat == "" {
+		_, _ = yellow.Fprintf(os.Stderr, "==> %s\n", stats)
+	}
+	if sampler != nil && !s.quiet {
+		_, _ = yellow.Fprintf(os.Stderr, "==> %s\n", sampler)
+	}
+	if code := atomic.LoadInt32(&exitCode); code != 0 {
+		os.Exit(int(code))
 	}
+}
 
-	rawConfig, err := clientConfig.RawConfig()
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+// lineLimit counts the lines written across all containers, and calls stop
+// once the maximum is reached.
+type lineLimit struct {
+	count int64 // First for 64-bit alignment of atomic ops
+	max   int64
+	stop  func()
+}
+
+// allow returns true if another line may be written.
+func (l *lineLimit) allow() bool {
+	n := atomic.AddInt64(&l.count, 1)
+	if n == l.max {
+		l.stop()
 	}
+	return n <= l.max
+}
 
-	if allNamespaces {
-		namespace = v1.NamespaceAll
-	} else if namespace == "" {
-		if rawConfig.Contexts[rawConfig.CurrentContext].Namespace == "" {
-			namespace = v1.NamespaceDefault
-		} else {
-			namespace = rawConfig.Contexts[rawConfig.CurrentContext].Namespace
+// startupWaiter reports when no containers are being tailed once the pods
+// existing at startup have been seen. With --wait, it says what it is waiting
+// for; with --no-wait, it fails unless containers were entered within the
+// grace period.
+type startupWaiter struct {
+	wait, noWait bool
+	gracePeriod  time.Duration
+	entered      func() int64
+	notify       func(message string)
+	fail         func(message string)
+}
+
+func (w *startupWaiter) ready(tailing int, description string) {
+	if tailing > 0 {
+		return
+	}
+	if w.wait {
+		w.notify(fmt.Sprintf("Waiting for %s", description))
+	}
+	if w.noWait {
+		// Give pods that are still starting a chance to come up
+		go func() {
+			time.Sleep(w.gracePeriod)
+			if w.entered() == 0 {
+				w.fail(fmt.Sprintf("No containers found for %s", description))
+			}
+		}()
+	}
+}
+
+// describeSelectors describes the pods matched by the selectors.
+func describeSelectors(selectors []labels.Selector) string {
+	var matching []string
+	for _, sel := range selectors {
+		if !sel.Empty() {
+			matching = append(matching, sel.String())
 		}
 	}
+	if len(matching) == 0 || len(matching) != len(selectors) {
+		return "all pods"
+	}
+	return fmt.Sprintf("pods matching %s", strings.Join(matching, " or "))
+}
 
-	yellow := color.New(color.FgYellow)
-	red := color.New(color.FgRed)
+// listContainers returns the sorted names of the containers that the
+// controllers, one per cluster, would tail, as namespace/pod/container
+// prefixed by the cluster's name if it has one.
+func listContainers(clusters []cluster, controllers []*Controller) ([]string, error) {
+	var names []string
+	for i, controller := range controllers {
+		refs, err := controller.MatchingContainers()
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			name := fmt.Sprintf("%s/%s/%s", ref.Pod.Namespace, ref.Pod.Name, ref.Container.Name)
+			if clusters[i].name != "" {
+				name = clusters[i].name + "/" + name
+			}
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
 
-	formatPod := func(pod *v1.Pod) string {
-		if allNamespaces {
-			return fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
+// handleSignals stops ktail on the first signal, so that the output is
+// drained before it exits, and exits at once on the second.
+func handleSignals(signals <-chan os.Signal, cancel func(), exit func(code int)) {
+	<-signals
+	cancel()
+	<-signals
+	// Asked twice; don't wait for the output to drain
+	exit(1)
+}
+
+// runContext returns the context ktail runs in, which ends after the timeout
+// unless it is zero.
+func runContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// cluster is a context being tailed by its own controller, all writing to the
+// same output. The name is only set when there is more than one.
+type cluster struct {
+	name           string
+	clientset      kubernetes.Interface
+	namespace      string
+	labelSelectors []labels.Selector
+}
+
+// connectClusters connects to each of the contexts given by --context, or the
+// current context if none are.
+func connectClusters(s *settings) ([]cluster, error) {
+	contextNames := s.contextNames
+	if len(contextNames) == 0 {
+		contextNames = []string{""}
+	}
+	var clusters []cluster
+	for _, contextName := range contextNames {
+		config, defaultNamespace, err := loadConfig(s.kubeconfigPath, contextName, s.clusterName)
+		if err != nil {
+			return nil, err
 		}
-		return pod.Name
+
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+
+		c := cluster{
+			clientset: clientset,
+			namespace: s.namespace,
+		}
+		if len(contextNames) > 1 {
+			c.name = contextName
+		}
+		if c.namespace == "" && !s.allNamespaces {
+			c.namespace = defaultNamespace
+		}
+		if c.labelSelectors, err = clusterSelectors(clientset, c.namespace, s); err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, c)
 	}
+	return clusters, nil
+}
 
-	formatPodAndContainer := func(pod *v1.Pod, container *v1.Container) string {
-		return fmt.Sprintf("%s:%s", formatPod(pod), container.Name)
+// clusterSelectors narrows each of the label selectors down to the pods also
+// matching the selector of the workload or of --selector-from-pod, as found
+// in the namespace.
+func clusterSelectors(clientset kubernetes.Interface, namespace string, s *settings) ([]labels.Selector, error) {
+	selectors := s.labelSelectors
+	narrow := func(sel labels.Selector) error {
+		narrowed := make([]labels.Selector, len(selectors))
+		for i := range selectors {
+			var err error
+			if narrowed[i], err = andSelectors(selectors[i], sel); err != nil {
+				return err
+			}
+		}
+		selectors = narrowed
+		return nil
+	}
+	if len(s.workloadArgs) > 0 {
+		kind, name, _ := parseWorkloadRef(s.workloadArgs[0])
+		workloadSelector, err := resolveWorkloadSelector(clientset, namespace, kind, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := narrow(workloadSelector); err != nil {
+			return nil, err
+		}
+	}
+	if s.selectorFromPod != "" {
+		podSelector, err := podSiblingSelector(clientset, namespace, s.selectorFromPod, s.selectorPodLabels)
+		if err != nil {
+			return nil, err
+		}
+		if err := narrow(podSelector); err != nil {
+			return nil, err
+		}
 	}
+	return selectors, nil
+}
 
-	var stdoutMutex sync.Mutex
-	controller := NewController(clientset, namespace, labelSelector,
-		Callbacks{
-			OnEvent: func(event LogEvent) {
-				stdoutMutex.Lock()
-				defer stdoutMutex.Unlock()
-				_ = tmpl.Execute(os.Stdout, event)
-			},
-			OnEnter: func(
-				pod *v1.Pod,
-				container *v1.Container,
-				initialAddPhase bool) bool {
-				if len(containerPatterns) > 0 {
-					match := false
-					for _, r := range containerPatterns {
-						if r.MatchString(pod.Name) || r.MatchString(container.Name) {
-							match = true
-							break
-						}
-					}
-					if !match {
-						return false
-					}
-				}
-				if !quiet {
-					if initialAddPhase {
-						_, _ = yellow.Fprintf(os.Stderr,
-							"==> Detected running container [%s]\n", formatPodAndContainer(pod, container))
-					} else {
-						_, _ = yellow.Fprintf(os.Stderr,
-							"==> New container [%s]\n", formatPodAndContainer(pod, container))
-					}
-				}
-				return true
-			},
-			OnExit: func(pod *v1.Pod, container *v1.Container) {
-				if !quiet {
-					var status = "unknown"
-					for _, containerStatus := range pod.Status.ContainerStatuses {
-						if containerStatus.Name == container.Name {
-							if containerStatus.State.Running != nil {
-								status = "running"
-							} else if containerStatus.State.Waiting != nil {
-								status = "waiting"
-							} else if containerStatus.State.Terminated != nil {
-								status = "terminated"
-							}
-							break
-						}
-					}
-					_, _ = yellow.Fprintf(os.Stderr,
-						"==> Container left (%s) [%s]\n", status,
-						formatPodAndContainer(pod, container))
-				}
-			},
-			OnError: func(pod *v1.Pod, container *v1.Container, err error) {
-				_, _ = red.Fprintf(os.Stderr,
-					"==> Warning: Error while tailing container [%s]: %s\n",
-					formatPodAndContainer(pod, container), err)
+// sinkChain is the sink that lines are written to, writing to stdout or
+// files and to any of the webhook, Loki and Kafka.
+type sinkChain struct {
+	sink          Sink
+	webhook, loki *WebhookSink
+	kafka         *KafkaSink
+}
+
+func newSinkChain(s *settings, red *color.Color) (*sinkChain, error) {
+	var (
+		chain sinkChain
+		err   error
+	)
+	if s.outputDir != "" {
+		if chain.sink, err = NewFileSink(s.outputDir, s.maxFileSize, s.gzipFiles, s.formatter); err != nil {
+			return nil, err
+		}
+	} else {
+		stdoutFormat := s.formatter
+		if s.outputFormat == "" && !s.raw && !s.stripColors {
+			// Don't let the message's colors carry over into the next prefix
+			stdoutFormat = ResetANSIFormatter(s.formatter)
+		}
+		var writerSink *WriterSink
+		if s.flushInterval > 0 {
+			writerSink = NewBufferedWriterSink(os.Stdout, stdoutFormat, s.flushInterval)
+		} else {
+			writerSink = NewWriterSink(os.Stdout, stdoutFormat)
+		}
+		if s.groupBlankLines {
+			writerSink.SeparatePods()
+		}
+		chain.sink = writerSink
+	}
+	if s.webhookOptions.URL != "" {
+		webhookOptions := s.webhookOptions
+		webhookOptions.OnError = func(err error, events int) {
+			_, _ = red.Fprintf(os.Stderr, "==> Warning: Failed to send %d lines to the webhook: %s\n", events, err)
+		}
+		chain.webhook = NewWebhookSink(webhookOptions)
+		chain.sink = MultiSink{chain.sink, logsOnlySink{chain.webhook}}
+	}
+	if s.lokiURL != "" {
+		chain.loki = NewLokiSink(s.lokiURL, WebhookOptions{
+			Headers:       s.webhookOptions.Headers,
+			BatchSize:     s.webhookOptions.BatchSize,
+			FlushInterval: s.webhookOptions.FlushInterval,
+			MaxRetries:    5,
+			OnError: func(err error, events int) {
+				_, _ = red.Fprintf(os.Stderr, "==> Warning: Failed to send %d lines to Loki: %s\n", events, err)
 			},
 		})
-	controller.Run()
+		chain.sink = MultiSink{chain.sink, logsOnlySink{chain.loki}}
+	}
+	if len(s.kafkaOptions.Brokers) > 0 {
+		kafkaOptions := s.kafkaOptions
+		var reportedAt time.Time
+		kafkaOptions.OnError = func(err error) {
+			if time.Since(reportedAt) < kafkaErrorReportInterval {
+				return
+			}
+			reportedAt = time.Now()
+			_, _ = red.Fprintf(os.Stderr, "==> Warning: Failed to produce lines to Kafka: %s\n", err)
+		}
+		if chain.kafka, err = NewKafkaSink(kafkaOptions); err != nil {
+			return nil, err
+		}
+		chain.sink = MultiSink{chain.sink, logsOnlySink{chain.kafka}}
+	}
+	if s.mergeWindow > 0 {
+		chain.sink = NewMergeBuffer(s.mergeWindow, chain.sink)
+	}
+	return &chain, nil
+}
+
+// reportFailures reports the lines that could not be sent, once the sinks
+// have been closed.
+func (c *sinkChain) reportFailures(red *color.Color) {
+	if c.webhook != nil {
+		if n, err := c.webhook.Failed(); n > 0 {
+			_, _ = red.Fprintf(os.Stderr, "==> Failed to send %d lines to the webhook: %s\n", n, err)
+		}
+	}
+	if c.loki != nil {
+		if n, err := c.loki.Failed(); n > 0 {
+			_, _ = red.Fprintf(os.Stderr, "==> Failed to send %d lines to Loki: %s\n", n, err)
+		}
+	}
+	if c.kafka != nil {
+		if n := c.kafka.Dropped(); n > 0 {
+			_, _ = red.Fprintf(os.Stderr, "==> Dropped %d lines because Kafka could not keep up\n", n)
+		}
+		if n, err := c.kafka.Failed(); n > 0 {
+			_, _ = red.Fprintf(os.Stderr, "==> Failed to produce %d lines to Kafka: %s\n", n, err)
+		}
+	}
+}
+
+// drain waits for the tailers to finish, and then for closeOutput to write
+// out what they have read. When stopped, such as by SIGTERM when the pod
+// ktail runs in is being terminated, it waits at most the timeout in all,
+// calling warn for what didn't finish in time; a zero timeout waits
+// indefinitely.
+func drain(
+	ctx context.Context,
+	tailersDone <-chan struct{},
+	timeout time.Duration,
+	closeOutput func(),
+	warn func(warning string)) {
+	select {
+	case <-tailersDone:
+	case <-ctx.Done():
+	}
+	var deadline time.Time
+	if ctx.Err() != nil && timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if !waitUntil(tailersDone, deadline) {
+		warn(fmt.Sprintf("Containers were still being tailed after %s", timeout))
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		closeOutput()
+	}()
+	if !waitUntil(closed, deadline) {
+		warn(fmt.Sprintf("Output was not flushed within %s", timeout))
+	}
+}
+
+// waitUntil waits for done to be closed, returning false if the deadline
+// passes first. A zero deadline waits indefinitely.
+func waitUntil(done <-chan struct{}, deadline time.Time) bool {
+	if deadline.IsZero() {
+		<-done
+		return true
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(deadline.Sub(time.Now())):
+		return false
+	}
 }
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	extensionsv1beta1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+func TestDrain(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		stopped      bool
+		tailersDone  bool
+		outputClosed bool
+		want         string
+	}{
+		{"tailers finished", false, true, true, ""},
+		{"stopped", true, true, true, ""},
+		// The output gets no more time once the tailers have used it up
+		{"tailers still running", true, false, false,
+			"Containers were still being tailed after 50ms; Output was not flushed within 50ms"},
+		{"output not flushed", true, true, false, "Output was not flushed within 50ms"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.stopped {
+				cancel()
+			}
+			tailersDone := make(chan struct{})
+			if test.tailersDone {
+				close(tailersDone)
+			}
+			unblock := make(chan struct{})
+			defer close(unblock)
+			closed := false
+			closeOutput := func() {
+				if !test.outputClosed {
+					<-unblock
+				}
+				closed = true
+			}
+
+			var warnings []string
+			drain(ctx, tailersDone, 50*time.Millisecond, closeOutput, func(warning string) {
+				warnings = append(warnings, warning)
+			})
+			if got := strings.Join(warnings, "; "); got != test.want {
+				t.Errorf("got warnings %q, want %q", got, test.want)
+			}
+			if test.outputClosed && !closed {
+				t.Error("got output not closed")
+			}
+		})
+	}
+}
+
+func TestClusterSelectors(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&extensionsv1beta1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: extensionsv1beta1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+		},
+	})
+	s := &settings{
+		labelSelectors: []labels.Selector{
+			labels.SelectorFromSet(labels.Set{"track": "stable"}),
+			labels.SelectorFromSet(labels.Set{"track": "canary"}),
+		},
+		workloadArgs: []string{"deployment/web"},
+	}
+	selectors, err := clusterSelectors(clientset, "default", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, sel := range selectors {
+		got = append(got, sel.String())
+	}
+	if want := "app=web,track=stable; app=web,track=canary"; strings.Join(got, "; ") != want {
+		t.Errorf("got selectors %q, want %q", got, want)
+	}
+}
+
+func TestRunContext_Timeout(t *testing.T) {
+	start := time.Now()
+	ctx, cancel := runContext(100 * time.Millisecond)
+	defer cancel()
+	clientset, _ := newFakeClientset(podWithContainers("a", "b"))
+	ctl := NewControllerWithOptions(clientset)
+	ctl.logStream = blockingLogs
+
+	tailersDone := make(chan struct{})
+	go func() {
+		defer close(tailersDone)
+		ctl.Run(ctx)
+	}()
+	var warnings []string
+	closed := false
+	drain(ctx, tailersDone, time.Second, func() { closed = true }, func(warning string) {
+		warnings = append(warnings, warning)
+	})
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("got Run returning after %s, want near the 100ms timeout", elapsed)
+	}
+	if n := ctl.TailerCount(); n != 0 {
+		t.Errorf("got %d tailers after the timeout, want 0", n)
+	}
+	if !closed || len(warnings) != 0 {
+		t.Errorf("got output closed %v with warnings %q, want closed without warnings", closed, warnings)
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Errorf("got context error %v, want the deadline exceeded", ctx.Err())
+	}
+}
+
+func TestRunContext_NoTimeout(t *testing.T) {
+	ctx, cancel := runContext(0)
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("got a deadline without a timeout")
+	}
+	cancel()
+	if ctx.Err() != context.Canceled {
+		t.Errorf("got context error %v, want cancelled", ctx.Err())
+	}
+}
+
+func TestLineLimit(t *testing.T) {
+	ctx, cancel := runContext(0)
+	defer cancel()
+	limit := &lineLimit{max: 50, stop: cancel}
+	var written int64
+	clientset, _ := newFakeClientset(podWithContainers("a", "b"))
+	ctl := NewControllerWithOptions(clientset, WithEventFunc(func(event LogEvent) {
+		if limit.allow() {
+			atomic.AddInt64(&written, 1)
+		}
+	}))
+	ctl.logStream = func(pod *v1.Pod, options *v1.PodLogOptions) (io.ReadCloser, error) {
+		r, w := io.Pipe()
+		go func() {
+			for i := 0; i < 100; i++ {
+				if _, err := io.WriteString(w, logLine(time.Now(), fmt.Sprintf("%s %d", options.Container, i))); err != nil {
+					return
+				}
+			}
+		}()
+		return r, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctl.Run(ctx)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after the line limit was reached")
+	}
+	if n := atomic.LoadInt64(&written); n != 50 {
+		t.Errorf("got %d lines written, want 50", n)
+	}
+	if n := ctl.TailerCount(); n != 0 {
+		t.Errorf("got %d tailers after the limit, want 0", n)
+	}
+}
+
+func TestStartupWaiter(t *testing.T) {
+	web := labels.SelectorFromSet(labels.Set{"app": "web"})
+	for _, test := range []struct {
+		name         string
+		wait, noWait bool
+		podAppears   bool
+		want         string
+	}{
+		{"wait", true, false, false, "notify: Waiting for pods matching app=web"},
+		{"no wait", false, true, false, "fail: No containers found for pods matching app=web"},
+		{"no wait with a pod appearing", false, true, true, ""},
+		{"wait and a pod appearing", true, false, true, "notify: Waiting for pods matching app=web"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var messages []string
+			record := func(kind string) func(string) {
+				return func(message string) {
+					mu.Lock()
+					defer mu.Unlock()
+					messages = append(messages, kind+": "+message)
+				}
+			}
+			var entered int64
+			waiter := &startupWaiter{
+				wait:        test.wait,
+				noWait:      test.noWait,
+				gracePeriod: 100 * time.Millisecond,
+				entered:     func() int64 { return atomic.LoadInt64(&entered) },
+				notify:      record("notify"),
+				fail:        record("fail"),
+			}
+			clientset, watcher := newFakeClientset()
+			ctl := NewControllerWithOptions(clientset,
+				WithLabelSelector(web),
+				WithCallbacks(Callbacks{
+					OnEnter: func(pod *v1.Pod, container *v1.Container, initialAdd bool) bool {
+						atomic.AddInt64(&entered, 1)
+						return true
+					},
+					OnReady: func(tailing int) { waiter.ready(tailing, describeSelectors([]labels.Selector{web})) },
+				}))
+			ctl.logStream = blockingLogs
+			go ctl.Run(context.Background())
+			defer ctl.Stop()
+
+			if test.podAppears {
+				pod := podWithContainers("app")
+				pod.Labels = map[string]string{"app": "web"}
+				watcher.Add(&pod)
+				waitFor(t, "the pod to be tailed", func() bool { return ctl.TailerCount() == 1 })
+			}
+			time.Sleep(200 * time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			if got := strings.Join(messages, "; "); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDescribeSelectors(t *testing.T) {
+	web := labels.SelectorFromSet(labels.Set{"app": "web"})
+	db := labels.SelectorFromSet(labels.Set{"app": "db"})
+	for _, test := range []struct {
+		selectors []labels.Selector
+		want      string
+	}{
+		{[]labels.Selector{labels.Everything()}, "all pods"},
+		{[]labels.Selector{web}, "pods matching app=web"},
+		{[]labels.Selector{web, db}, "pods matching app=web or app=db"},
+		{[]labels.Selector{web, labels.Everything()}, "all pods"},
+	} {
+		if got := describeSelectors(test.selectors); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.selectors, got, test.want)
+		}
+	}
+}
+
+// slowWriter takes a while for each write, like a congested pipe.
+type slowWriter struct {
+	buf bytes.Buffer
+	sync.Mutex
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(50 * time.Millisecond)
+	w.Lock()
+	defer w.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *slowWriter) String() string {
+	w.Lock()
+	defer w.Unlock()
+	return w.buf.String()
+}
+
+func TestHandleSignals_Drain(t *testing.T) {
+	ctx, cancel := runContext(0)
+	defer cancel()
+	out := &slowWriter{}
+	sink := NewBufferedWriterSink(out, messageFormatter, time.Hour)
+	t0 := time.Now()
+	clientset, _ := newFakeClientset(podWithContainers("app"))
+	received := make(chan struct{})
+	ctl := NewControllerWithOptions(clientset, WithEventFunc(func(event LogEvent) {
+		_ = sink.Write(event)
+		if event.Message == "b" {
+			close(received)
+		}
+	}))
+	ctl.logStream = func(pod *v1.Pod, options *v1.PodLogOptions) (io.ReadCloser, error) {
+		// Two lines, then nothing until stopped
+		r, w := io.Pipe()
+		go func() {
+			_, _ = io.WriteString(w, logLine(t0, "a")+logLine(t0.Add(time.Second), "b"))
+		}()
+		return r, nil
+	}
+
+	signals := make(chan os.Signal, 2)
+	exited := make(chan int, 1)
+	go handleSignals(signals, cancel, func(code int) { exited <- code })
+	tailersDone := make(chan struct{})
+	go func() {
+		defer close(tailersDone)
+		ctl.Run(ctx)
+	}()
+	<-received
+	signals <- syscall.SIGTERM
+
+	drain(ctx, tailersDone, time.Second, func() {
+		if err := sink.Close(); err != nil {
+			t.Error(err)
+		}
+	}, func(warning string) { t.Errorf("unexpected warning: %s", warning) })
+	if got := out.String(); got != "a\nb\n" {
+		t.Errorf("got %q written when drained, want all lines", got)
+	}
+	if n := ctl.TailerCount(); n != 0 {
+		t.Errorf("got %d tailers after draining, want 0", n)
+	}
+	select {
+	case code := <-exited:
+		t.Errorf("got exit %d after one signal, want the output drained instead", code)
+	default:
+	}
+
+	signals <- syscall.SIGTERM
+	select {
+	case code := <-exited:
+		if code != 1 {
+			t.Errorf("got exit code %d after a second signal, want 1", code)
+		}
+	case <-time.After(time.Second):
+		t.Error("got no exit after a second signal")
+	}
+}
+
+func TestListContainers(t *testing.T) {
+	s, err := parseSettings([]string{"--list", "--all-namespaces", "-l", "app=web", "--exclude-container", "^sidecar$"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := func(namespace, name, app string, containers ...string) v1.Pod {
+		p := podWithContainers(containers...)
+		p.Namespace, p.Name, p.UID = namespace, name, types.UID("uid-"+namespace+"-"+name)
+		p.Labels = map[string]string{"app": app}
+		return p
+	}
+	east, _ := newFakeClientset(
+		pod("default", "web-1", "web", "app", "sidecar"),
+		pod("default", "db-1", "db", "db"),
+		pod("kube-system", "web-dns", "web", "dns"))
+	west, _ := newFakeClientset(pod("prod", "web-2", "web", "app"))
+	clusters := []cluster{{name: "east", clientset: east}, {name: "west", clientset: west}}
+
+	var entered int32
+	var controllers []*Controller
+	for _, c := range clusters {
+		controllers = append(controllers, NewControllerWithOptions(c.clientset,
+			WithNamespace(s.namespace),
+			WithLabelSelectors(s.labelSelectors...),
+			WithPodFilter(s.containerFilter.MatchPod),
+			WithFilter(s.containerFilter.Match),
+			WithCallbacks(Callbacks{OnEnter: func(*v1.Pod, *v1.Container, bool) bool {
+				atomic.AddInt32(&entered, 1)
+				return true
+			}})))
+	}
+	names, err := listContainers(clusters, controllers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(names, "\n"), "east/default/web-1/app\nwest/prod/web-2/app"; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	for _, ctl := range controllers {
+		if n := ctl.TailerCount(); n != 0 {
+			t.Errorf("got %d tailers created, want none", n)
+		}
+	}
+	if n := atomic.LoadInt32(&entered); n != 0 {
+		t.Errorf("got %d containers entered, want none", n)
+	}
+
+	// Without cluster names, the containers are listed as they are
+	names, err = listContainers([]cluster{{clientset: west}}, controllers[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(names, "\n"), "prod/web-2/app"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
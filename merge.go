@@ -0,0 +1,162 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// MergeBuffer is a sink that holds on to events for a short window so that
+// events from different containers can be passed on in timestamp order.
+type MergeBuffer struct {
+	window time.Duration
+	next   Sink
+	events []bufferedEvent
+	latest map[string]time.Time // Latest sort time of each container
+	stopCh chan struct{}
+	doneCh chan struct{}
+	sync.Mutex
+}
+
+type bufferedEvent struct {
+	event LogEvent
+	time  time.Time
+	close bool // Close the event's container in the next sink instead
+}
+
+type byTime []bufferedEvent
+
+func (b byTime) Len() int           { return len(b) }
+func (b byTime) Less(i, j int) bool { return b[i].time.Before(b[j].time) }
+func (b byTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// NewMergeBuffer returns a buffer that passes events to the next sink once
+// they are older than window. Close must be called to flush remaining
+// events; it also closes the next sink.
+func NewMergeBuffer(window time.Duration, next Sink) *MergeBuffer {
+	b := &MergeBuffer{
+		window: window,
+		next:   next,
+		latest: map[string]time.Time{},
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Write buffers an event. Events without a timestamp are ordered by the
+// time they were received. A container's events are never reordered, even
+// if their timestamps are out of order: each is sorted as no earlier than
+// the container's previous event.
+func (b *MergeBuffer) Write(event LogEvent) error {
+	t := time.Now()
+	if event.Timestamp != nil {
+		t = *event.Timestamp
+	}
+	key := buildKey(event.Pod, event.Container)
+
+	b.Lock()
+	defer b.Unlock()
+	if latest, ok := b.latest[key]; ok && t.Before(latest) {
+		t = latest
+	}
+	b.latest[key] = t
+	b.events = append(b.events, bufferedEvent{event: event, time: t})
+	return nil
+}
+
+// CloseContainer closes the container in the next sink once the events
+// buffered for it have been passed on.
+func (b *MergeBuffer) CloseContainer(cluster string, pod *v1.Pod, container *v1.Container) error {
+	key := buildKey(pod, container)
+
+	b.Lock()
+	defer b.Unlock()
+	latest, ok := b.latest[key]
+	if !ok {
+		return closeContainer(b.next, cluster, pod, container)
+	}
+	b.events = append(b.events, bufferedEvent{
+		event: LogEvent{Cluster: cluster, Pod: pod, Container: container},
+		time:  latest,
+		close: true,
+	})
+	return nil
+}
+
+// Flush passes on all buffered events, regardless of age.
+func (b *MergeBuffer) Flush() error {
+	if err := b.flush(time.Time{}); err != nil {
+		return err
+	}
+	return b.next.Flush()
+}
+
+// Close stops buffering, and flushes and closes the next sink.
+func (b *MergeBuffer) Close() error {
+	close(b.stopCh)
+	<-b.doneCh
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return b.next.Close()
+}
+
+func (b *MergeBuffer) run() {
+	defer close(b.doneCh)
+
+	interval := b.window / 2
+	if interval <= 0 {
+		interval = time.Millisecond * 100
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopCh:
+			return
+		case now := <-ticker.C:
+			_ = b.flush(now.Add(-b.window))
+		}
+	}
+}
+
+// flush passes on, in order, all events at or before the cutoff. A zero
+// cutoff passes on everything. It returns the first error from the next
+// sink.
+func (b *MergeBuffer) flush(cutoff time.Time) error {
+	b.Lock()
+	defer b.Unlock()
+
+	sort.Stable(byTime(b.events))
+	n := len(b.events)
+	if !cutoff.IsZero() {
+		n = sort.Search(len(b.events), func(i int) bool {
+			return b.events[i].time.After(cutoff)
+		})
+	}
+	var firstErr error
+	for _, e := range b.events[:n] {
+		var err error
+		if e.close {
+			err = closeContainer(b.next, e.event.Cluster, e.event.Pod, e.event.Container)
+		} else {
+			err = b.next.Write(e.event)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	b.events = append(b.events[:0], b.events[n:]...)
+
+	// Containers with nothing left buffered can't be reordered any more
+	for key, t := range b.latest {
+		if cutoff.IsZero() || !t.After(cutoff) {
+			delete(b.latest, key)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// recordingSink records the messages written to it, and the containers
+// closed, as "close:<container>".
+type recordingSink struct {
+	records []string
+	flushes int
+	closed  bool
+	sync.Mutex
+}
+
+func (s *recordingSink) Write(event LogEvent) error {
+	s.Lock()
+	defer s.Unlock()
+	s.records = append(s.records, event.Message)
+	return nil
+}
+
+func (s *recordingSink) CloseContainer(cluster string, pod *v1.Pod, container *v1.Container) error {
+	s.Lock()
+	defer s.Unlock()
+	s.records = append(s.records, "close:"+container.Name)
+	return nil
+}
+
+func (s *recordingSink) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+	s.flushes++
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *recordingSink) String() string {
+	s.Lock()
+	defer s.Unlock()
+	return strings.Join(s.records, " ")
+}
+
+func testEvent(pod *v1.Pod, container string, t time.Time, message string) LogEvent {
+	return LogEvent{
+		Pod:       pod,
+		Container: &v1.Container{Name: container},
+		Timestamp: &t,
+		Message:   message,
+	}
+}
+
+func TestMergeBuffer(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	for _, test := range []struct {
+		name  string
+		write func(b *MergeBuffer)
+		want  string
+	}{
+		{"timestamp order across containers", func(b *MergeBuffer) {
+			_ = b.Write(testEvent(pod, "a", at(2), "a2"))
+			_ = b.Write(testEvent(pod, "b", at(1), "b1"))
+			_ = b.Write(testEvent(pod, "b", at(3), "b3"))
+		}, "b1 a2 b3"},
+		{"container order kept for earlier timestamps", func(b *MergeBuffer) {
+			_ = b.Write(testEvent(pod, "a", at(3), "a3"))
+			_ = b.Write(testEvent(pod, "a", at(1), "a1"))
+			_ = b.Write(testEvent(pod, "b", at(2), "b2"))
+		}, "b2 a3 a1"},
+		{"close after the container's buffered events", func(b *MergeBuffer) {
+			_ = b.Write(testEvent(pod, "a", at(1), "a1"))
+			_ = b.Write(testEvent(pod, "a", at(3), "a3"))
+			_ = b.CloseContainer("", pod, &v1.Container{Name: "a"})
+			_ = b.Write(testEvent(pod, "b", at(2), "b2"))
+			_ = b.Write(testEvent(pod, "b", at(4), "b4"))
+		}, "a1 b2 a3 close:a b4"},
+		{"close with nothing buffered", func(b *MergeBuffer) {
+			_ = b.CloseContainer("", pod, &v1.Container{Name: "a"})
+			_ = b.Write(testEvent(pod, "a", at(1), "a1"))
+		}, "close:a a1"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			next := &recordingSink{}
+			b := NewMergeBuffer(time.Hour, next)
+			test.write(b)
+			if err := b.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := next.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if !next.closed {
+				t.Errorf("next sink was not closed")
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// truncatedMarker is appended to messages shortened by truncateMessage.
+const truncatedMarker = "…(truncated)"
+
+// truncateMessage shortens s to at most n bytes, not counting the marker,
+// without splitting a UTF-8 sequence.
+func truncateMessage(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + truncatedMarker
+}
+
+// ansiPattern matches ANSI escape sequences: CSI sequences such as colors,
+// OSC sequences such as window titles, and two-byte escapes.
+var ansiPattern = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[@-Z\\-_])`)
+
+// ansiReset resets the terminal's colors and other text attributes.
+const ansiReset = "\x1b[0m"
+
+// stripANSI removes ANSI escape sequences from s.
+func stripANSI(s string) string {
+	if !strings.Contains(s, "\x1b") {
+		return s
+	}
+	return ansiPattern.ReplaceAllString(s, "")
+}
+
+// resetANSI appends a reset to s if it contains escape sequences, so that
+// colors it sets don't carry over into the following output.
+func resetANSI(s string) string {
+	if !strings.Contains(s, "\x1b") {
+		return s
+	}
+	return s + ansiReset
+}
+
+// isBinary returns true if s is not valid UTF-8, as is the case for most
+// binary data.
+func isBinary(s string) bool {
+	return !utf8.ValidString(s)
+}
+
+// escapeBinary returns s with invalid UTF-8 and non-printable characters,
+// other than tabs, escaped as \xNN.
+func escapeBinary(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if (r == utf8.RuneError && size <= 1) || (r != '\t' && !unicode.IsPrint(r)) {
+			for _, b := range []byte(s[i : i+size]) {
+				fmt.Fprintf(&buf, "\\x%02x", b)
+			}
+		} else {
+			buf.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	return buf.String()
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestTruncateMessage(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly", 7, "exactly"},
+		{"too long", 3, "too" + truncatedMarker},
+		{"héllo", 2, "h" + truncatedMarker},
+		{"héllo", 3, "hé" + truncatedMarker},
+	} {
+		if got := truncateMessage(test.s, test.n); got != test.want {
+			t.Errorf("truncateMessage(%q, %d): got %q, want %q", test.s, test.n, got, test.want)
+		}
+	}
+}
+
+func TestEscapeBinary(t *testing.T) {
+	for _, test := range []struct {
+		s       string
+		binary  bool
+		escaped string
+	}{
+		{"plain\ttext", false, "plain\ttext"},
+		{"bell\a", false, `bell\x07`},
+		{"héllo", false, "héllo"},
+		{"\xff\xfeab", true, `\xff\xfeab`},
+	} {
+		if got := isBinary(test.s); got != test.binary {
+			t.Errorf("isBinary(%q): got %v, want %v", test.s, got, test.binary)
+		}
+		if got := escapeBinary(test.s); got != test.escaped {
+			t.Errorf("escapeBinary(%q): got %q, want %q", test.s, got, test.escaped)
+		}
+	}
+}
+
+func TestStripANSI(t *testing.T) {
+	for _, test := range []struct {
+		s, stripped, reset string
+	}{
+		{"plain", "plain", "plain"},
+		{"\x1b[1;31mred\x1b[0m", "red", "\x1b[1;31mred\x1b[0m" + ansiReset},
+		{"\x1b]0;title\x07text", "text", "\x1b]0;title\x07text" + ansiReset},
+		{"\x1bMup", "up", "\x1bMup" + ansiReset},
+	} {
+		if got := stripANSI(test.s); got != test.stripped {
+			t.Errorf("stripANSI(%q): got %q, want %q", test.s, got, test.stripped)
+		}
+		if got := resetANSI(test.s); got != test.reset {
+			t.Errorf("resetANSI(%q): got %q, want %q", test.s, got, test.reset)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var (
+	activeTailersGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ktail",
+		Name:      "active_tailers",
+		Help:      "Number of containers currently being tailed.",
+	})
+	tailersStartedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ktail",
+		Name:      "tailers_started_total",
+		Help:      "Number of containers that tailing has started for.",
+	})
+	tailersStoppedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ktail",
+		Name:      "tailers_stopped_total",
+		Help:      "Number of containers that tailing has stopped for.",
+	})
+	tailErrorsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ktail",
+		Name:      "errors_total",
+		Help:      "Number of errors encountered while tailing containers.",
+	})
+	reconnectsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ktail",
+		Name:      "reconnects_total",
+		Help:      "Number of times a container's log stream was reopened after an error.",
+	})
+	linesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ktail",
+		Name:      "lines_total",
+		Help:      "Number of log lines received, not counting markers generated by ktail.",
+	})
+	droppedLinesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ktail",
+		Name:      "lines_dropped_total",
+		Help:      "Number of log lines dropped because a container's buffer was full.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		activeTailersGauge,
+		tailersStartedCounter,
+		tailersStoppedCounter,
+		tailErrorsCounter,
+		reconnectsCounter,
+		linesCounter,
+		droppedLinesCounter)
+}
+
+// instrumentCallbacks wraps the callbacks so that they update the metrics.
+func instrumentCallbacks(callbacks Callbacks) Callbacks {
+	onEvent, onEnter, onExit, onError, onDrop := callbacks.OnEvent, callbacks.OnEnter,
+		callbacks.OnExit, callbacks.OnError, callbacks.OnDrop
+	onReconnect := callbacks.OnReconnect
+	callbacks.OnEvent = func(event LogEvent) {
+		if !event.Synthetic {
+			linesCounter.Inc()
+		}
+		onEvent(event)
+	}
+	callbacks.OnEnter = func(pod *v1.Pod, container *v1.Container, initialAddPhase bool) bool {
+		if !onEnter(pod, container, initialAddPhase) {
+			return false
+		}
+		tailersStartedCounter.Inc()
+		activeTailersGauge.Inc()
+		return true
+	}
+	callbacks.OnExit = func(pod *v1.Pod, container *v1.Container) {
+		tailersStoppedCounter.Inc()
+		activeTailersGauge.Dec()
+		onExit(pod, container)
+	}
+	callbacks.OnError = func(pod *v1.Pod, container *v1.Container, err error) {
+		tailErrorsCounter.Inc()
+		onError(pod, container, err)
+	}
+	callbacks.OnReconnect = func(pod *v1.Pod, container *v1.Container) {
+		reconnectsCounter.Inc()
+		if onReconnect != nil {
+			onReconnect(pod, container)
+		}
+	}
+	callbacks.OnDrop = func(pod *v1.Pod, container *v1.Container) {
+		droppedLinesCounter.Inc()
+		if onDrop != nil {
+			onDrop(pod, container)
+		}
+	}
+	return callbacks
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// scrapeMetrics returns the values of the ktail metrics in the default
+// registry, by name.
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			switch {
+			case metric.GetCounter() != nil:
+				values[family.GetName()] = metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				values[family.GetName()] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func TestInstrumentCallbacks(t *testing.T) {
+	ctl := NewControllerWithOptions(nil)
+	callbacks := instrumentCallbacks(ctl.callbacks)
+	pod := testPod(0)
+	app, sidecar := &pod.Spec.Containers[0], &v1.Container{Name: "sidecar"}
+
+	before := scrapeMetrics(t)
+	callbacks.OnEnter(&pod, app, true)
+	callbacks.OnEnter(&pod, sidecar, false)
+	callbacks.OnEvent(testEvent(&pod, "app", time.Now(), "line"))
+	marker := testEvent(&pod, "app", time.Now(), "=== container restarted ===")
+	marker.Synthetic = true
+	callbacks.OnEvent(marker)
+	callbacks.OnError(&pod, app, fmt.Errorf("failed"))
+	callbacks.OnReconnect(&pod, app)
+	callbacks.OnDrop(&pod, app)
+	callbacks.OnExit(&pod, sidecar)
+	after := scrapeMetrics(t)
+
+	for name, want := range map[string]float64{
+		"ktail_active_tailers":        1,
+		"ktail_tailers_started_total": 2,
+		"ktail_tailers_stopped_total": 1,
+		"ktail_errors_total":          1,
+		"ktail_reconnects_total":      1,
+		"ktail_lines_total":           1,
+		"ktail_lines_dropped_total":   1,
+	} {
+		if got := after[name] - before[name]; got != want {
+			t.Errorf("%s: got an increase of %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// MultilineJoiner joins continuation lines, such as those of a stack
+// trace, onto the preceding line of the same container, so that each
+// record becomes a single event.
+type MultilineJoiner struct {
+	start   *regexp.Regexp
+	timeout time.Duration
+	emit    LogEventFunc
+	pending map[string]*pendingRecord
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+	sync.Mutex
+}
+
+type pendingRecord struct {
+	event    LogEvent
+	received time.Time
+}
+
+// NewMultilineJoiner returns a joiner where lines matching start begin a
+// new record. A record is passed to emit when the next record begins, or
+// when no continuation has arrived for the timeout.
+func NewMultilineJoiner(start *regexp.Regexp, timeout time.Duration, emit LogEventFunc) *MultilineJoiner {
+	j := &MultilineJoiner{
+		start:   start,
+		timeout: timeout,
+		emit:    emit,
+		pending: map[string]*pendingRecord{},
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	go j.run()
+	return j
+}
+
+// Add processes a line.
+func (j *MultilineJoiner) Add(event LogEvent) {
+	key := buildKey(event.Pod, event.Container)
+
+	j.Lock()
+	defer j.Unlock()
+
+	record, ok := j.pending[key]
+	if ok && !j.start.MatchString(event.Message) {
+		record.event.Message += "\n" + event.Message
+		record.received = time.Now()
+		return
+	}
+	if ok {
+		j.emit(record.event)
+	}
+	j.pending[key] = &pendingRecord{event: event, received: time.Now()}
+}
+
+// FlushContainer emits the pending record of a container, for example when
+// it is no longer being tailed.
+func (j *MultilineJoiner) FlushContainer(pod *v1.Pod, container *v1.Container) {
+	key := buildKey(pod, container)
+
+	j.Lock()
+	defer j.Unlock()
+
+	if record, ok := j.pending[key]; ok {
+		delete(j.pending, key)
+		j.emit(record.event)
+	}
+}
+
+// Close emits all pending records.
+func (j *MultilineJoiner) Close() {
+	close(j.stopCh)
+	<-j.doneCh
+	j.flush(time.Time{})
+}
+
+func (j *MultilineJoiner) run() {
+	defer close(j.doneCh)
+
+	ticker := time.NewTicker(j.timeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.stopCh:
+			return
+		case now := <-ticker.C:
+			j.flush(now.Add(-j.timeout))
+		}
+	}
+}
+
+// flush emits records last extended before the cutoff. A zero cutoff
+// emits all records.
+func (j *MultilineJoiner) flush(cutoff time.Time) {
+	j.Lock()
+	defer j.Unlock()
+
+	for key, record := range j.pending {
+		if cutoff.IsZero() || record.received.Before(cutoff) {
+			delete(j.pending, key)
+			j.emit(record.event)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestMultilineJoiner(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	now := time.Now()
+	type line struct{ container, message string }
+	for _, test := range []struct {
+		name  string
+		lines []line
+		want  []string
+	}{
+		{"stack trace", []line{
+			{"a", "ERROR boom"}, {"a", "  at main()"}, {"a", "  at run()"}, {"a", "INFO next"},
+		}, []string{"ERROR boom\n  at main()\n  at run()", "INFO next"}},
+		{"continuations kept per container", []line{
+			{"a", "ERROR a"}, {"b", "ERROR b"}, {"a", "  at a()"}, {"b", "  at b()"},
+		}, []string{"ERROR a\n  at a()", "ERROR b\n  at b()"}},
+		{"leading continuation", []line{
+			{"a", "  orphan"}, {"a", "INFO next"},
+		}, []string{"  orphan", "INFO next"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var messages []string
+			j := NewMultilineJoiner(regexp.MustCompile(`^[A-Z]+ `), time.Hour, collectMessages(&messages))
+			for _, l := range test.lines {
+				j.Add(testEvent(pod, l.container, now, l.message))
+			}
+			// Flush in a fixed order; Close flushes in map order
+			for _, container := range []string{"a", "b"} {
+				j.FlushContainer(pod, &v1.Container{Name: container})
+			}
+			j.Close()
+			if strings.Join(messages, "|") != strings.Join(test.want, "|") {
+				t.Errorf("got %q, want %q", messages, test.want)
+			}
+		})
+	}
+}
+
+func TestMultilineJoiner_Timeout(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	var messages []string
+	collect := collectMessages(&messages)
+	emitted := make(chan struct{}, 1)
+	j := NewMultilineJoiner(regexp.MustCompile(`^[A-Z]+ `), 10*time.Millisecond, func(event LogEvent) {
+		collect(event)
+		emitted <- struct{}{}
+	})
+	defer j.Close()
+	j.Add(testEvent(pod, "a", time.Now(), "ERROR boom"))
+	j.Add(testEvent(pod, "a", time.Now(), "  at main()"))
+	select {
+	case <-emitted:
+	case <-time.After(time.Second):
+		t.Fatal("record was not emitted after the timeout")
+	}
+	if len(messages) != 1 || messages[0] != "ERROR boom\n  at main()" {
+		t.Errorf("got %q, want the joined record", messages)
+	}
+}
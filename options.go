@@ -0,0 +1,242 @@
+package main
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Option configures a Controller. See NewControllerWithOptions.
+type Option func(ctl *Controller)
+
+// WithNamespace restricts the controller to a single namespace. The empty
+// string means all namespaces.
+func WithNamespace(namespace string) Option {
+	return func(ctl *Controller) {
+		ctl.namespace = namespace
+	}
+}
+
+// WithCluster sets the cluster name given to the log events and tailers of
+// the controller, to tell them apart when several controllers share a sink.
+func WithCluster(name string) Option {
+	return func(ctl *Controller) {
+		ctl.cluster = name
+	}
+}
+
+// WithLabelSelector only tails pods matching the selector.
+func WithLabelSelector(selector labels.Selector) Option {
+	return func(ctl *Controller) {
+		if selector != nil {
+			ctl.labelSelectors = []labels.Selector{selector}
+		}
+	}
+}
+
+// WithLabelSelectors only tails pods matching any of the selectors.
+func WithLabelSelectors(selectors ...labels.Selector) Option {
+	return func(ctl *Controller) {
+		if len(selectors) > 0 {
+			ctl.labelSelectors = selectors
+		}
+	}
+}
+
+// WithCompletedPods also tails the containers of pods that have succeeded
+// or failed by the time they are first seen, reading their logs once.
+func WithCompletedPods(succeeded, failed bool) Option {
+	return func(ctl *Controller) {
+		ctl.includeSucceeded = succeeded
+		ctl.includeFailed = failed
+	}
+}
+
+// WithFieldSelector narrows the server-side pod watch by field.
+func WithFieldSelector(selector fields.Selector) Option {
+	return func(ctl *Controller) {
+		if selector != nil {
+			ctl.fieldSelector = selector
+		}
+	}
+}
+
+// WithFilter only tails containers for which the filter returns true.
+func WithFilter(filter ContainerFilterFunc) Option {
+	return func(ctl *Controller) {
+		ctl.filter = filter
+	}
+}
+
+// WithPodFilter only tails the containers of pods for which the filter
+// returns true. Unlike WithFilter, pods it rejects are not reported to
+// OnFilteredOut.
+func WithPodFilter(filter PodFilterFunc) Option {
+	return func(ctl *Controller) {
+		ctl.podFilter = filter
+	}
+}
+
+// WithInitContainers controls whether init containers are tailed.
+func WithInitContainers(include bool) Option {
+	return func(ctl *Controller) {
+		ctl.includeInitContainers = include
+	}
+}
+
+// WithResyncPeriod sets how often the informer re-delivers all pods. Zero
+// disables resyncing.
+func WithResyncPeriod(period time.Duration) Option {
+	return func(ctl *Controller) {
+		ctl.resyncPeriod = period
+	}
+}
+
+// WithTailOptions sets the options passed to each container tailer.
+func WithTailOptions(options TailOptions) Option {
+	return func(ctl *Controller) {
+		ctl.tailOptions = options
+	}
+}
+
+// WithCallbacks sets all callbacks at once. Nil callbacks are ignored.
+func WithCallbacks(callbacks Callbacks) Option {
+	return func(ctl *Controller) {
+		if callbacks.OnEvent != nil {
+			ctl.callbacks.OnEvent = callbacks.OnEvent
+		}
+		if callbacks.OnEnter != nil {
+			ctl.callbacks.OnEnter = callbacks.OnEnter
+		}
+		if callbacks.OnExit != nil {
+			ctl.callbacks.OnExit = callbacks.OnExit
+		}
+		if callbacks.OnError != nil {
+			ctl.callbacks.OnError = callbacks.OnError
+		}
+		if callbacks.OnStopped != nil {
+			ctl.callbacks.OnStopped = callbacks.OnStopped
+		}
+		if callbacks.OnReconnect != nil {
+			ctl.callbacks.OnReconnect = callbacks.OnReconnect
+		}
+		if callbacks.OnQueued != nil {
+			ctl.callbacks.OnQueued = callbacks.OnQueued
+		}
+		if callbacks.OnReady != nil {
+			ctl.callbacks.OnReady = callbacks.OnReady
+		}
+		if callbacks.OnDrop != nil {
+			ctl.callbacks.OnDrop = callbacks.OnDrop
+		}
+		if callbacks.OnWatchError != nil {
+			ctl.callbacks.OnWatchError = callbacks.OnWatchError
+		}
+		if callbacks.OnWatchRecover != nil {
+			ctl.callbacks.OnWatchRecover = callbacks.OnWatchRecover
+		}
+		if callbacks.OnFilteredOut != nil {
+			ctl.callbacks.OnFilteredOut = callbacks.OnFilteredOut
+		}
+		if callbacks.OnPodEvent != nil {
+			ctl.callbacks.OnPodEvent = callbacks.OnPodEvent
+		}
+	}
+}
+
+// WithEventFunc sets the callback receiving each log line.
+func WithEventFunc(f LogEventFunc) Option {
+	return func(ctl *Controller) {
+		ctl.callbacks.OnEvent = f
+	}
+}
+
+// WithSink writes each log line to the sink. Write errors are ignored; the
+// caller remains responsible for closing the sink after Run returns.
+func WithSink(sink Sink) Option {
+	return WithEventFunc(func(event LogEvent) {
+		_ = sink.Write(event)
+	})
+}
+
+// WithEnterFunc sets the callback invoked before a container is tailed.
+func WithEnterFunc(f ContainerEnterFunc) Option {
+	return func(ctl *Controller) {
+		ctl.callbacks.OnEnter = f
+	}
+}
+
+// WithExitFunc sets the callback invoked when a container is no longer
+// tailed.
+func WithExitFunc(f ContainerExitFunc) Option {
+	return func(ctl *Controller) {
+		ctl.callbacks.OnExit = f
+	}
+}
+
+// WithErrorFunc sets the callback invoked when tailing a container fails.
+func WithErrorFunc(f ContainerErrorFunc) Option {
+	return func(ctl *Controller) {
+		ctl.callbacks.OnError = f
+	}
+}
+
+// WithReconnectFunc sets the callback invoked when a container's log stream
+// is reestablished after an error.
+func WithReconnectFunc(f ContainerReconnectFunc) Option {
+	return func(ctl *Controller) {
+		ctl.callbacks.OnReconnect = f
+	}
+}
+
+// WithErrorChannel makes tailing errors available from Errors, in addition
+// to the error callback. The channel holds up to size errors; further
+// errors are dropped and counted rather than blocking the tailer.
+func WithErrorChannel(size int) Option {
+	return func(ctl *Controller) {
+		ctl.errors = make(chan ContainerError, size)
+	}
+}
+
+// WithMaxTailers limits how many containers are tailed at once. Further
+// containers are queued, and tailed as others stop. Zero means no limit.
+func WithMaxTailers(n int) Option {
+	return func(ctl *Controller) {
+		ctl.maxTailers = n
+	}
+}
+
+// WithWaitingMarkers controls whether a marker line is emitted through the
+// event callback when a container is waiting to start, with the reason.
+func WithWaitingMarkers(enabled bool) Option {
+	return func(ctl *Controller) {
+		ctl.waitingMarkers = enabled
+	}
+}
+
+// WithIdleTimeout stops tailers that have received no lines for the
+// duration, if their container is no longer running. Zero disables this.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(ctl *Controller) {
+		ctl.idleTimeout = timeout
+	}
+}
+
+// WithStartPositions resumes tailing containers after the timestamp
+// returned by the function, for example one saved by a previous run. A nil
+// timestamp starts the container as usual.
+func WithStartPositions(f func(pod *v1.Pod, container *v1.Container) *time.Time) Option {
+	return func(ctl *Controller) {
+		ctl.startPosition = f
+	}
+}
+
+// WithRestartMarkers controls whether a marker line is emitted through the
+// event callback when a tailed container restarts.
+func WithRestartMarkers(enabled bool) Option {
+	return func(ctl *Controller) {
+		ctl.restartMarkers = enabled
+	}
+}
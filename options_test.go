@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// optionsTestPods returns pods in two namespaces, one of which has
+// succeeded.
+func optionsTestPods() []v1.Pod {
+	pod := func(namespace, name, app string, containers ...string) v1.Pod {
+		p := podWithContainers(containers...)
+		p.Namespace, p.Name, p.UID = namespace, name, types.UID("uid-"+name)
+		p.Labels = map[string]string{"app": app}
+		return p
+	}
+	job := pod("default", "job-1", "job", "main")
+	job.Status.Phase = v1.PodSucceeded
+	job.Status.ContainerStatuses[0].State = v1.ContainerState{Terminated: &v1.ContainerStateTerminated{}}
+	return []v1.Pod{
+		pod("default", "web-1", "web", "app", "sidecar"),
+		pod("default", "db-1", "db", "db"),
+		pod("other", "web-2", "web", "app"),
+		job,
+	}
+}
+
+// matchingContainers returns the containers the controller would tail, as
+// sorted namespace/pod/container names.
+func matchingContainers(t *testing.T, ctl *Controller) string {
+	refs, err := ctl.MatchingContainers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ref := range refs {
+		names = append(names, ref.Pod.Namespace+"/"+ref.Pod.Name+"/"+ref.Container.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestNewControllerWithOptions(t *testing.T) {
+	web := labels.SelectorFromSet(labels.Set{"app": "web"})
+	db := labels.SelectorFromSet(labels.Set{"app": "db"})
+	for _, test := range []struct {
+		name    string
+		options []Option
+		want    string
+	}{
+		{"defaults", nil,
+			"default/db-1/db,default/web-1/app,default/web-1/sidecar,other/web-2/app"},
+		{"namespace", []Option{WithNamespace("default")},
+			"default/db-1/db,default/web-1/app,default/web-1/sidecar"},
+		{"namespace and selector", []Option{WithNamespace("default"), WithLabelSelector(web)},
+			"default/web-1/app,default/web-1/sidecar"},
+		{"selectors and filter", []Option{
+			WithLabelSelectors(web, db),
+			WithFilter(func(pod *v1.Pod, container *v1.Container) bool { return container.Name != "sidecar" }),
+		}, "default/db-1/db,default/web-1/app,other/web-2/app"},
+		{"pod filter", []Option{
+			WithPodFilter(func(pod *v1.Pod) bool { return pod.Namespace == "other" }),
+		}, "other/web-2/app"},
+		{"completed pods", []Option{
+			WithCompletedPods(true, false),
+			WithLabelSelector(labels.SelectorFromSet(labels.Set{"app": "job"})),
+		}, "default/job-1/main"},
+		{"nil selectors keep the defaults", []Option{WithLabelSelector(nil), WithFieldSelector(nil)},
+			"default/db-1/db,default/web-1/app,default/web-1/sidecar,other/web-2/app"},
+		{"later options win", []Option{WithNamespace("other"), WithNamespace("default"), WithLabelSelector(db)},
+			"default/db-1/db"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clientset, _ := newFakeClientset(optionsTestPods()...)
+			ctl := NewControllerWithOptions(clientset, test.options...)
+			if got := matchingContainers(t, ctl); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewController(t *testing.T) {
+	clientset, _ := newFakeClientset(optionsTestPods()...)
+	ctl := NewController(clientset, "default", labels.SelectorFromSet(labels.Set{"app": "web"}),
+		nil, nil, true, 0, TailOptions{}, Callbacks{})
+	if got, want := matchingContainers(t, ctl), "default/web-1/app,default/web-1/sidecar"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestNewControllerWithOptions_Callbacks(t *testing.T) {
+	var calls []string
+	record := func(name string) func(pod *v1.Pod, container *v1.Container) {
+		return func(pod *v1.Pod, container *v1.Container) {
+			calls = append(calls, name)
+		}
+	}
+	ctl := NewControllerWithOptions(nil,
+		WithCallbacks(Callbacks{
+			OnEvent: func(event LogEvent) { calls = append(calls, "callbacks event") },
+			OnExit:  record("callbacks exit"),
+		}),
+		WithEventFunc(func(event LogEvent) { calls = append(calls, "event "+event.Cluster) }),
+		WithCallbacks(Callbacks{OnReconnect: record("reconnect")}),
+		WithCluster("east"))
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-1"}}
+	container := &v1.Container{Name: "app"}
+	ctl.callbacks.OnEvent(LogEvent{Pod: pod, Container: container})
+	ctl.callbacks.OnExit(pod, container)
+	ctl.callbacks.OnReconnect(pod, container)
+	// Callbacks that weren't given default to doing nothing
+	ctl.callbacks.OnError(pod, container, nil)
+	ctl.callbacks.OnStopped(pod, container)
+	if !ctl.callbacks.OnEnter(pod, container, true) {
+		t.Error("got container not entered by default")
+	}
+
+	if got, want := strings.Join(calls, ","), "event east,callbacks exit,reconnect"; got != want {
+		t.Errorf("got calls %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fatih/color"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var prefixColors = []*color.Color{
+	color.New(color.FgGreen),
+	color.New(color.FgBlue),
+	color.New(color.FgMagenta),
+	color.New(color.FgCyan),
+	color.New(color.FgHiGreen),
+	color.New(color.FgHiBlue),
+	color.New(color.FgHiMagenta),
+	color.New(color.FgHiCyan),
+}
+
+// Color modes, giving the number of colors the terminal supports.
+const (
+	colorMode16        = "16"
+	colorMode256       = "256"
+	colorModeTrueColor = "truecolor"
+)
+
+// FormatOptions configures how output templates render events. It is set
+// up once at startup, and captured by the template functions.
+type FormatOptions struct {
+	// Colors is false when the formatted logs should not be colored, such
+	// as when they are written to files. Unlike color.NoColor, it leaves
+	// ktail's own messages on stderr colored.
+	Colors bool
+
+	// ColorMode is the palette of the colors derived from containers' keys.
+	ColorMode string
+
+	// ColorScheme, if set, assigns colors to containers ahead of those
+	// derived from their keys.
+	ColorScheme *ColorScheme
+
+	// Location and TimeLayout control how formatTime renders timestamps. A
+	// nil location renders them in UTC, and an empty layout like
+	// time.Time's String method.
+	Location   *time.Location
+	TimeLayout string
+}
+
+// prefixColors256 are the colors of the 256-color cube that are neither
+// gray nor too dark to read.
+var prefixColors256 = func() []int {
+	var colors []int
+	for r := 0; r < 6; r++ {
+		for g := 0; g < 6; g++ {
+			for b := 0; b < 6; b++ {
+				if (r == g && g == b) || r+g+b < 5 {
+					continue
+				}
+				colors = append(colors, 16+36*r+6*g+b)
+			}
+		}
+	}
+	return colors
+}()
+
+// detectColorMode guesses the terminal's color support from the
+// environment.
+func detectColorMode(getenv func(string) string) string {
+	switch getenv("COLORTERM") {
+	case "truecolor", "24bit":
+		return colorModeTrueColor
+	}
+	if strings.Contains(getenv("TERM"), "256color") {
+		return colorMode256
+	}
+	return colorMode16
+}
+
+// colorForKey returns a color from the mode's palette, derived from a hash
+// of the key, so that the same container is always rendered in the same
+// color.
+func colorForKey(mode, key string) *color.Color {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum32()
+	switch mode {
+	case colorMode256:
+		return color.New(38, 5, color.Attribute(prefixColors256[sum%uint32(len(prefixColors256))]))
+	case colorModeTrueColor:
+		r, g, b := hueToRGB(float64(sum % 360))
+		return color.New(38, 2, color.Attribute(r), color.Attribute(g), color.Attribute(b))
+	}
+	return prefixColors[sum%uint32(len(prefixColors))]
+}
+
+// hueToRGB returns a bright, moderately saturated color of the hue, given
+// in degrees.
+func hueToRGB(hue float64) (r, g, b int) {
+	const saturation, value = 0.6, 0.95
+	c := value * saturation
+	x := c * (1 - math.Abs(math.Mod(hue/60, 2)-1))
+	m := value - c
+	var rf, gf, bf float64
+	switch {
+	case hue < 60:
+		rf, gf, bf = c, x, 0
+	case hue < 120:
+		rf, gf, bf = x, c, 0
+	case hue < 180:
+		rf, gf, bf = 0, c, x
+	case hue < 240:
+		rf, gf, bf = 0, x, c
+	case hue < 300:
+		rf, gf, bf = x, 0, c
+	default:
+		rf, gf, bf = c, 0, x
+	}
+	return int((rf + m) * 255), int((gf + m) * 255), int((bf + m) * 255)
+}
+
+// templateFuncs returns the extra functions available to output templates.
+func (o FormatOptions) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"colored": func(pod *v1.Pod, container *v1.Container, s string) string {
+			if !o.Colors {
+				return s
+			}
+			return o.colorForContainer(pod, container).Sprint(s)
+		},
+		"fit":         fitWidth,
+		"labelValues": labelValues,
+		"singleContainer": func(pod *v1.Pod) bool {
+			return len(pod.Spec.Containers)+len(pod.Spec.InitContainers) == 1
+		},
+		"imageTag":   imageTag,
+		"formatTime": o.formatTime,
+		"age":        func(t *time.Time) string { return formatAge(t, time.Now()) },
+	}
+}
+
+// formatAge renders how long before now the timestamp was, such as
+// "[-2.3s]".
+func formatAge(t *time.Time, now time.Time) string {
+	if t == nil {
+		return ""
+	}
+	d := now.Sub(*t)
+	if d < 0 {
+		d = 0
+	}
+	if d < time.Minute {
+		return fmt.Sprintf("[-%.1fs]", d.Seconds())
+	}
+	return fmt.Sprintf("[-%s]", d-d%time.Second)
+}
+
+// formatTime renders the timestamp in the configured location and layout.
+func (o FormatOptions) formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	location := o.Location
+	if location == nil {
+		location = time.UTC
+	}
+	if o.TimeLayout == "" {
+		return t.In(location).String()
+	}
+	return t.In(location).Format(o.TimeLayout)
+}
+
+// parseTimeFormat loads the time zone of the --timezone flag, and checks
+// the layout of the --time-format flag, which may be empty.
+func parseTimeFormat(timezone, layout string) (*time.Location, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid --timezone: %s", err)
+	}
+	if layout != "" {
+		probe := time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+		if probe.Format(layout) == layout {
+			return nil, fmt.Errorf("Invalid --time-format: %q has no time elements", layout)
+		}
+	}
+	return location, nil
+}
+
+// imageTag returns a short name for the version of an image: its tag, the
+// start of its digest, or "latest" if it has neither.
+func imageTag(image string) string {
+	if i := strings.LastIndex(image, "@"); i >= 0 {
+		digest := image[i+1:]
+		if j := strings.Index(digest, ":"); j >= 0 {
+			digest = digest[j+1:]
+		}
+		if len(digest) > 12 {
+			digest = digest[:12]
+		}
+		return digest
+	}
+	// A colon after the last slash separates the tag, rather than a port
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[i+1:]
+	}
+	return "latest"
+}
+
+// labelValues returns the values of the labels, such as "[v1,eu]". Missing
+// labels are left empty.
+func labelValues(labels map[string]string, names ...string) string {
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = labels[name]
+	}
+	return "[" + strings.Join(values, ",") + "]"
+}
+
+// fitWidth pads s with spaces, or shortens it with an ellipsis, to exactly
+// width characters. A width of zero or less returns s unchanged.
+func fitWidth(width int, s string) string {
+	if width <= 0 {
+		return s
+	}
+	runes := []rune(s)
+	if len(runes) > width {
+		return string(runes[:width-1]) + "…"
+	}
+	return s + strings.Repeat(" ", width-len(runes))
+}
+
+// jsonEvent is the representation of a LogEvent used by the JSON output
+// format. Each event is written as a single line.
+type jsonEvent struct {
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Cluster   string     `json:"cluster,omitempty"`
+	Namespace string     `json:"namespace"`
+	Pod       string     `json:"pod"`
+	Container string     `json:"container"`
+	Node      string     `json:"node,omitempty"`
+	Message   string     `json:"message"`
+}
+
+func newJSONEvent(event LogEvent) jsonEvent {
+	return jsonEvent{
+		Timestamp: event.Timestamp,
+		Cluster:   event.Cluster,
+		Namespace: event.Pod.Namespace,
+		Pod:       event.Pod.Name,
+		Container: event.Container.Name,
+		Node:      event.Node,
+		Message:   event.Message,
+	}
+}
+
+func writeJSONEvent(w io.Writer, event LogEvent) error {
+	return json.NewEncoder(w).Encode(newJSONEvent(event))
+}
+
+// newCSVFormatter returns a formatter writing each event as a CSV record
+// of the columns. The header is written before the first record.
+func newCSVFormatter(columns []column) EventFormatter {
+	var headerOnce sync.Once
+	return func(w io.Writer, event LogEvent) error {
+		cw := csv.NewWriter(w)
+		headerOnce.Do(func() {
+			header := make([]string, len(columns))
+			for i, c := range columns {
+				header[i] = c.name
+			}
+			_ = cw.Write(header)
+		})
+		record := make([]string, len(columns))
+		for i, c := range columns {
+			record[i] = c.value(event)
+		}
+		_ = cw.Write(record)
+		cw.Flush()
+		return cw.Error()
+	}
+}
+
+// newJSONFormatter returns a formatter writing each event as a JSON object
+// with the columns as keys, in order.
+func newJSONFormatter(columns []column) EventFormatter {
+	return func(w io.Writer, event LogEvent) error {
+		var buf bytes.Buffer
+		buf.WriteByte('{')
+		for i, c := range columns {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(c.name)
+			value, _ := json.Marshal(c.value(event))
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(value)
+		}
+		buf.WriteString("}\n")
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+}
+
+// newLogfmtFormatter returns a formatter writing each event as a logfmt
+// line of the columns, using their short names. Empty values are left out,
+// and the message is always quoted and written last, so that it can be
+// read up to the end of the line.
+func newLogfmtFormatter(columns []column) EventFormatter {
+	var ordered []column
+	var message []column
+	for _, c := range columns {
+		if c.name == "message" {
+			message = append(message, c)
+		} else {
+			ordered = append(ordered, c)
+		}
+	}
+	columns = append(ordered, message...)
+	return func(w io.Writer, event LogEvent) error {
+		var buf bytes.Buffer
+		for _, c := range columns {
+			value := c.value(event)
+			if value == "" && c.name != "message" {
+				continue
+			}
+			if buf.Len() > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(c.shortName)
+			buf.WriteByte('=')
+			if c.name == "message" {
+				buf.WriteString(strconv.Quote(value))
+			} else {
+				buf.WriteString(logfmtValue(value))
+			}
+		}
+		buf.WriteByte('\n')
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+}
+
+// logfmtValue quotes s if it would otherwise not parse as a single value.
+func logfmtValue(s string) string {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError || !unicode.IsPrint(r)
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestDetectColorMode(t *testing.T) {
+	for _, test := range []struct {
+		colorterm, term string
+		want            string
+	}{
+		{"truecolor", "xterm-256color", colorModeTrueColor},
+		{"24bit", "xterm", colorModeTrueColor},
+		{"", "xterm-256color", colorMode256},
+		{"", "screen-256color", colorMode256},
+		{"", "xterm", colorMode16},
+		{"", "", colorMode16},
+	} {
+		env := map[string]string{"COLORTERM": test.colorterm, "TERM": test.term}
+		if got := detectColorMode(func(key string) string { return env[key] }); got != test.want {
+			t.Errorf("COLORTERM=%q TERM=%q: got %q, want %q", test.colorterm, test.term, got, test.want)
+		}
+	}
+}
+
+func TestColorForKey(t *testing.T) {
+	key := "default/web-1/uid-1/app"
+	if c := colorForKey(colorMode16, key); !colorIn(c, prefixColors) {
+		t.Errorf("16 colors: got a color outside the basic palette")
+	} else if !c.Equals(colorForKey(colorMode16, key)) {
+		t.Errorf("16 colors: got a different color for the same key")
+	}
+	for _, test := range []struct {
+		mode string
+		want *regexp.Regexp
+	}{
+		{colorMode256, regexp.MustCompile(`^\x1b\[38;5;(\d+)m`)},
+		{colorModeTrueColor, regexp.MustCompile(`^\x1b\[38;2;\d+;\d+;\d+m`)},
+	} {
+		c := colorForKey(test.mode, key)
+		c.EnableColor()
+		s := c.Sprint("x")
+		match := test.want.FindStringSubmatch(s)
+		if match == nil {
+			t.Errorf("%s: got %q, want a match for %s", test.mode, s, test.want)
+			continue
+		}
+		if test.mode == colorMode256 {
+			var found bool
+			for _, n := range prefixColors256 {
+				found = found || fmt.Sprint(n) == match[1]
+			}
+			if !found {
+				t.Errorf("256 colors: got color %s, which is gray or too dark", match[1])
+			}
+		}
+		again := colorForKey(test.mode, key)
+		again.EnableColor()
+		if again.Sprint("x") != s {
+			t.Errorf("%s: got a different color for the same key", test.mode)
+		}
+	}
+}
+
+func TestFormatOptions_Colored(t *testing.T) {
+	pod := testPod(0)
+	colored := func(o FormatOptions) string {
+		f := o.templateFuncs()["colored"].(func(*v1.Pod, *v1.Container, string) string)
+		return f(&pod, &pod.Spec.Containers[0], "web-1")
+	}
+	if got := colored(FormatOptions{Colors: false, ColorMode: colorModeTrueColor}); got != "web-1" {
+		t.Errorf("got %q without colors, want it unchanged", got)
+	}
+
+	// --no-color, or stdout not being a terminal, disables colors globally
+	defer func(noColor bool) { color.NoColor = noColor }(color.NoColor)
+	color.NoColor = true
+	if got := colored(FormatOptions{Colors: true, ColorMode: colorModeTrueColor}); got != "web-1" {
+		t.Errorf("got %q with colors disabled, want it unchanged", got)
+	}
+	color.NoColor = false
+	got := colored(FormatOptions{Colors: true, ColorMode: colorModeTrueColor})
+	if !strings.HasPrefix(got, "\x1b[38;2;") || !strings.Contains(got, "web-1") {
+		t.Errorf("got %q with colors, want it colored", got)
+	}
+	if again := colored(FormatOptions{Colors: true, ColorMode: colorModeTrueColor}); again != got {
+		t.Errorf("got %q, then %q for the same container", got, again)
+	}
+}
+
+func colorIn(c *color.Color, palette []*color.Color) bool {
+	for _, p := range palette {
+		if c.Equals(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHueToRGB(t *testing.T) {
+	for _, test := range []struct {
+		hue     float64
+		r, g, b int
+	}{
+		{0, 242, 96, 96},
+		{120, 96, 242, 96},
+		{240, 96, 96, 242},
+	} {
+		if r, g, b := hueToRGB(test.hue); r != test.r || g != test.g || b != test.b {
+			t.Errorf("hue %v: got %d,%d,%d, want %d,%d,%d", test.hue, r, g, b, test.r, test.g, test.b)
+		}
+	}
+}
+
+func TestFormatAge(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(-d)
+		return &t
+	}
+	for _, test := range []struct {
+		t    *time.Time
+		want string
+	}{
+		{nil, ""},
+		{at(0), "[-0.0s]"},
+		{at(2300 * time.Millisecond), "[-2.3s]"},
+		{at(90*time.Second + 500*time.Millisecond), "[-1m30s]"},
+		{at(-time.Second), "[-0.0s]"},
+	} {
+		if got := formatAge(test.t, now); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.t, got, test.want)
+		}
+	}
+}
+
+func TestImageTag(t *testing.T) {
+	for _, test := range []struct {
+		image, want string
+	}{
+		{"nginx:1.13", "1.13"},
+		{"nginx", "latest"},
+		{"registry:5000/team/app", "latest"},
+		{"registry:5000/team/app:v2", "v2"},
+		{"app@sha256:0123456789abcdef0123", "0123456789ab"},
+		{"app:v2@sha256:abc", "abc"},
+	} {
+		if got := imageTag(test.image); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.image, got, test.want)
+		}
+	}
+}
+
+func TestFitWidth(t *testing.T) {
+	for _, test := range []struct {
+		width   int
+		s, want string
+	}{
+		{0, "web-1", "web-1"},
+		{8, "web-1", "web-1   "},
+		{5, "web-1", "web-1"},
+		{4, "web-1", "web…"},
+		{3, "édité", "éd…"},
+	} {
+		if got := fitWidth(test.width, test.s); got != test.want {
+			t.Errorf("fitWidth(%d, %q): got %q, want %q", test.width, test.s, got, test.want)
+		}
+	}
+}
+
+func TestFormatOptions_FormatTime(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %s", err)
+	}
+	ts := time.Date(2017, 6, 1, 12, 0, 0, 500000000, time.UTC)
+	for _, test := range []struct {
+		name    string
+		options FormatOptions
+		want    string
+	}{
+		{"default", FormatOptions{}, "2017-06-01 12:00:00.5 +0000 UTC"},
+		{"time zone", FormatOptions{Location: newYork}, "2017-06-01 08:00:00.5 -0400 EDT"},
+		{"layout", FormatOptions{Location: newYork, TimeLayout: "15:04:05.000"}, "08:00:00.500"},
+	} {
+		if got := test.options.formatTime(&ts); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+	if got := (FormatOptions{}).formatTime(nil); got != "" {
+		t.Errorf("got %q for no timestamp, want none", got)
+	}
+}
+
+func TestParseTimeFormat(t *testing.T) {
+	for _, test := range []struct {
+		timezone, layout string
+		wantErr          string
+	}{
+		{"UTC", "", ""},
+		{"Local", "15:04:05", ""},
+		{"Mars/Olympus_Mons", "", "Invalid --timezone"},
+		{"UTC", "hh:mm", `Invalid --time-format: "hh:mm" has no time elements`},
+	} {
+		_, err := parseTimeFormat(test.timezone, test.layout)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%q, %q: got error %s", test.timezone, test.layout, err)
+		} else if test.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), test.wantErr)) {
+			t.Errorf("%q, %q: got error %v, want %q", test.timezone, test.layout, err, test.wantErr)
+		}
+	}
+}
+
+func TestWriteJSONEvent(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	at := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	for _, message := range []string{`said "hi"`, "two\nlines", `back\slash`} {
+		event := testEvent(pod, "app", at, message)
+		event.Node = "node-1"
+		if err := writeJSONEvent(&buf, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	event := testEvent(pod, "app", at, "no node")
+	event.Timestamp = nil
+	if err := writeJSONEvent(&buf, event); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"timestamp":"2017-06-01T12:00:00Z","namespace":"default","pod":"web-1","container":"app","node":"node-1","message":"said \"hi\""}
+{"timestamp":"2017-06-01T12:00:00Z","namespace":"default","pod":"web-1","container":"app","node":"node-1","message":"two\nlines"}
+{"timestamp":"2017-06-01T12:00:00Z","namespace":"default","pod":"web-1","container":"app","node":"node-1","message":"back\\slash"}
+{"namespace":"default","pod":"web-1","container":"app","message":"no node"}
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestLogfmtFormatter(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	ts := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	prefix := "ts=2017-06-01T12:00:00Z ns=default pod=web-1 container=app "
+	columns, err := parseColumns(defaultColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := newLogfmtFormatter(columns)
+	for _, test := range []struct {
+		message string
+		want    string
+	}{
+		{"plain", `msg="plain"`},
+		{"", `msg=""`},
+		{"two words", `msg="two words"`},
+		{"key=value other=1", `msg="key=value other=1"`},
+		{`said "hi"`, `msg="said \"hi\""`},
+		{`C:\temp`, `msg="C:\\temp"`},
+		{"tab\tand\nnewline", `msg="tab\tand\nnewline"`},
+		{"\x1b[31mred", `msg="\x1b[31mred"`},
+		{"naïve ☃", `msg="naïve ☃"`},
+	} {
+		var buf bytes.Buffer
+		if err := format(&buf, testEvent(pod, "app", ts, test.message)); err != nil {
+			t.Fatal(err)
+		}
+		if want := prefix + test.want + "\n"; buf.String() != want {
+			t.Errorf("%q: got %q, want %q", test.message, buf.String(), want)
+		}
+	}
+
+	// Values other than the message are quoted only when needed, and the
+	// message stays last whatever the order of the columns
+	columns, err = parseColumns([]string{"msg", "pod", "node", "container"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := testEvent(pod, "app", ts, "a=b")
+	event.Node = "node 1"
+	var buf bytes.Buffer
+	if err := newLogfmtFormatter(columns)(&buf, event); err != nil {
+		t.Fatal(err)
+	}
+	if want := `pod=web-1 node="node 1" container=app msg="a=b"` + "\n"; buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestCSVOutput(t *testing.T) {
+	s, err := parseSettings([]string{"--output", "csv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	// Lines are only written out when flushed, at the latest on Close
+	sink := NewBufferedWriterSink(&buf, s.formatter, time.Hour)
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	ts := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, message := range []string{
+		"plain",
+		"a, b",
+		`said "hi"`,
+		"two\nlines",
+		` leading space`,
+		"",
+	} {
+		if err := sink.Write(testEvent(pod, "app", ts, message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("got %q written before closing, want it buffered", buf.String())
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "timestamp,namespace,pod,container,message\n" +
+		"2017-06-01T12:00:00Z,default,web-1,app,plain\n" +
+		`2017-06-01T12:00:00Z,default,web-1,app,"a, b"` + "\n" +
+		`2017-06-01T12:00:00Z,default,web-1,app,"said ""hi"""` + "\n" +
+		"2017-06-01T12:00:00Z,default,web-1,app,\"two\nlines\"\n" +
+		`2017-06-01T12:00:00Z,default,web-1,app," leading space"` + "\n" +
+		"2017-06-01T12:00:00Z,default,web-1,app,\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// suppressedReportInterval is how often the number of lines suppressed by
+// rate limiting is reported while a container keeps exceeding the limit.
+const suppressedReportInterval = 5 * time.Second
+
+// rateLimiter is a token bucket allowing rate events per second on average,
+// and bursts of up to a second's worth of events.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	rl := &rateLimiter{rate: rate}
+	rl.tokens = rl.burst()
+	return rl
+}
+
+// allow returns true if an event at the given time is within the limit,
+// taking a token if so.
+func (rl *rateLimiter) allow(now time.Time) bool {
+	if !rl.last.IsZero() {
+		rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+		if rl.tokens > rl.burst() {
+			rl.tokens = rl.burst()
+		}
+	}
+	rl.last = now
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	return true
+}
+
+func (rl *rateLimiter) burst() float64 {
+	if rl.rate < 1 {
+		return 1
+	}
+	return rl.rate
+}
+
+func formatSuppressed(n int64) string {
+	if n == 1 {
+		return "… 1 line suppressed"
+	}
+	return fmt.Sprintf("… %d lines suppressed", n)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name    string
+		rate    float64
+		offsets []time.Duration // From start, for each event
+		want    string          // "+" allowed, "-" suppressed
+	}{
+		{"burst of a second's worth", 2, []time.Duration{0, 0, 0}, "++-"},
+		{"refills over time", 2, []time.Duration{0, 0, 0, 500 * time.Millisecond, 500 * time.Millisecond}, "++-+-"},
+		{"burst is capped", 2, []time.Duration{0, time.Hour, time.Hour, time.Hour}, "+++-"},
+		{"rate below one", 0.5, []time.Duration{0, time.Second, 2 * time.Second}, "+-+"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rl := newRateLimiter(test.rate)
+			var got []byte
+			for _, offset := range test.offsets {
+				if rl.allow(start.Add(offset)) {
+					got = append(got, '+')
+				} else {
+					got = append(got, '-')
+				}
+			}
+			if string(got) != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestContainerTailer_RateLimit(t *testing.T) {
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	var lines []string
+	for i, message := range []string{"a", "b", "c"} {
+		lines = append(lines, logLine(start.Add(time.Duration(i)*time.Second), message))
+	}
+	var messages []string
+	pod := testPod(0)
+	tailer := NewContainerTailer(nil, pod, pod.Spec.Containers[0], collectMessages(&messages),
+		nil, TailOptions{RateLimit: 1, NoFollow: true})
+	tailer.openStream = (&fakeLogs{current: []string{strings.Join(lines, "")}}).stream
+	tailer.Run(func(err error) { t.Errorf("unexpected error: %s", err) })
+
+	want := []string{"a", formatSuppressed(2)}
+	if strings.Join(messages, ",") != strings.Join(want, ",") {
+		t.Errorf("got lines %q, want %q", messages, want)
+	}
+	if linesRead, bytesRead := tailer.Counts(); linesRead != 3 || bytesRead != 3 {
+		t.Errorf("got counts %d lines, %d bytes; want 3 lines, 3 bytes", linesRead, bytesRead)
+	}
+}
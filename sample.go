@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Sampler passes a fixed fraction of each container's lines. The lines are
+// picked evenly rather than at random, so that every container is
+// represented, however few lines it logs.
+type Sampler struct {
+	rate       float64
+	containers map[string]float64
+	seen       int64
+	kept       int64
+	sync.Mutex
+}
+
+func NewSampler(rate float64) *Sampler {
+	return &Sampler{
+		rate:       rate,
+		containers: map[string]float64{},
+	}
+}
+
+// Sample returns true if the event should be kept.
+func (s *Sampler) Sample(event LogEvent) bool {
+	key := buildKey(event.Pod, event.Container)
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.seen++
+	credit, ok := s.containers[key]
+	if !ok {
+		// Keep each container's first line
+		credit = 1
+	} else {
+		credit += s.rate
+	}
+	if credit < 1 {
+		s.containers[key] = credit
+		return false
+	}
+	s.containers[key] = credit - 1
+	s.kept++
+	return true
+}
+
+// CloseContainer forgets a container that is no longer tailed.
+func (s *Sampler) CloseContainer(pod *v1.Pod, container *v1.Container) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.containers, buildKey(pod, container))
+}
+
+// String returns a one-line summary of the lines kept.
+func (s *Sampler) String() string {
+	s.Lock()
+	defer s.Unlock()
+	percent := 0.0
+	if s.seen > 0 {
+		percent = 100 * float64(s.kept) / float64(s.seen)
+	}
+	return fmt.Sprintf("Sampled %d of %d lines (%.1f%%)", s.kept, s.seen, percent)
+}
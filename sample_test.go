@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestSampler(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	now := time.Now()
+	for _, test := range []struct {
+		name  string
+		rate  float64
+		lines []string // Containers of the lines, in order
+		want  string   // Whether each line is kept
+	}{
+		{"a quarter", 0.25, []string{"a", "a", "a", "a", "a", "a", "a", "a", "a"}, "x___x___x"},
+		{"half", 0.5, []string{"a", "a", "a", "a", "a"}, "x_x_x"},
+		{"first line of each container", 0.1, []string{"a", "b", "a", "b"}, "xx__"},
+		{"all", 1, []string{"a", "a", "a"}, "xxx"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewSampler(test.rate)
+			var got []string
+			for _, container := range test.lines {
+				if s.Sample(testEvent(pod, container, now, "line")) {
+					got = append(got, "x")
+				} else {
+					got = append(got, "_")
+				}
+			}
+			if strings.Join(got, "") != test.want {
+				t.Errorf("got %s, want %s", strings.Join(got, ""), test.want)
+			}
+		})
+	}
+}
+
+func TestSampler_CloseContainer(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	s := NewSampler(0.1)
+	_ = s.Sample(testEvent(pod, "a", time.Now(), "first"))
+	s.CloseContainer(pod, &v1.Container{Name: "a"})
+	if !s.Sample(testEvent(pod, "a", time.Now(), "first again")) {
+		t.Errorf("first line after CloseContainer was not kept")
+	}
+	if got, want := s.String(), "Sampled 2 of 2 lines (100.0%)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
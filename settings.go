@@ -0,0 +1,599 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// settings holds the command line flags, and what is derived from them.
+type settings struct {
+	contextNames       []string
+	clusterName        string
+	kubeconfigPath     string
+	labelSelectorExprs []string
+	fieldSelectorExpr  string
+	namespace          string
+	allNamespaces      bool
+	initContainers     bool
+	resyncPeriod       time.Duration
+	mergeWindow        time.Duration
+	timeout            time.Duration
+	maxLines           int64
+	httpAddr           string
+	outputDir          string
+	maxFileSize        int64
+	gzipFiles          bool
+	webhookOptions     WebhookOptions
+	webhookHeaders     []string
+	lokiURL            string
+	kafkaOptions       KafkaOptions
+	kafkaKey           string
+	quiet              bool
+	wait               bool
+	noWait             bool
+	noColor            bool
+	timestamps         bool
+	tmplString         string
+	outputFormat       string
+	tailOptions        TailOptions
+	since              time.Duration
+	sinceTime          string
+	tailLines          int64
+	containerExprs     []string
+	excludeContainers  []string
+	excludePods        []string
+	excludeNamespaces  []string
+	includeNamespaces  []string
+	includeSystem      bool
+	skipCompleted      bool
+	skipFailed         bool
+	nodeName           string
+	runningOnly        bool
+	drainTimeout       time.Duration
+	list               bool
+	sampleRate         float64
+	stripColors        bool
+	selectorFromPod    string
+	selectorPodLabels  []string
+	groupBlankLines    bool
+	exitOnTermination  bool
+	showNode           bool
+	imageInPrefix      bool
+	maxTailers         int
+	colorSchemePath    string
+	colorModeName      string
+	verbosity          int
+	containerStatus    bool
+	idleTimeout        time.Duration
+	parseJSON          bool
+	jsonMessages       JSONMessageFormatter
+	contextLines       int
+	highlightExprs     []string
+	raw                bool
+	timezone           string
+	timeLayout         string
+	relativeTime       bool
+	columnNames        []string
+	stateFilePath      string
+	shortPrefix        bool
+	labelColumns       []string
+	maxLineLength      int
+	skipBinary         bool
+	podIPs             []string
+	flushInterval      time.Duration
+	containerFilter    ContainerFilter
+	includeExprs       []string
+	excludeExprs       []string
+	lineFilter         LineFilter
+	multilineStart     string
+	multilineTimeout   time.Duration
+	prefixWidth        int
+
+	// Derived by validate
+	workloadArgs      []string
+	highlightPatterns []*regexp.Regexp
+	multilinePattern  *regexp.Regexp
+	labelSelectors    []labels.Selector
+	fieldSelector     fields.Selector
+	formatOptions     FormatOptions
+	formatter         EventFormatter
+}
+
+// parseSettings parses the command line arguments, exiting on syntax errors
+// and for --help, and checks them with validate.
+func parseSettings(args []string) (*settings, error) {
+	s := &settings{}
+	flags := pflag.NewFlagSet("ktail", pflag.ExitOnError)
+	flags.Usage = func() {
+		flags.PrintDefaults()
+	}
+	s.addFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := s.validate(flags); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *settings) addFlags(flags *pflag.FlagSet) {
+	flags.StringArrayVar(&s.contextNames, "context", nil,
+		"Kubernetes context name; if repeated, the contexts are tailed at once, with its name in the prefix")
+	flags.StringVar(&s.clusterName, "cluster", "", "Kubernetes cluster name from kubeconfig, overriding the context's")
+	flags.StringVar(&s.kubeconfigPath, "kubeconfig", "", "Path to kubeconfig (in-cluster configuration is used in a pod when not given)")
+	flags.StringVarP(&s.namespace, "namespace", "n", "", "Kubernetes namespace")
+	flags.StringArrayVarP(&s.labelSelectorExprs, "selector", "l", nil,
+		"Match pods by label (see 'kubectl get -h' for syntax); if repeated, pods matching any are tailed")
+	flags.StringVar(&s.selectorFromPod, "selector-from-pod", "",
+		"Tail the pods that have the same labels as this pod")
+	flags.StringSliceVar(&s.selectorPodLabels, "selector-from-pod-labels", nil,
+		"With --selector-from-pod, only match these of the pod's labels (e.g. 'app,tier')")
+	flags.StringVar(&s.fieldSelectorExpr, "field-selector", "", "Match pods by field (e.g. 'spec.nodeName=node1')")
+	flags.BoolVar(&s.parseJSON, "parse-json", false,
+		"Pretty-print messages that are JSON objects, or show only the fields given by --json-field")
+	flags.StringSliceVar(&s.jsonMessages.Fields, "json-field", nil,
+		"With --parse-json, show these fields of JSON messages, in order (e.g. 'level,msg')")
+	flags.StringVar(&s.multilineStart, "multiline-start", "",
+		"Join lines not matching this regexp onto the previous line, e.g. '^\\S' for indented stack traces")
+	flags.DurationVar(&s.multilineTimeout, "multiline-timeout", time.Second,
+		"With --multiline-start, output a joined line after no continuation has arrived for this long")
+	flags.StringSliceVar(&s.podIPs, "pod-ip", nil, "Only tail pods with this IP address (may be repeated)")
+	flags.StringVar(&s.nodeName, "node", "", "Only tail pods running on this node")
+	flags.BoolVar(&s.runningOnly, "running-only", false,
+		"Only watch running pods, filtered by the server (same as --field-selector status.phase=Running)")
+	flags.StringSliceVarP(&s.labelColumns, "label-columns", "L", nil,
+		"Include the values of these pod labels in the prefix of each line (e.g. 'version,region')")
+	flags.BoolVar(&s.shortPrefix, "short-prefix", false, "Leave the container name out of the prefix for pods with one container")
+	flags.BoolVar(&s.showNode, "show-node", false, "Include the node name in the prefix of each line")
+	flags.BoolVar(&s.imageInPrefix, "image-in-prefix", false,
+		"Include the container's image tag in the prefix of each line")
+	flags.StringVarP(&s.tmplString, "template", "t", "", "Template to format each line. For example, for"+
+		" just the message, use --template '{{ .Message }}'.")
+	flags.BoolVar(&s.groupBlankLines, "group-blank-lines", false,
+		"Write a blank line between groups of lines from different pods")
+	flags.IntVar(&s.prefixWidth, "prefix-width", 0,
+		"Pad or shorten the pod and container prefix to this many characters, to align messages; 0 disables")
+	flags.BoolVar(&s.raw, "raw", false, "Print only the message of each line, without prefix or color")
+	flags.StringSliceVar(&s.columnNames, "columns", nil,
+		"With --output json, csv or logfmt, the fields to include, in order (e.g. 'ts,pod,msg')")
+	flags.StringVarP(&s.outputFormat, "output", "o", "", "Output format; use 'json' for one JSON object per line, 'logfmt', or 'csv'")
+	flags.StringArrayVarP(&s.containerExprs, "container", "c", nil,
+		"Only tail containers whose name matches this regexp (may be repeated)")
+	flags.StringArrayVar(&s.excludeContainers, "exclude-container", nil,
+		"Don't tail containers whose name matches this regexp (may be repeated)")
+	flags.StringArrayVar(&s.excludePods, "exclude-pod", nil,
+		"Don't tail pods whose name matches this regexp (may be repeated)")
+	flags.StringArrayVar(&s.includeExprs, "include", nil, "Only show lines matching this regexp (may be repeated)")
+	flags.StringArrayVar(&s.excludeExprs, "exclude", nil, "Don't show lines matching this regexp (may be repeated)")
+	flags.BoolVar(&s.stripColors, "strip-ansi", false,
+		"Remove ANSI escape sequences, such as colors, from messages")
+	flags.BoolVar(&s.skipBinary, "skip-binary", false,
+		"Don't show lines that aren't valid UTF-8, instead of showing them escaped")
+	flags.IntVar(&s.maxLineLength, "max-line-length", 0,
+		"Truncate messages longer than this many bytes; 0 disables")
+	flags.IntVarP(&s.contextLines, "context-lines", "C", 0,
+		"Also show this many lines before and after each line matching --include")
+	flags.StringArrayVar(&s.highlightExprs, "highlight", nil,
+		"Highlight the parts of lines matching this regexp (may be repeated)")
+	flags.DurationVar(&s.flushInterval, "flush-interval", 0,
+		"Buffer output and write it out at this interval, for high volumes; 0 writes each line immediately")
+	flags.StringVar(&s.outputDir, "output-dir", "",
+		"Write each container's logs to its own file in this directory, instead of stdout")
+	flags.BoolVar(&s.gzipFiles, "gzip", false, "With --output-dir, compress the files with gzip")
+	flags.Int64Var(&s.maxFileSize, "max-file-size", 0,
+		"With --output-dir, rotate files when they reach this many bytes; 0 disables rotation")
+	flags.StringVar(&s.webhookOptions.URL, "webhook-url", "", "Also POST batches of lines as JSON to this URL")
+	flags.StringArrayVar(&s.webhookHeaders, "webhook-header", nil,
+		"Header to send with webhook and Loki requests, as 'Name: value' (may be repeated)")
+	flags.IntVar(&s.webhookOptions.BatchSize, "webhook-batch-size", 100, "Maximum number of lines per webhook request")
+	flags.DurationVar(&s.webhookOptions.FlushInterval, "webhook-flush-interval", time.Second,
+		"Maximum time to hold lines before sending them to the webhook")
+	flags.StringVar(&s.lokiURL, "loki-url", "", "Also push lines to the Loki instance at this base URL")
+	flags.StringSliceVar(&s.kafkaOptions.Brokers, "kafka-brokers", nil,
+		"Also produce lines as JSON to Kafka, through these brokers (e.g. 'kafka-1:9092,kafka-2:9092')")
+	flags.StringVar(&s.kafkaOptions.Topic, "kafka-topic", "", "With --kafka-brokers, the topic to produce to")
+	flags.StringVar(&s.kafkaKey, "kafka-key", defaultKafkaKey,
+		"With --kafka-brokers, a template for the message key, which decides the partition")
+	flags.IntVar(&s.kafkaOptions.BatchSize, "kafka-batch-size", 100,
+		"With --kafka-brokers, the number of lines that triggers producing a batch")
+	flags.DurationVar(&s.kafkaOptions.FlushInterval, "kafka-flush-interval", time.Second,
+		"With --kafka-brokers, the maximum time to hold lines before producing them")
+	flags.DurationVar(&s.mergeWindow, "merge-window", 0,
+		"Buffer lines for this long to output them in timestamp order across containers")
+	flags.BoolVar(&s.allNamespaces, "all-namespaces", false, "Apply to all Kubernetes namespaces")
+	flags.StringArrayVar(&s.excludeNamespaces, "exclude-namespace", []string{"kube-system", "kube-public"},
+		"With --all-namespaces, don't tail pods in this namespace (may be repeated)")
+	flags.StringArrayVar(&s.includeNamespaces, "include-namespace", nil,
+		"With --all-namespaces, only tail pods in namespaces matching this regexp (may be repeated)")
+	flags.BoolVar(&s.includeSystem, "include-system", false,
+		"With --all-namespaces, also tail pods in the namespaces given by --exclude-namespace")
+	flags.BoolVar(&s.initContainers, "init-containers", true, "Include init containers")
+	flags.BoolVar(&s.timestamps, "timestamps", false, "Include timestamps on each line")
+	flags.BoolVar(&s.relativeTime, "relative-time", false, "Include how long ago each line was logged, such as [-2.3s]")
+	flags.StringVar(&s.timezone, "timezone", "UTC", "Time zone of timestamps, such as 'Local' or 'America/New_York'")
+	flags.StringVar(&s.timeLayout, "time-format", "",
+		"Layout of timestamps, in Go's reference time format (e.g. '15:04:05.000')")
+	flags.DurationVar(&s.since, "since", 0, "Show logs newer than a relative duration like 5s, 2m, or 3h")
+	flags.StringVar(&s.sinceTime, "since-time", "", "Show logs after a specific RFC3339 timestamp")
+	flags.Int64Var(&s.tailLines, "tail", -1, "Number of recent lines to show from each running container; -1 shows"+
+		" only new lines unless --since or --since-time is given")
+	flags.BoolVarP(&s.tailOptions.Previous, "previous", "p", false,
+		"Show logs from the previous instance of restarted containers before following")
+	flags.DurationVar(&s.resyncPeriod, "resync-period", 0,
+		"How often to re-check all pods, to recover from missed events; 0 disables")
+	flags.IntVar(&s.tailOptions.NotReadyRetries, "not-ready-retries", 0,
+		"Report an error after this many attempts to read logs that aren't available yet; 0 retries quietly")
+	flags.BoolVar(&s.tailOptions.NoFollow, "no-follow", false,
+		"Print the existing logs of running containers and exit, instead of following them")
+	flags.BoolVar(&s.skipCompleted, "skip-completed", true,
+		"Don't show the logs of pods that have succeeded; defaults to false with --no-follow")
+	flags.BoolVar(&s.skipFailed, "skip-failed", true,
+		"Don't show the logs of pods that have failed; defaults to false with --no-follow")
+	flags.StringVar(&s.stateFilePath, "state-file", "",
+		"Save how far each container has been read to this file, and resume from it when restarted")
+	flags.DurationVar(&s.timeout, "timeout", 0, "Stop tailing and exit after this duration")
+	flags.BoolVar(&s.exitOnTermination, "exit-on-pod-termination", false,
+		"Exit once all tailed pods have terminated, with status 1 if any of them failed")
+	flags.BoolVar(&s.list, "list", false, "List the containers that would be tailed, and exit")
+	flags.DurationVar(&s.drainTimeout, "drain-timeout", 20*time.Second,
+		"On exit, wait at most this long for lines already read to be written out; 0 waits indefinitely")
+	flags.Int64Var(&s.maxLines, "max-lines", 0, "Stop tailing and exit after this many lines")
+	flags.StringVar(&s.httpAddr, "http-addr", "",
+		"Serve Prometheus metrics at /metrics and current tailers at /tailers on this address (e.g. ':9090')")
+	flags.DurationVar(&s.idleTimeout, "idle-timeout", 10*time.Minute,
+		"Stop tailing a container that has been silent this long if it is no longer running; 0 disables")
+	flags.IntVar(&s.maxTailers, "max-tailers", 0,
+		"Tail at most this many containers at once, queueing the rest; 0 means no limit")
+	flags.IntVar(&s.tailOptions.BufferSize, "buffer-size", 0,
+		"Buffer up to this many lines per container, dropping the oldest when output can't keep up;"+
+			" 0 disables buffering")
+	flags.Float64Var(&s.sampleRate, "sample", 0,
+		"Show only this fraction of each container's lines (e.g. 0.1 for 10%); 0 shows all")
+	flags.Float64Var(&s.tailOptions.RateLimit, "rate-limit", 0,
+		"Show at most this many lines per second from each container, suppressing the rest; 0 means no limit")
+	flags.DurationVar(&s.tailOptions.ReadTimeout, "read-timeout", 0,
+		"Reconnect to a container whose log stream has sent nothing for this long; 0 disables")
+	flags.DurationVar(&s.tailOptions.RetryMin, "retry-min-interval", 100*time.Millisecond,
+		"Initial delay before reconnecting to a container after an error")
+	flags.DurationVar(&s.tailOptions.RetryMax, "retry-max-interval", 10*time.Second,
+		"Maximum delay between reconnection attempts")
+	flags.BoolVar(&s.wait, "wait", false, "Print a message while waiting for matching pods to appear")
+	flags.BoolVar(&s.noWait, "no-wait", false, "Exit with an error if no matching pods are found")
+	flags.BoolVar(&s.noColor, "no-color", false, "Disable colored output")
+	flags.StringVar(&s.colorModeName, "color-mode", "auto",
+		"Number of colors to use for prefixes: '16', '256', 'truecolor', or 'auto' to detect from the terminal")
+	flags.StringVar(&s.colorSchemePath, "color-scheme", "", "YAML or JSON file assigning colors to containers")
+	flags.BoolVar(&s.containerStatus, "include-container-status", false,
+		"Print a line when a container is waiting to start, such as for ImagePullBackOff")
+	flags.CountVarP(&s.verbosity, "verbose", "v",
+		"Explain why matching pods are not being tailed; repeat (-vv) to also log every pod event")
+	flags.BoolVarP(&s.quiet, "quiet", "q", false, "Don't print events about new, deleted or restarted containers")
+}
+
+// validate checks the flags and combinations of them, and derives the
+// filters, selectors and output format from them.
+func (s *settings) validate(flags *pflag.FlagSet) error {
+	if s.since < 0 {
+		return fmt.Errorf("--since must not be negative")
+	}
+	if s.since > 0 {
+		seconds := int64(math.Ceil(s.since.Seconds()))
+		s.tailOptions.SinceSeconds = &seconds
+	}
+
+	if s.sinceTime != "" {
+		if s.since > 0 {
+			return fmt.Errorf("Only one of --since and --since-time may be specified")
+		}
+		t, err := time.Parse(time.RFC3339, s.sinceTime)
+		if err != nil {
+			return fmt.Errorf("Invalid --since-time: %s", err)
+		}
+		s.tailOptions.SinceTime = &t
+	}
+
+	if s.tailOptions.NoFollow {
+		if !flags.Changed("skip-completed") {
+			s.skipCompleted = false
+		}
+		if !flags.Changed("skip-failed") {
+			s.skipFailed = false
+		}
+	}
+
+	if s.tailLines >= 0 {
+		s.tailOptions.TailLines = &s.tailLines
+	}
+
+	switch s.outputFormat {
+	case "":
+	case "json", "logfmt", "csv":
+		if s.tmplString != "" {
+			return fmt.Errorf("--template cannot be used with --output %s", s.outputFormat)
+		}
+	default:
+		return fmt.Errorf("Invalid output format: %q", s.outputFormat)
+	}
+
+	var patternArgs []string
+	for _, arg := range flags.Args() {
+		if _, _, ok := parseWorkloadRef(arg); ok {
+			s.workloadArgs = append(s.workloadArgs, arg)
+		} else {
+			patternArgs = append(patternArgs, arg)
+		}
+	}
+	if len(s.workloadArgs) > 1 {
+		return fmt.Errorf("Only one workload (such as deployment/myapp) may be specified")
+	}
+
+	var err error
+	if s.containerFilter.Patterns, err = compilePatterns(patternArgs); err != nil {
+		return err
+	}
+	if s.containerFilter.Include, err = compilePatterns(s.containerExprs); err != nil {
+		return err
+	}
+	if s.containerFilter.Exclude, err = compilePatterns(s.excludeContainers); err != nil {
+		return err
+	}
+	if len(s.podIPs) > 0 {
+		s.containerFilter.PodIPs = map[string]bool{}
+		for _, ip := range s.podIPs {
+			s.containerFilter.PodIPs[ip] = true
+		}
+	}
+	if s.containerFilter.ExcludePods, err = compilePatterns(s.excludePods); err != nil {
+		return err
+	}
+	if len(s.includeNamespaces) > 0 && !s.allNamespaces {
+		return fmt.Errorf("--include-namespace requires --all-namespaces")
+	}
+	if s.containerFilter.IncludeNamespaces, err = compilePatterns(s.includeNamespaces); err != nil {
+		return err
+	}
+	if s.lineFilter.Include, err = compilePatterns(s.includeExprs); err != nil {
+		return err
+	}
+	if s.lineFilter.Exclude, err = compilePatterns(s.excludeExprs); err != nil {
+		return err
+	}
+
+	if s.highlightPatterns, err = compilePatterns(s.highlightExprs); err != nil {
+		return err
+	}
+
+	if s.multilineStart != "" {
+		if s.multilinePattern, err = regexp.Compile(s.multilineStart); err != nil {
+			return fmt.Errorf("Invalid regexp: %q: %s", s.multilineStart, err)
+		}
+		if s.multilineTimeout <= 0 {
+			return fmt.Errorf("--multiline-timeout must be positive")
+		}
+	}
+
+	if s.webhookOptions.URL != "" || s.lokiURL != "" {
+		s.webhookOptions.Headers = http.Header{}
+		s.webhookOptions.MaxRetries = 5
+		for _, header := range s.webhookHeaders {
+			parts := strings.SplitN(header, ":", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("Invalid webhook header: %q", header)
+			}
+			s.webhookOptions.Headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+	}
+
+	if s.maxLineLength < 0 {
+		return fmt.Errorf("--max-line-length must not be negative")
+	}
+
+	if s.contextLines < 0 {
+		return fmt.Errorf("--context-lines must not be negative")
+	}
+
+	if len(s.jsonMessages.Fields) > 0 && !s.parseJSON {
+		return fmt.Errorf("--json-field requires --parse-json")
+	}
+
+	if s.gzipFiles && s.outputDir == "" {
+		return fmt.Errorf("--gzip requires --output-dir")
+	}
+
+	if s.groupBlankLines && (s.outputFormat != "" || s.outputDir != "") {
+		return fmt.Errorf("--group-blank-lines cannot be used with --output or --output-dir")
+	}
+
+	if s.sampleRate < 0 || s.sampleRate > 1 {
+		return fmt.Errorf("--sample must be between 0 and 1")
+	}
+
+	if s.prefixWidth < 0 {
+		return fmt.Errorf("--prefix-width must not be negative")
+	}
+
+	if s.wait && s.noWait {
+		return fmt.Errorf("Only one of --wait and --no-wait may be specified")
+	}
+
+	// The logs are not colored when written to files
+	s.formatOptions = FormatOptions{Colors: !s.raw && s.outputDir == ""}
+	switch s.colorModeName {
+	case "auto":
+		s.formatOptions.ColorMode = detectColorMode(os.Getenv)
+	case colorMode16, colorMode256, colorModeTrueColor:
+		s.formatOptions.ColorMode = s.colorModeName
+	default:
+		return fmt.Errorf("Invalid color mode: %q", s.colorModeName)
+	}
+
+	if s.colorSchemePath != "" {
+		if s.formatOptions.ColorScheme, err = LoadColorScheme(s.colorSchemePath); err != nil {
+			return err
+		}
+	}
+
+	if s.formatOptions.Location, err = parseTimeFormat(s.timezone, s.timeLayout); err != nil {
+		return err
+	}
+	s.formatOptions.TimeLayout = s.timeLayout
+
+	if s.raw {
+		if s.tmplString != "" || s.outputFormat != "" {
+			return fmt.Errorf("--raw cannot be used with --template or --output")
+		}
+		s.tmplString = "{{.Message}}"
+	}
+
+	if s.tmplString == "" {
+		prefix := func(withContainer bool) string {
+			format, args := "%s", ".Pod.Name"
+			if withContainer {
+				format, args = format+":%s", args+" .Container.Name"
+			}
+			if s.allNamespaces {
+				format, args = "%s/"+format, ".Pod.Namespace "+args
+			}
+			if s.imageInPrefix {
+				format, args = format+"(%s)", args+" (imageTag .ContainerImage)"
+			}
+			if s.showNode {
+				format, args = format+"@%s", args+" .Node"
+			}
+			if len(s.contextNames) > 1 {
+				format, args = "%s/"+format, ".Cluster "+args
+			}
+			return fmt.Sprintf(`{{colored .Pod .Container (fit %d (printf %q %s))}}`, s.prefixWidth, format, args)
+		}
+		if s.shortPrefix {
+			s.tmplString = "{{if singleContainer .Pod}}" + prefix(false) + "{{else}}" + prefix(true) + "{{end}}"
+		} else {
+			s.tmplString = prefix(true)
+		}
+		if len(s.labelColumns) > 0 {
+			s.tmplString += " {{labelValues .Labels"
+			for _, label := range s.labelColumns {
+				s.tmplString += fmt.Sprintf(" %q", label)
+			}
+			s.tmplString += "}}"
+		}
+		s.tmplString += " {{.Message}}"
+		if s.relativeTime {
+			s.tmplString = "{{age .Timestamp}} " + s.tmplString
+		} else if s.timestamps {
+			s.tmplString = "{{formatTime .Timestamp}} " + s.tmplString
+		}
+	}
+	s.tmplString += "\n"
+
+	s.labelSelectors = []labels.Selector{labels.Everything()}
+	if len(s.labelSelectorExprs) > 0 {
+		s.labelSelectors = nil
+		for _, expr := range s.labelSelectorExprs {
+			sel, err := labels.Parse(expr)
+			if err != nil {
+				return err
+			}
+			s.labelSelectors = append(s.labelSelectors, sel)
+		}
+	}
+
+	s.fieldSelector = fields.Everything()
+	if s.fieldSelectorExpr != "" {
+		if s.fieldSelector, err = fields.ParseSelector(s.fieldSelectorExpr); err != nil {
+			return err
+		}
+	}
+	if s.nodeName != "" {
+		s.fieldSelector = andFieldSelectors(s.fieldSelector, fields.OneTermEqualSelector("spec.nodeName", s.nodeName))
+	}
+	if s.runningOnly {
+		s.fieldSelector = andFieldSelectors(s.fieldSelector,
+			fields.OneTermEqualSelector("status.phase", string(v1.PodRunning)))
+	}
+
+	if len(s.kafkaOptions.Brokers) > 0 {
+		if s.kafkaOptions.Topic == "" {
+			return fmt.Errorf("--kafka-brokers requires --kafka-topic")
+		}
+		if s.kafkaOptions.Key, err = template.New("key").Funcs(s.formatOptions.templateFuncs()).Parse(s.kafkaKey); err != nil {
+			return fmt.Errorf("Invalid Kafka key template: %s", err)
+		}
+	}
+
+	tmpl, err := template.New("line").Funcs(s.formatOptions.templateFuncs()).Parse(s.tmplString)
+	if err != nil {
+		return fmt.Errorf("Invalid template: %s", err)
+	}
+
+	if s.allNamespaces {
+		s.namespace = v1.NamespaceAll
+		if !s.includeSystem {
+			s.containerFilter.ExcludeNamespaces = map[string]bool{}
+			for _, ns := range s.excludeNamespaces {
+				s.containerFilter.ExcludeNamespaces[ns] = true
+			}
+		}
+	}
+	if len(s.workloadArgs) > 0 && s.allNamespaces {
+		return fmt.Errorf("A workload cannot be used with --all-namespaces")
+	}
+	if s.selectorFromPod != "" && s.allNamespaces {
+		return fmt.Errorf("--selector-from-pod cannot be used with --all-namespaces")
+	}
+	if len(s.selectorPodLabels) > 0 && s.selectorFromPod == "" {
+		return fmt.Errorf("--selector-from-pod-labels requires --selector-from-pod")
+	}
+
+	s.formatter = TemplateFormatter(tmpl)
+	if len(s.highlightPatterns) > 0 {
+		s.formatter = HighlightFormatter(s.highlightPatterns, s.formatOptions, s.formatter)
+	}
+	if len(s.columnNames) > 0 && s.outputFormat == "" {
+		return fmt.Errorf("--columns requires --output json, csv or logfmt")
+	}
+	if len(s.columnNames) == 0 {
+		s.columnNames = defaultColumns
+	}
+	columns, err := parseColumns(s.columnNames)
+	if err != nil {
+		return err
+	}
+	switch s.outputFormat {
+	case "json":
+		s.formatter = writeJSONEvent
+		if flags.Changed("columns") {
+			s.formatter = newJSONFormatter(columns)
+		}
+	case "logfmt":
+		s.formatter = newLogfmtFormatter(columns)
+	case "csv":
+		if s.outputDir != "" {
+			return fmt.Errorf("--output csv cannot be used with --output-dir")
+		}
+		s.formatter = newCSVFormatter(columns)
+	}
+	return nil
+}
+
+// andFieldSelectors returns a selector matching both selectors. Unlike
+// fields.AndSelectors, an empty selector is left out, so that it doesn't
+// leave an empty term in the selector sent to the API server.
+func andFieldSelectors(a, b fields.Selector) fields.Selector {
+	if a.Empty() {
+		return b
+	}
+	return fields.AndSelectors(a, b)
+}
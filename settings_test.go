@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestParseSettings_Invalid(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--json-field", "msg"}, "--json-field requires --parse-json"},
+		{[]string{"--wait", "--no-wait"}, "Only one of --wait and --no-wait may be specified"},
+		{[]string{"--since", "-1s"}, "--since must not be negative"},
+		{[]string{"--since", "1m", "--since-time", "2017-06-01T12:00:00Z"},
+			"Only one of --since and --since-time may be specified"},
+		{[]string{"--since-time", "yesterday"}, "Invalid --since-time"},
+		{[]string{"--output", "yaml"}, `Invalid output format: "yaml"`},
+		{[]string{"--output", "json", "--template", "{{.Message}}"}, "--template cannot be used with --output json"},
+		{[]string{"deployment/a", "deployment/b"}, "Only one workload (such as deployment/myapp) may be specified"},
+		{[]string{"--gzip"}, "--gzip requires --output-dir"},
+		{[]string{"--group-blank-lines", "--output", "json"},
+			"--group-blank-lines cannot be used with --output or --output-dir"},
+		{[]string{"--sample", "1.5"}, "--sample must be between 0 and 1"},
+		{[]string{"--prefix-width", "-1"}, "--prefix-width must not be negative"},
+		{[]string{"--max-line-length", "-1"}, "--max-line-length must not be negative"},
+		{[]string{"--context-lines", "-1"}, "--context-lines must not be negative"},
+		{[]string{"--include-namespace", "team-"}, "--include-namespace requires --all-namespaces"},
+		{[]string{"--multiline-start", "^\\S", "--multiline-timeout", "0"}, "--multiline-timeout must be positive"},
+		{[]string{"--webhook-url", "http://localhost", "--webhook-header", "nocolon"}, `Invalid webhook header: "nocolon"`},
+		{[]string{"--color-mode", "8"}, `Invalid color mode: "8"`},
+		{[]string{"--raw", "--output", "json"}, "--raw cannot be used with --template or --output"},
+		{[]string{"--kafka-brokers", "localhost:9092"}, "--kafka-brokers requires --kafka-topic"},
+		{[]string{"--template", "{{.Message"}, "Invalid template: "},
+		{[]string{"--template", "{{nosuch .Message}}"}, `Invalid template: template: line:1: function "nosuch" not defined`},
+		{[]string{"--all-namespaces", "deployment/web"}, "A workload cannot be used with --all-namespaces"},
+		{[]string{"--all-namespaces", "--selector-from-pod", "web-1"},
+			"--selector-from-pod cannot be used with --all-namespaces"},
+		{[]string{"--selector-from-pod-labels", "app"}, "--selector-from-pod-labels requires --selector-from-pod"},
+		{[]string{"--columns", "ts,msg"}, "--columns requires --output json, csv or logfmt"},
+		{[]string{"--output", "csv", "--output-dir", "logs"}, "--output csv cannot be used with --output-dir"},
+	} {
+		_, err := parseSettings(test.args)
+		if err == nil {
+			t.Errorf("%q: got no error, want %q", test.args, test.want)
+		} else if !strings.HasPrefix(err.Error(), test.want) {
+			t.Errorf("%q: got error %q, want %q", test.args, err, test.want)
+		}
+	}
+}
+
+func TestParseSettings(t *testing.T) {
+	s, err := parseSettings([]string{"--since", "1500ms", "--no-follow", "--all-namespaces",
+		"--node", "node-1", "^api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.tailOptions.SinceSeconds == nil || *s.tailOptions.SinceSeconds != 2 {
+		t.Errorf("got since seconds %v, want 2", s.tailOptions.SinceSeconds)
+	}
+	if s.skipCompleted || s.skipFailed {
+		t.Error("got completed or failed pods skipped with --no-follow")
+	}
+	if !s.containerFilter.ExcludeNamespaces["kube-system"] {
+		t.Error("got kube-system not excluded with --all-namespaces")
+	}
+	if !s.fieldSelector.Matches(fields.Set{"spec.nodeName": "node-1"}) ||
+		s.fieldSelector.Matches(fields.Set{"spec.nodeName": "node-2"}) {
+		t.Errorf("got field selector %q, want pods on node-1", s.fieldSelector)
+	}
+	if len(s.containerFilter.Patterns) != 1 || s.containerFilter.Patterns[0].String() != "^api" {
+		t.Errorf("got patterns %v, want [^api]", s.containerFilter.Patterns)
+	}
+
+	s, err = parseSettings([]string{"--no-follow", "--skip-failed", "--since-time", "2017-06-01T12:00:00Z",
+		"deployment/web", "^api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.skipCompleted || !s.skipFailed {
+		t.Errorf("got skip completed %v and failed %v, want false and true", s.skipCompleted, s.skipFailed)
+	}
+	if want := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC); s.tailOptions.SinceTime == nil ||
+		!s.tailOptions.SinceTime.Equal(want) {
+		t.Errorf("got since time %v, want %s", s.tailOptions.SinceTime, want)
+	}
+	if len(s.workloadArgs) != 1 || s.workloadArgs[0] != "deployment/web" {
+		t.Errorf("got workloads %q, want [deployment/web]", s.workloadArgs)
+	}
+	if len(s.containerFilter.Patterns) != 1 {
+		t.Errorf("got patterns %v, want only [^api]", s.containerFilter.Patterns)
+	}
+}
+
+func TestParseSettings_Template(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	event := testEvent(pod, "app", time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC), "hello")
+	event.Node = "node-1"
+	event.Labels = map[string]string{"app": "web", "version": "v2"}
+	for _, test := range []struct {
+		template string
+		want     string
+	}{
+		{"{{.Pod.Namespace}}/{{.Pod.Name}}/{{.Container.Name}}@{{.Node}} {{.Message}}",
+			"default/web-1/app@node-1 hello\n"},
+		{`{{index .Labels "app"}} {{.Message}}`, "web hello\n"},
+		{`{{labelValues .Labels "version" "region"}} {{.Message}}`, "[v2,] hello\n"},
+		{"{{formatTime .Timestamp}} {{.Message}}", "2017-06-01 12:00:00 +0000 UTC hello\n"},
+	} {
+		s, err := parseSettings([]string{"--template", test.template})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := s.formatter(&buf, event); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.want {
+			t.Errorf("%s: got %q, want %q", test.template, buf.String(), test.want)
+		}
+	}
+}
+
+func TestParseSettings_TailOptions(t *testing.T) {
+	for _, test := range []struct {
+		args  []string
+		check func(t *testing.T, options TailOptions)
+	}{
+		{nil, func(t *testing.T, options TailOptions) {
+			if options.SinceSeconds != nil {
+				t.Errorf("got SinceSeconds %d, want none", *options.SinceSeconds)
+			}
+			if options.TailLines != nil {
+				t.Errorf("got TailLines %d, want none", *options.TailLines)
+			}
+		}},
+		{[]string{"--tail", "5"}, func(t *testing.T, options TailOptions) {
+			if options.TailLines == nil || *options.TailLines != 5 {
+				t.Errorf("got TailLines %v, want 5", options.TailLines)
+			}
+		}},
+		{[]string{"--tail", "-1"}, func(t *testing.T, options TailOptions) {
+			if options.TailLines != nil {
+				t.Errorf("got TailLines %d, want none", *options.TailLines)
+			}
+		}},
+		{[]string{"--since", "10m"}, func(t *testing.T, options TailOptions) {
+			if options.SinceSeconds == nil || *options.SinceSeconds != 600 {
+				t.Errorf("got SinceSeconds %v, want 600", options.SinceSeconds)
+			}
+		}},
+		{[]string{"--since", "0"}, func(t *testing.T, options TailOptions) {
+			if options.SinceSeconds != nil {
+				t.Errorf("got SinceSeconds %d, want none", *options.SinceSeconds)
+			}
+		}},
+		{[]string{"--since-time", "2017-06-01T14:00:00+02:00"}, func(t *testing.T, options TailOptions) {
+			want := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+			if options.SinceTime == nil || !options.SinceTime.Equal(want) {
+				t.Errorf("got SinceTime %v, want %s", options.SinceTime, want)
+			}
+			if options.SinceSeconds != nil {
+				t.Errorf("got SinceSeconds %d, want none", *options.SinceSeconds)
+			}
+		}},
+	} {
+		s, err := parseSettings(test.args)
+		if err != nil {
+			t.Fatalf("%q: %s", test.args, err)
+		}
+		test.check(t, s.tailOptions)
+	}
+}
+
+func TestParseSettings_Colors(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		want bool
+	}{
+		{nil, true},
+		{[]string{"--output-dir", "logs"}, false},
+		{[]string{"--raw"}, false},
+	} {
+		s, err := parseSettings(test.args)
+		if err != nil {
+			t.Fatalf("%q: %s", test.args, err)
+		}
+		if s.formatOptions.Colors != test.want {
+			t.Errorf("%q: got colors %v, want %v", test.args, s.formatOptions.Colors, test.want)
+		}
+	}
+}
+
+// tailedWith returns the namespace/name of the pods tailed by a controller
+// configured from the args like main does, as the pods are added and then
+// updated. Pods not matching the field selector are left out, as the API
+// server would.
+func tailedWith(t *testing.T, args []string, pods ...v1.Pod) string {
+	s, err := parseSettings(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientset, watcher := newFakeClientset()
+	events := &podEvents{}
+	ctl := NewControllerWithOptions(clientset,
+		WithNamespace(v1.NamespaceAll),
+		WithLabelSelectors(s.labelSelectors...),
+		WithFieldSelector(s.fieldSelector),
+		WithPodFilter(s.containerFilter.MatchPod),
+		WithFilter(s.containerFilter.Match),
+		WithCompletedPods(!s.skipCompleted, !s.skipFailed),
+		WithCallbacks(Callbacks{OnPodEvent: events.record}))
+	ctl.logStream = blockingLogs
+	defer runController(ctl)()
+
+	for i := range pods {
+		if s.fieldSelector.Matches(fields.Set{"spec.nodeName": pods[i].Spec.NodeName}) {
+			watcher.Add(&pods[i])
+			watcher.Modify(&pods[i])
+		}
+	}
+	events.sync(t, watcher)
+	seen := map[string]bool{}
+	for _, info := range ctl.ListTailers() {
+		seen[info.Namespace+"/"+info.Pod] = true
+	}
+	var names []string
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// settingsTestPod returns a running pod with a container named app.
+func settingsTestPod(namespace, name string) v1.Pod {
+	pod := podWithContainers("app")
+	pod.Namespace, pod.Name, pod.UID = namespace, name, types.UID("uid-"+namespace+"-"+name)
+	pod.Labels = map[string]string{"app": "web"}
+	return pod
+}
+
+func TestParseSettings_ExcludePod(t *testing.T) {
+	pods := []v1.Pod{
+		settingsTestPod("default", "web-1"),
+		settingsTestPod("default", "web-canary-1"),
+		settingsTestPod("default", "web-debug"),
+		settingsTestPod("default", "web-2"),
+	}
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-l", "app=web"}, "default/web-1,default/web-2,default/web-canary-1,default/web-debug"},
+		{[]string{"-l", "app=web", "--exclude-pod", "canary"}, "default/web-1,default/web-2,default/web-debug"},
+		{[]string{"-l", "app=web", "--exclude-pod", "canary", "--exclude-pod", "-debug$"},
+			"default/web-1,default/web-2"},
+	} {
+		if got := tailedWith(t, test.args, pods...); got != test.want {
+			t.Errorf("%q: got %s tailed, want %s", test.args, got, test.want)
+		}
+	}
+}
+
+func TestParseSettings_SystemNamespaces(t *testing.T) {
+	pods := []v1.Pod{
+		settingsTestPod("default", "web-1"),
+		settingsTestPod("kube-system", "dns-1"),
+		settingsTestPod("kube-public", "info-1"),
+		settingsTestPod("monitoring", "agent-1"),
+	}
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--all-namespaces"}, "default/web-1,monitoring/agent-1"},
+		{[]string{"--all-namespaces", "--include-system"},
+			"default/web-1,kube-public/info-1,kube-system/dns-1,monitoring/agent-1"},
+		{[]string{"--all-namespaces", "--exclude-namespace", "monitoring"}, "default/web-1,kube-public/info-1,kube-system/dns-1"},
+		{[]string{"--all-namespaces", "--exclude-namespace", "monitoring", "--exclude-namespace", "kube-system"},
+			"default/web-1,kube-public/info-1"},
+	} {
+		if got := tailedWith(t, test.args, pods...); got != test.want {
+			t.Errorf("%q: got %s tailed, want %s", test.args, got, test.want)
+		}
+	}
+}
+
+func TestParseSettings_CompletedPods(t *testing.T) {
+	finished := func(name string, phase v1.PodPhase) v1.Pod {
+		pod := settingsTestPod("default", name)
+		pod.Status.Phase = phase
+		pod.Status.ContainerStatuses[0].State = v1.ContainerState{Terminated: &v1.ContainerStateTerminated{}}
+		return pod
+	}
+	pods := []v1.Pod{
+		settingsTestPod("default", "running"),
+		finished("succeeded", v1.PodSucceeded),
+		finished("failed", v1.PodFailed),
+	}
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "default/running"},
+		{[]string{"--skip-completed=false"}, "default/running,default/succeeded"},
+		{[]string{"--skip-failed=false"}, "default/failed,default/running"},
+		{[]string{"--no-follow"}, "default/failed,default/running,default/succeeded"},
+		{[]string{"--no-follow", "--skip-completed"}, "default/failed,default/running"},
+	} {
+		if got := tailedWith(t, test.args, pods...); got != test.want {
+			t.Errorf("%q: got %s tailed, want %s", test.args, got, test.want)
+		}
+	}
+}
+
+func TestParseSettings_Node(t *testing.T) {
+	onNode := func(name, node string) v1.Pod {
+		pod := settingsTestPod("default", name)
+		pod.Spec.NodeName = node
+		return pod
+	}
+	pods := []v1.Pod{onNode("web-1", "node-1"), onNode("web-2", "node-2"), onNode("web-3", "node-1")}
+	if got, want := tailedWith(t, []string{"--node", "node-1"}, pods...), "default/web-1,default/web-3"; got != want {
+		t.Errorf("got %s tailed, want %s", got, want)
+	}
+
+	defer func(noColor bool) { color.NoColor = noColor }(color.NoColor)
+	color.NoColor = true
+	event := testEvent(&pods[0], "app", time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC), "hello")
+	event.Node = pods[0].Spec.NodeName
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "web-1:app hello\n"},
+		{[]string{"--show-node"}, "web-1:app@node-1 hello\n"},
+		{[]string{"--show-node", "--all-namespaces"}, "default/web-1:app@node-1 hello\n"},
+	} {
+		s, err := parseSettings(test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := s.formatter(&buf, event); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.want {
+			t.Errorf("%q: got %q, want %q", test.args, buf.String(), test.want)
+		}
+	}
+}
+
+func TestParseSettings_Raw(t *testing.T) {
+	s, err := parseSettings([]string{"--raw", "--include", "error", "--exclude", "ignored", "--highlight", "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := settingsTestPod("default", "web-1")
+	var buf bytes.Buffer
+	for _, message := range []string{
+		"an error", "all good", "an ignored error", "\x1b[31mcolored\x1b[0m error", "",
+	} {
+		if !s.lineFilter.Match(message) {
+			continue
+		}
+		event := testEvent(&pod, "app", time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC), message)
+		if err := s.formatter(&buf, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := "an error\n\x1b[31mcolored\x1b[0m error\n"; buf.String() != want {
+		t.Errorf("got %q, want only the matching messages %q", buf.String(), want)
+	}
+}
+
+// formatWith formats the event with the default template for the args,
+// without colors.
+func formatWith(t *testing.T, args []string, event LogEvent) string {
+	defer func(noColor bool) { color.NoColor = noColor }(color.NoColor)
+	color.NoColor = true
+	s, err := parseSettings(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := s.formatter(&buf, event); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestParseSettings_ShortPrefix(t *testing.T) {
+	ts := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	single := settingsTestPod("default", "web-1")
+	multi := podWithContainers("app", "sidecar")
+	multi.Namespace, multi.Name = "default", "web-2"
+	withInit := settingsTestPod("default", "web-3")
+	withInit.Spec.InitContainers = []v1.Container{{Name: "migrate"}}
+	for _, test := range []struct {
+		args []string
+		pod  *v1.Pod
+		want string
+	}{
+		{nil, &single, "web-1:app hello\n"},
+		{[]string{"--short-prefix"}, &single, "web-1 hello\n"},
+		{[]string{"--short-prefix"}, &multi, "web-2:app hello\n"},
+		{[]string{"--short-prefix"}, &withInit, "web-3:app hello\n"},
+		{[]string{"--short-prefix", "--all-namespaces"}, &single, "default/web-1 hello\n"},
+		{[]string{"--short-prefix", "--all-namespaces"}, &multi, "default/web-2:app hello\n"},
+	} {
+		event := testEvent(test.pod, "app", ts, "hello")
+		if got := formatWith(t, test.args, event); got != test.want {
+			t.Errorf("%q for %s: got %q, want %q", test.args, test.pod.Name, got, test.want)
+		}
+	}
+}
+
+func TestParseSettings_LabelColumns(t *testing.T) {
+	ts := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	pod := settingsTestPod("default", "web-1")
+	for _, test := range []struct {
+		args   []string
+		labels map[string]string
+		want   string
+	}{
+		{nil, map[string]string{"version": "v2"}, "web-1:app hello\n"},
+		{[]string{"--label-columns", "version,region"}, map[string]string{"version": "v2", "region": "eu"},
+			"web-1:app [v2,eu] hello\n"},
+		{[]string{"-L", "version", "-L", "region"}, map[string]string{"region": "eu"}, "web-1:app [,eu] hello\n"},
+		{[]string{"-L", "version,region"}, nil, "web-1:app [,] hello\n"},
+	} {
+		event := testEvent(&pod, "app", ts, "hello")
+		event.Labels = test.labels
+		if got := formatWith(t, test.args, event); got != test.want {
+			t.Errorf("%q with %v: got %q, want %q", test.args, test.labels, got, test.want)
+		}
+	}
+}
+
+func TestParseSettings_PodIP(t *testing.T) {
+	withIP := func(name, ip string) v1.Pod {
+		pod := settingsTestPod("default", name)
+		pod.Status.PodIP = ip
+		return pod
+	}
+	pods := []v1.Pod{
+		withIP("web-1", "10.1.2.3"),
+		withIP("web-2", "10.1.2.4"),
+		withIP("web-3", "10.1.2.30"),
+		withIP("pending", ""),
+	}
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--pod-ip", "10.1.2.3"}, "default/web-1"},
+		{[]string{"--pod-ip", "10.1.2.3,10.1.2.30"}, "default/web-1,default/web-3"},
+		{[]string{"--pod-ip", "10.1.2.4", "--pod-ip", "10.1.2.30"}, "default/web-2,default/web-3"},
+		{[]string{"--pod-ip", "10.9.9.9"}, ""},
+	} {
+		if got := tailedWith(t, test.args, pods...); got != test.want {
+			t.Errorf("%q: got %q tailed, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestParseSettings_RunningOnly(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"--running-only"}, "status.phase=Running"},
+		{[]string{"--field-selector", "spec.nodeName=node-1", "--running-only"},
+			"spec.nodeName=node-1,status.phase=Running"},
+		{[]string{"--field-selector", "metadata.name!=web-1,spec.restartPolicy=Always", "--running-only"},
+			"metadata.name!=web-1,spec.restartPolicy=Always,status.phase=Running"},
+		{[]string{"--node", "node-1", "--running-only"}, "spec.nodeName=node-1,status.phase=Running"},
+	} {
+		s, err := parseSettings(test.args)
+		if err != nil {
+			t.Fatalf("%q: %s", test.args, err)
+		}
+		if got := s.fieldSelector.String(); got != test.want {
+			t.Errorf("%q: got field selector %q, want %q", test.args, got, test.want)
+		}
+		if _, err := fields.ParseSelector(s.fieldSelector.String()); err != nil {
+			t.Errorf("%q: got a field selector the API server can't parse: %s", test.args, err)
+		}
+	}
+
+	s, err := parseSettings([]string{"--field-selector", "spec.nodeName=node-1", "--running-only"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		set  fields.Set
+		want bool
+	}{
+		{fields.Set{"spec.nodeName": "node-1", "status.phase": "Running"}, true},
+		{fields.Set{"spec.nodeName": "node-1", "status.phase": "Pending"}, false},
+		{fields.Set{"spec.nodeName": "node-2", "status.phase": "Running"}, false},
+	} {
+		if got := s.fieldSelector.Matches(test.set); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.set, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/fatih/color"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Sink receives log events for output. Write may be called concurrently
+// from multiple tailers.
+type Sink interface {
+	Write(event LogEvent) error
+
+	// Flush writes out any buffered events.
+	Flush() error
+
+	// Close flushes and releases the sink. No events may be written after
+	// it has been called.
+	Close() error
+}
+
+// ContainerCloser is implemented by sinks that hold resources for each
+// container, such as an open file, that can be released once no more events
+// will be written for the container. The cluster is that of the
+// container's events, which is empty unless tailing more than one.
+type ContainerCloser interface {
+	CloseContainer(cluster string, pod *v1.Pod, container *v1.Container) error
+}
+
+// closeContainer closes the container in the sink, if it implements
+// ContainerCloser.
+func closeContainer(sink Sink, cluster string, pod *v1.Pod, container *v1.Container) error {
+	if closer, ok := sink.(ContainerCloser); ok {
+		return closer.CloseContainer(cluster, pod, container)
+	}
+	return nil
+}
+
+// EventFormatter writes a single event to a writer.
+type EventFormatter func(w io.Writer, event LogEvent) error
+
+// TemplateFormatter returns a formatter that executes the template for
+// each event.
+func TemplateFormatter(tmpl *template.Template) EventFormatter {
+	return func(w io.Writer, event LogEvent) error {
+		return tmpl.Execute(w, event)
+	}
+}
+
+// ResetANSIFormatter returns a formatter that resets the terminal's colors
+// after any message that sets them, then formats the event.
+func ResetANSIFormatter(format EventFormatter) EventFormatter {
+	return func(w io.Writer, event LogEvent) error {
+		event.Message = resetANSI(event.Message)
+		return format(w, event)
+	}
+}
+
+// HighlightFormatter returns a formatter that highlights the parts of each
+// message matching any of the patterns, then formats the event. Nothing is
+// highlighted when colors are disabled, by --no-color or by the options.
+func HighlightFormatter(patterns []*regexp.Regexp, options FormatOptions, format EventFormatter) EventFormatter {
+	highlight := color.New(color.ReverseVideo)
+	return func(w io.Writer, event LogEvent) error {
+		if options.Colors && !color.NoColor {
+			event.Message = highlightMatches(patterns, event.Message, highlight)
+		}
+		return format(w, event)
+	}
+}
+
+// highlightMatches wraps the matches of the patterns in the color.
+// Overlapping and adjacent matches are highlighted as one.
+func highlightMatches(patterns []*regexp.Regexp, s string, c *color.Color) string {
+	var spans spansByStart
+	for _, r := range patterns {
+		for _, span := range r.FindAllStringIndex(s, -1) {
+			if span[0] < span[1] {
+				spans = append(spans, span)
+			}
+		}
+	}
+	if len(spans) == 0 {
+		return s
+	}
+	sort.Sort(spans)
+
+	var buf bytes.Buffer
+	pos := 0
+	for i := 0; i < len(spans); {
+		start, end := spans[i][0], spans[i][1]
+		for i++; i < len(spans) && spans[i][0] <= end; i++ {
+			if spans[i][1] > end {
+				end = spans[i][1]
+			}
+		}
+		buf.WriteString(s[pos:start])
+		buf.WriteString(c.Sprint(s[start:end]))
+		pos = end
+	}
+	buf.WriteString(s[pos:])
+	return buf.String()
+}
+
+type spansByStart [][]int
+
+func (s spansByStart) Len() int           { return len(s) }
+func (s spansByStart) Less(i, j int) bool { return s[i][0] < s[j][0] }
+func (s spansByStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// WriterSink formats events to a writer, such as stdout. Each event is
+// formatted into a buffer and written with a single call, so that lines
+// from concurrent tailers never interleave. It does not close the writer.
+type WriterSink struct {
+	w        io.Writer
+	format   EventFormatter
+	buf      bytes.Buffer
+	buffered *bufio.Writer
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+
+	// With separatePods, lastPod and podRun track the pod of the previous
+	// line and how many lines in a row it has written.
+	separatePods bool
+	lastPod      string
+	podRun       int
+	sync.Mutex
+}
+
+// minPodRun is how many lines in a row a pod must write for SeparatePods to
+// set them apart from the next pod's.
+const minPodRun = 2
+
+func NewWriterSink(w io.Writer, format EventFormatter) *WriterSink {
+	return &WriterSink{
+		w:      w,
+		format: format,
+	}
+}
+
+// NewBufferedWriterSink returns a WriterSink that collects output in
+// memory, and writes it out every interval, when the buffer is full, and on
+// Flush and Close. This saves system calls at high volume.
+func NewBufferedWriterSink(w io.Writer, format EventFormatter, interval time.Duration) *WriterSink {
+	buffered := bufio.NewWriterSize(w, 64*1024)
+	s := &WriterSink{
+		w:        buffered,
+		format:   format,
+		buffered: buffered,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	go s.run(interval)
+	return s
+}
+
+func (s *WriterSink) run(interval time.Duration) {
+	defer close(s.doneCh)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			_ = s.Flush()
+		}
+	}
+}
+
+// SeparatePods makes the sink write a blank line before a line from a
+// different pod than the previous one, if that pod wrote several lines in a
+// row. Quickly interleaved pods are left as they are, rather than having
+// blank lines between every line.
+func (s *WriterSink) SeparatePods() {
+	s.Lock()
+	defer s.Unlock()
+	s.separatePods = true
+}
+
+func (s *WriterSink) Write(event LogEvent) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.buf.Reset()
+	if s.separatePods {
+		pod := event.Cluster + "/" + event.Pod.Namespace + "/" + event.Pod.Name
+		if pod != s.lastPod {
+			if s.podRun >= minPodRun {
+				s.buf.WriteByte('\n')
+			}
+			s.lastPod, s.podRun = pod, 0
+		}
+		s.podRun++
+	}
+	if err := s.format(&s.buf, event); err != nil {
+		return err
+	}
+	_, err := s.w.Write(s.buf.Bytes())
+	return err
+}
+
+func (s *WriterSink) Flush() error {
+	if s.buffered == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.buffered.Flush()
+}
+
+func (s *WriterSink) Close() error {
+	if s.buffered == nil {
+		return nil
+	}
+	close(s.stopCh)
+	<-s.doneCh
+	return s.Flush()
+}
+
+// logsOnlySink passes on only the events read from containers' logs, and
+// not synthetic ones such as restart markers and context separators.
+type logsOnlySink struct {
+	Sink
+}
+
+func (s logsOnlySink) Write(event LogEvent) error {
+	if event.Synthetic {
+		return nil
+	}
+	return s.Sink.Write(event)
+}
+
+// MultiSink writes each event to several sinks.
+type MultiSink []Sink
+
+func (sinks MultiSink) Write(event LogEvent) error {
+	var firstErr error
+	for _, sink := range sinks {
+		if err := sink.Write(event); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (sinks MultiSink) Flush() error {
+	var firstErr error
+	for _, sink := range sinks {
+		if err := sink.Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (sinks MultiSink) CloseContainer(cluster string, pod *v1.Pod, container *v1.Container) error {
+	var firstErr error
+	for _, sink := range sinks {
+		if err := closeContainer(sink, cluster, pod, container); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (sinks MultiSink) Close() error {
+	var firstErr error
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// writeRecorder records each call to Write separately.
+type writeRecorder struct {
+	writes []string
+	sync.Mutex
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestResetANSIFormatter(t *testing.T) {
+	format := ResetANSIFormatter(messageFormatter)
+	for _, test := range []struct {
+		message string
+		want    string
+	}{
+		{"plain", "plain\n"},
+		{"\x1b[31mred", "\x1b[31mred" + ansiReset + "\n"},
+	} {
+		var buf bytes.Buffer
+		event := LogEvent{Message: test.message}
+		if err := format(&buf, event); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.want {
+			t.Errorf("%q: got %q, want %q", test.message, buf.String(), test.want)
+		}
+		if event.Message != test.message {
+			t.Errorf("%q: message changed to %q", test.message, event.Message)
+		}
+	}
+}
+
+func TestWriterSink_Concurrent(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	// Write the line in pieces, as templates do
+	format := func(w io.Writer, event LogEvent) error {
+		if _, err := io.WriteString(w, event.Container.Name+" "); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, event.Message+"\n")
+		return err
+	}
+	out := &writeRecorder{}
+	sink := NewWriterSink(out, format)
+	var wg sync.WaitGroup
+	for _, container := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func(container string) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				_ = sink.Write(testEvent(pod, container, time.Now(), fmt.Sprint(i)))
+			}
+		}(container)
+	}
+	wg.Wait()
+
+	if len(out.writes) != 300 {
+		t.Fatalf("got %d writes, want 300", len(out.writes))
+	}
+	for _, line := range out.writes {
+		if fields := strings.Fields(line); len(fields) != 2 || !strings.HasSuffix(line, "\n") {
+			t.Fatalf("got partial write %q", line)
+		}
+	}
+}
+
+func TestSink_Shutdown(t *testing.T) {
+	logs, synthetic := &recordingSink{}, &recordingSink{}
+	sink := NewMergeBuffer(time.Hour, MultiSink{synthetic, logsOnlySink{logs}})
+	ctx, cancel := context.WithCancel(context.Background())
+	clientset, _ := newFakeClientset(podWithContainers("app"))
+	ctl := NewControllerWithOptions(clientset, WithEventFunc(func(event LogEvent) {
+		_ = sink.Write(event)
+		if event.Message == "b" {
+			cancel()
+		}
+	}))
+	t0 := time.Now()
+	ctl.logStream = (&fakeLogs{current: []string{logLine(t0, "a") + logLine(t0.Add(time.Second), "b")}}).stream
+
+	tailersDone := make(chan struct{})
+	go func() {
+		defer close(tailersDone)
+		ctl.Run(ctx)
+	}()
+	drain(ctx, tailersDone, time.Second, func() {
+		// Events still buffered are written out by Close
+		if got := logs.String(); got != "" {
+			t.Errorf("got %q written before closing, want none", got)
+		}
+		if err := sink.Close(); err != nil {
+			t.Error(err)
+		}
+	}, func(warning string) { t.Errorf("unexpected warning: %s", warning) })
+
+	for _, s := range []*recordingSink{logs, synthetic} {
+		if got := s.String(); got != "a b" {
+			t.Errorf("got %q written, want %q", got, "a b")
+		}
+		if s.flushes == 0 || !s.closed {
+			t.Errorf("got %d flushes and closed %v, want flushed and closed", s.flushes, s.closed)
+		}
+	}
+}
+
+func TestHighlightFormatter(t *testing.T) {
+	defer func(noColor bool) { color.NoColor = noColor }(color.NoColor)
+	color.NoColor = false
+	on, off := "\x1b[7m", "\x1b[0m"
+	for _, test := range []struct {
+		patterns []string
+		message  string
+		want     string
+	}{
+		{[]string{"timeout|panic"}, "no match", "no match"},
+		{[]string{"timeout|panic"}, "read timeout", "read " + on + "timeout" + off},
+		{[]string{"timeout|panic"}, "panic after timeout", on + "panic" + off + " after " + on + "timeout" + off},
+		{[]string{"time", "meout"}, "timeout", on + "timeout" + off},
+		{[]string{"time", "out"}, "timeout!", on + "timeout" + off + "!"},
+		{[]string{"timeout", "me"}, "a timeout", "a " + on + "timeout" + off},
+		{[]string{"x*"}, "empty matches", "empty matches"},
+	} {
+		format := HighlightFormatter(patterns(test.patterns...), FormatOptions{Colors: true}, messageFormatter)
+		var buf bytes.Buffer
+		if err := format(&buf, LogEvent{Message: test.message}); err != nil {
+			t.Fatal(err)
+		}
+		if want := test.want + "\n"; buf.String() != want {
+			t.Errorf("%q in %q: got %q, want %q", test.patterns, test.message, buf.String(), want)
+		}
+	}
+
+	for _, test := range []struct {
+		name    string
+		options FormatOptions
+		noColor bool
+	}{
+		{"--no-color", FormatOptions{Colors: true}, true},
+		{"colors off", FormatOptions{Colors: false}, false},
+	} {
+		color.NoColor = test.noColor
+		format := HighlightFormatter(patterns("timeout"), test.options, messageFormatter)
+		var buf bytes.Buffer
+		if err := format(&buf, LogEvent{Message: "read timeout"}); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != "read timeout\n" {
+			t.Errorf("%s: got %q, want no highlighting", test.name, buf.String())
+		}
+	}
+}
+
+func TestWriterSink_Flushing(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	written := func(out *writeRecorder) string {
+		out.Lock()
+		defer out.Unlock()
+		return strings.Join(out.writes, "")
+	}
+
+	// Line-buffered: each line is written out at once
+	out := &writeRecorder{}
+	sink := NewWriterSink(out, messageFormatter)
+	for _, test := range []struct{ message, want string }{{"a", "a\n"}, {"b", "a\nb\n"}} {
+		if err := sink.Write(testEvent(pod, "app", time.Now(), test.message)); err != nil {
+			t.Fatal(err)
+		}
+		if got := written(out); got != test.want {
+			t.Errorf("%s: got %q written, want %q", test.message, got, test.want)
+		}
+	}
+
+	// Batched: lines are written out every interval, and on close
+	out = &writeRecorder{}
+	sink = NewBufferedWriterSink(out, messageFormatter, 50*time.Millisecond)
+	for _, message := range []string{"a", "b"} {
+		if err := sink.Write(testEvent(pod, "app", time.Now(), message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := written(out); got != "" {
+		t.Errorf("got %q written at once, want it batched", got)
+	}
+	waitFor(t, "the batch to be flushed", func() bool { return written(out) == "a\nb\n" })
+	if n := len(out.writes); n != 1 {
+		t.Errorf("got %d writes for the batch, want 1", n)
+	}
+	if err := sink.Write(testEvent(pod, "app", time.Now(), "c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := written(out); got != "a\nb\nc\n" {
+		t.Errorf("got %q written after closing, want the last line flushed", got)
+	}
+}
+
+func TestWriterSink_SeparatePods(t *testing.T) {
+	ts := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	pods := map[string]*v1.Pod{}
+	for _, name := range []string{"a", "b"} {
+		pods[name] = &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+	}
+	// Each line is written by the pod it names; "east:a" is pod a in
+	// another cluster
+	for _, test := range []struct {
+		lines    []string
+		separate bool
+		want     string
+	}{
+		{[]string{"a", "a", "b", "b", "a"}, true, "a a | b b | a"},
+		{[]string{"a", "a", "b", "b", "a"}, false, "a a b b a"},
+		{[]string{"a", "b", "a", "b"}, true, "a b a b"},
+		{[]string{"a", "b", "b", "a", "a", "a"}, true, "a b b | a a a"},
+		{[]string{"a", "a", "a"}, true, "a a a"},
+		{[]string{"a", "a", "east:a", "east:a", "a"}, true, "a a | east:a east:a | a"},
+	} {
+		var buf bytes.Buffer
+		sink := NewWriterSink(&buf, messageFormatter)
+		if test.separate {
+			sink.SeparatePods()
+		}
+		for _, line := range test.lines {
+			event := testEvent(pods[line[strings.Index(line, ":")+1:]], "app", ts, line)
+			if i := strings.Index(line, ":"); i >= 0 {
+				event.Cluster = line[:i]
+			}
+			if err := sink.Write(event); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := strings.Replace(strings.TrimSuffix(buf.String(), "\n"), "\n\n", " | ", -1)
+		got = strings.Replace(got, "\n", " ", -1)
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.lines, got, test.want)
+		}
+	}
+}
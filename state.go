@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// stateSaveInterval is how often the state file is written while tailing.
+const stateSaveInterval = 5 * time.Second
+
+// stateRetention is how long the position of a container is kept after its
+// last line. This forgets pods that were deleted while ktail wasn't running.
+const stateRetention = 7 * 24 * time.Hour
+
+// StateFile persists the timestamp of the last line read from each
+// container, so that a later run can resume where this one stopped.
+type StateFile struct {
+	path      string
+	positions map[string]time.Time
+	dirty     bool
+	stopCh    chan struct{}
+	doneCh    chan struct{}
+	sync.Mutex
+}
+
+type stateFileContents struct {
+	Positions map[string]time.Time `json:"positions"`
+}
+
+// OpenStateFile reads the state file at the path, if it exists, and starts
+// saving it periodically. A state file that can't be read is reported
+// through the returned error, but still returns a usable, empty state.
+func OpenStateFile(path string) (*StateFile, error) {
+	state := &StateFile{
+		path:      path,
+		positions: map[string]time.Time{},
+		stopCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+	go state.run()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	var contents stateFileContents
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return state, fmt.Errorf("Ignoring invalid state file %s: %s", path, err)
+	}
+	cutoff := time.Now().Add(-stateRetention)
+	for key, t := range contents.Positions {
+		if t.After(cutoff) {
+			state.positions[key] = t
+		}
+	}
+	state.dirty = len(state.positions) < len(contents.Positions)
+	return state, nil
+}
+
+// Position returns the timestamp of the last line read from the container,
+// or nil if unknown.
+func (s *StateFile) Position(pod *v1.Pod, container *v1.Container) *time.Time {
+	s.Lock()
+	defer s.Unlock()
+	if t, ok := s.positions[buildKey(pod, container)]; ok {
+		return &t
+	}
+	return nil
+}
+
+// Record advances the position of the event's container.
+func (s *StateFile) Record(event LogEvent) {
+	if event.Timestamp == nil {
+		return
+	}
+	key := buildKey(event.Pod, event.Container)
+
+	s.Lock()
+	defer s.Unlock()
+	if t, ok := s.positions[key]; !ok || event.Timestamp.After(t) {
+		s.positions[key] = *event.Timestamp
+		s.dirty = true
+	}
+}
+
+// Forget removes the positions of the pod's containers, once the pod has
+// been deleted.
+func (s *StateFile) Forget(pod *v1.Pod) {
+	prefix := fmt.Sprintf("%s/%s/%s/", pod.Namespace, pod.Name, pod.UID)
+
+	s.Lock()
+	defer s.Unlock()
+	for key := range s.positions {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.positions, key)
+			s.dirty = true
+		}
+	}
+}
+
+// Close stops the periodic saving and saves the state.
+func (s *StateFile) Close() error {
+	close(s.stopCh)
+	<-s.doneCh
+	return s.save()
+}
+
+func (s *StateFile) run() {
+	defer close(s.doneCh)
+
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}
+}
+
+// save writes the state if it has changed. The file is replaced atomically,
+// so it is never left half-written.
+func (s *StateFile) save() error {
+	s.Lock()
+	if !s.dirty {
+		s.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(stateFileContents{Positions: s.positions})
+	s.dirty = false
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ktail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	now := time.Now().UTC().Truncate(time.Second)
+	pod := func(name string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID("uid-" + name)}}
+	}
+	app := &v1.Container{Name: "app"}
+	web, old, deleted := pod("web"), pod("old"), pod("deleted")
+	data, _ := json.Marshal(stateFileContents{Positions: map[string]time.Time{
+		buildKey(web, app):     now.Add(-time.Hour),
+		buildKey(old, app):     now.Add(-stateRetention - time.Hour),
+		buildKey(deleted, app): now.Add(-time.Minute),
+	}})
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := OpenStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Record(testEvent(web, "app", now, "newer"))
+	state.Record(testEvent(web, "app", now.Add(-time.Minute), "older"))
+	state.Forget(deleted)
+	if err := state.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = OpenStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	for _, test := range []struct {
+		pod  *v1.Pod
+		want *time.Time
+	}{
+		{web, &now},
+		{old, nil},
+		{deleted, nil},
+	} {
+		got := state.Position(test.pod, app)
+		if (got == nil) != (test.want == nil) || (got != nil && !got.Equal(*test.want)) {
+			t.Errorf("got position %v for %s, want %v", got, test.pod.Name, test.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Stats counts what happened during a session, for the summary on exit.
+type Stats struct {
+	lines      int64 // First for 64-bit alignment of atomic ops
+	dropped    int64
+	errors     int64
+	containers int64
+	pods       map[string]bool
+	sync.Mutex
+}
+
+func NewStats() *Stats {
+	return &Stats{pods: map[string]bool{}}
+}
+
+// Instrument wraps the callbacks so that they update the stats.
+func (s *Stats) Instrument(callbacks Callbacks) Callbacks {
+	onEnter, onError, onDrop := callbacks.OnEnter, callbacks.OnError, callbacks.OnDrop
+	callbacks.OnEnter = func(pod *v1.Pod, container *v1.Container, initialAddPhase bool) bool {
+		if !onEnter(pod, container, initialAddPhase) {
+			return false
+		}
+		atomic.AddInt64(&s.containers, 1)
+		s.Lock()
+		s.pods[string(pod.UID)] = true
+		s.Unlock()
+		return true
+	}
+	callbacks.OnError = func(pod *v1.Pod, container *v1.Container, err error) {
+		atomic.AddInt64(&s.errors, 1)
+		onError(pod, container, err)
+	}
+	callbacks.OnDrop = func(pod *v1.Pod, container *v1.Container) {
+		atomic.AddInt64(&s.dropped, 1)
+		if onDrop != nil {
+			onDrop(pod, container)
+		}
+	}
+	return callbacks
+}
+
+// AddLine counts a line that was written.
+func (s *Stats) AddLine() {
+	atomic.AddInt64(&s.lines, 1)
+}
+
+// String returns a one-line summary.
+func (s *Stats) String() string {
+	s.Lock()
+	pods := len(s.pods)
+	s.Unlock()
+	return fmt.Sprintf("Tailed %d containers in %d pods: %d lines, %d dropped, %d errors",
+		atomic.LoadInt64(&s.containers), pods, atomic.LoadInt64(&s.lines),
+		atomic.LoadInt64(&s.dropped), atomic.LoadInt64(&s.errors))
+}
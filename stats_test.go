@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestStats(t *testing.T) {
+	stats := NewStats()
+	callbacks := stats.Instrument(Callbacks{
+		OnEnter: func(pod *v1.Pod, container *v1.Container, initialAddPhase bool) bool {
+			return container.Name != "skipped"
+		},
+		OnError: func(*v1.Pod, *v1.Container, error) {},
+	})
+	pod1 := &v1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "1"}}
+	pod2 := &v1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "2"}}
+	for _, enter := range []struct {
+		pod       *v1.Pod
+		container string
+	}{{pod1, "app"}, {pod1, "sidecar"}, {pod1, "skipped"}, {pod2, "app"}} {
+		callbacks.OnEnter(enter.pod, &v1.Container{Name: enter.container}, true)
+	}
+	callbacks.OnDrop(pod1, &v1.Container{Name: "app"})
+	callbacks.OnError(pod2, &v1.Container{Name: "app"}, nil)
+	stats.AddLine()
+	stats.AddLine()
+
+	want := "Tailed 3 containers in 2 pods: 2 lines, 1 dropped, 1 errors"
+	if got := stats.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
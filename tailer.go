@@ -2,9 +2,12 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jpillora/backoff"
@@ -19,56 +22,319 @@ type LogEvent struct {
 	Container *v1.Container
 	Timestamp *time.Time
 	Message   string
+
+	// Copied from the pod and container for convenience.
+	Node           string
+	Labels         map[string]string
+	PodIP          string
+	ContainerImage string
+
+	// ContainerImageID is the image the container is running, as resolved
+	// by the node, usually including its digest.
+	ContainerImageID string
+
+	// Cluster is the name of the context the pod was found through, when
+	// tailing several at once.
+	Cluster string
+
+	// Synthetic is set for events generated by ktail, such as restart
+	// markers, rather than read from the container's logs.
+	Synthetic bool
 }
 
 type LogEventFunc func(LogEvent)
 
+// TailOptions controls how a tailer requests logs and recovers from errors.
+type TailOptions struct {
+	// RetryMin and RetryMax bound the exponential backoff between
+	// reconnection attempts. Zero values use the backoff defaults.
+	RetryMin time.Duration
+	RetryMax time.Duration
+
+	// SinceSeconds, if set, requests history going back this many seconds
+	// when a tailer has no start timestamp of its own.
+	SinceSeconds *int64
+
+	// SinceTime, if set, requests history starting at this time for
+	// containers that are already running when ktail starts.
+	SinceTime *time.Time
+
+	// TailLines, if set, limits the initial backlog of each container to
+	// this many lines. It is not applied when reconnecting.
+	TailLines *int64
+
+	// Previous, if set, first shows the logs of the previous instance of a
+	// restarted container, then follows the current instance.
+	Previous bool
+
+	// NotReadyRetries is how many times a request for logs that are not
+	// available yet is retried quietly before it is reported as an error.
+	// Zero retries quietly forever. It also bounds the retries for a pod
+	// that isn't found, after which the pod is taken to be gone.
+	NotReadyRetries int
+
+	// NoFollow, if set, makes each tailer return once it has read the
+	// container's existing logs, instead of following new lines.
+	NoFollow bool
+
+	// BufferSize, if positive, is how many lines are buffered between
+	// reading a container's logs and the event function, so that a slow
+	// consumer doesn't stall reading. When the buffer is full, the oldest
+	// line is dropped.
+	BufferSize int
+
+	// RateLimit, if positive, is how many lines per second are passed on
+	// for each container, allowing bursts of up to a second's worth. Lines
+	// beyond the limit are suppressed, and their number is reported with a
+	// synthetic event.
+	RateLimit float64
+
+	// ReadTimeout, if positive, is how long a stream may go without
+	// receiving data before it is considered stalled, closed and reopened.
+	ReadTimeout time.Duration
+}
+
+// logStreamFunc opens a stream of a pod's logs.
+type logStreamFunc func(pod *v1.Pod, options *v1.PodLogOptions) (io.ReadCloser, error)
+
+// clientsetLogStream returns a logStreamFunc that requests logs from the
+// API server.
+func clientsetLogStream(clientset kubernetes.Interface) logStreamFunc {
+	return func(pod *v1.Pod, options *v1.PodLogOptions) (io.ReadCloser, error) {
+		return clientset.Core().Pods(pod.Namespace).GetLogs(pod.Name, options).Stream()
+	}
+}
+
+// errReadTimeout is returned by runStream when a stream stalled.
+var errReadTimeout = fmt.Errorf("No data received within the read timeout")
+
+// defaultNotFoundRetries is how many times logs are requested from a pod
+// that isn't found before it is taken to be gone, unless NotReadyRetries is
+// set.
+const defaultNotFoundRetries = 3
+
+func notFoundRetries(notReadyRetries int) int {
+	if notReadyRetries > 0 {
+		return notReadyRetries
+	}
+	return defaultNotFoundRetries
+}
+
 func NewContainerTailer(
-	clientset *kubernetes.Clientset,
+	clientset kubernetes.Interface,
 	pod v1.Pod,
 	container v1.Container,
 	eventFunc LogEventFunc,
-	fromTimestamp *time.Time) *ContainerTailer {
+	fromTimestamp *time.Time,
+	options TailOptions) *ContainerTailer {
+	var events chan LogEvent
+	if options.BufferSize > 0 {
+		events = make(chan LogEvent, options.BufferSize)
+	}
+	var limiter *rateLimiter
+	if options.RateLimit > 0 {
+		limiter = newRateLimiter(options.RateLimit)
+	}
 	return &ContainerTailer{
-		clientset:     clientset,
+		openStream:    clientsetLogStream(clientset),
 		pod:           pod,
 		container:     container,
 		eventFunc:     eventFunc,
 		fromTimestamp: fromTimestamp,
-		errorBackoff:  &backoff.Backoff{},
+		tailLines:     options.TailLines,
+		exited:        hasExited(pod, container),
+		options:       options,
+		startedAt:     time.Now(),
+		lastActivity:  time.Now().UnixNano(),
+		events:        events,
+		limiter:       limiter,
+		stopCh:        make(chan struct{}),
+		errorBackoff: &backoff.Backoff{
+			Min:    options.RetryMin,
+			Max:    options.RetryMax,
+			Factor: 2,
+			Jitter: true,
+		},
 	}
 }
 
 type ContainerTailer struct {
-	clientset     *kubernetes.Clientset
+	dropped       int64 // First for 64-bit alignment of atomic ops
+	lastActivity  int64 // Unix nanoseconds
+	linesRead     int64
+	bytesRead     int64
+	openStream    logStreamFunc
 	pod           v1.Pod
 	container     v1.Container
-	stop          bool
 	eventFunc     LogEventFunc
 	fromTimestamp *time.Time
+	lastTimestamp *time.Time
+	atLast        int  // Lines received with lastTimestamp
+	catchingUp    bool // Dropping lines already received, on a new stream
+	skipAtLast    int  // Lines at lastTimestamp still to drop while catching up
+	tailLines     *int64
+	exited        bool
+	options       TailOptions
+	startedAt     time.Time
 	errorBackoff  *backoff.Backoff
+	events        chan LogEvent
+	onDrop        func() // Called for each dropped line, if set
+	onReconnect   func() // Called when a stream is opened after an error, if set
+	limiter       *rateLimiter
+	suppressed    int64
+	suppressedAt  time.Time // When the first line since the last report was suppressed
+	stopCh        chan struct{}
+	stopOnce      sync.Once
+	stream        io.ReadCloser
+	sync.Mutex
 }
 
+// Stop makes Run return as soon as possible, interrupting any stream that
+// is currently being read. It may be called before Run, and more than once.
 func (ct *ContainerTailer) Stop() {
-	ct.stop = true
+	ct.stopOnce.Do(func() {
+		close(ct.stopCh)
+	})
+
+	ct.Lock()
+	defer ct.Unlock()
+	if ct.stream != nil {
+		_ = ct.stream.Close()
+	}
+}
+
+func (ct *ContainerTailer) stopped() bool {
+	select {
+	case <-ct.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for the duration, returning false if the tailer was stopped
+// in the meantime.
+func (ct *ContainerTailer) sleep(d time.Duration) bool {
+	select {
+	case <-ct.stopCh:
+		return false
+	case <-time.After(d):
+		return true
+	}
 }
 
+// Run streams the container's logs until the tailer is stopped or the
+// container goes away, reconnecting with exponential backoff on errors. If
+// the tailer has already been stopped, Run returns immediately.
 func (ct *ContainerTailer) Run(onError func(err error)) {
+	if ct.stopped() {
+		return
+	}
+
+	if ct.events != nil {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for event := range ct.events {
+				ct.eventFunc(event)
+			}
+		}()
+		defer func() {
+			close(ct.events)
+			<-done
+		}()
+	}
+	if ct.limiter != nil {
+		defer ct.reportSuppressed()
+	}
+
+	if ct.options.Previous && ct.hasRestarted() {
+		ct.runPrevious(onError)
+	}
+
 	ct.errorBackoff.Reset()
-	for !ct.stop {
+	failed := false
+	for !ct.stopped() {
 		stream, err := ct.getStream()
 		if err != nil {
-			time.Sleep(ct.errorBackoff.Duration())
+			if !ct.sleep(ct.errorBackoff.Duration()) {
+				break
+			}
 			onError(err)
+			failed = true
 			continue
 		}
 		if stream == nil {
 			break
 		}
-		if err := ct.runStream(stream); err != nil {
+		if failed {
+			failed = false
+			if ct.onReconnect != nil {
+				ct.onReconnect()
+			}
+		}
+		if err := ct.runStream(stream); err == errReadTimeout {
+			// Quiet containers time out too, so this is not an error.
+			// Reconnecting at once is only reported as a reconnect.
+			failed = true
+		} else if err != nil {
+			if ct.stopped() {
+				break
+			}
 			onError(err)
-			time.Sleep(ct.errorBackoff.Duration())
+			failed = true
+			ct.sleep(ct.errorBackoff.Duration())
+		} else if ct.options.NoFollow || ct.exited {
+			break
+		}
+	}
+}
+
+// hasExited returns true if the container had terminated when the pod was
+// observed. Its logs are then read once instead of followed.
+func hasExited(pod v1.Pod, container v1.Container) bool {
+	status := findContainerStatus(&pod, &container)
+	return status != nil && status.State.Terminated != nil
+}
+
+func (ct *ContainerTailer) hasRestarted() bool {
+	for _, status := range ct.pod.Status.ContainerStatuses {
+		if status.Name == ct.container.Name {
+			return status.RestartCount > 0
+		}
+	}
+	return false
+}
+
+// runPrevious dumps the logs of the container's previous instance. The
+// current instance is then read as if runPrevious hadn't run: from the
+// tailer's own start timestamp, and with the same TailLines, so that the
+// previous instance's last lines don't hide the current one's history.
+func (ct *ContainerTailer) runPrevious(onError func(err error)) {
+	fromTimestamp, lastTimestamp, atLast, tailLines := ct.fromTimestamp, ct.lastTimestamp, ct.atLast, ct.tailLines
+	defer func() {
+		ct.fromTimestamp, ct.lastTimestamp, ct.atLast, ct.tailLines = fromTimestamp, lastTimestamp, atLast, tailLines
+	}()
+
+	stream, err := ct.openStream(&ct.pod, &v1.PodLogOptions{
+		Container:  ct.container.Name,
+		Previous:   true,
+		Timestamps: true,
+		TailLines:  ct.tailLines,
+	})
+	if err != nil {
+		if status, ok := err.(errors.APIStatus); ok {
+			// No previous instance is available
+			switch status.Status().Code {
+			case http.StatusBadRequest, http.StatusNotFound:
+				return
+			}
 		}
+		onError(err)
+		return
+	}
+	if err := ct.runStream(stream); err != nil && !ct.stopped() {
+		onError(err)
 	}
 }
 
@@ -77,16 +343,53 @@ func (ct *ContainerTailer) runStream(stream io.ReadCloser) error {
 		_ = stream.Close()
 	}()
 
+	ct.Lock()
+	if ct.stopped() {
+		ct.Unlock()
+		return nil
+	}
+	ct.stream = stream
+	ct.Unlock()
+	defer func() {
+		ct.Lock()
+		ct.stream = nil
+		ct.Unlock()
+	}()
+
+	// The API only honours the since time to the second, so a new stream
+	// may start with lines that have already been received. They are
+	// dropped until the stream gets past the last line received.
+	ct.catchingUp, ct.skipAtLast = ct.lastTimestamp != nil, ct.atLast
+
+	// Closing the stream interrupts a read that is waiting for data
+	var timedOut int32
+	var timer *time.Timer
+	if ct.options.ReadTimeout > 0 {
+		timer = time.AfterFunc(ct.options.ReadTimeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			_ = stream.Close()
+		})
+		defer timer.Stop()
+	}
+
 	r := bufio.NewReader(stream)
 	for {
 		line, err := r.ReadString('\n')
+		if atomic.LoadInt32(&timedOut) == 1 {
+			return errReadTimeout
+		}
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			return err
 		}
+		if timer != nil {
+			timer.Reset(ct.options.ReadTimeout)
+		}
+		atomic.StoreInt64(&ct.lastActivity, time.Now().UnixNano())
 		ct.errorBackoff.Reset()
+		ct.tailLines = nil
 		ct.receiveLine(line)
 	}
 	return nil
@@ -108,37 +411,140 @@ func (ct *ContainerTailer) receiveLine(s string) {
 
 	var timestamp *time.Time
 	if t, err := time.Parse(time.RFC3339Nano, parts[0]); err == nil {
+		if ct.catchingUp {
+			if t.Before(*ct.lastTimestamp) {
+				return
+			}
+			if t.Equal(*ct.lastTimestamp) && ct.skipAtLast > 0 {
+				ct.skipAtLast--
+				return
+			}
+			ct.catchingUp = false
+		}
+		if ct.lastTimestamp != nil && t.Equal(*ct.lastTimestamp) {
+			ct.atLast++
+		} else {
+			ct.atLast = 1
+		}
 		timestamp = &t
+		ct.lastTimestamp = &t
 
-		// On restart, start from this timestamp. This isn't exact, however.
-		nextTimestamp := t.Add(time.Millisecond * 1)
-		ct.fromTimestamp = &nextTimestamp
+		// On restart, start from this timestamp
+		ct.fromTimestamp = &t
 	}
+	atomic.AddInt64(&ct.linesRead, 1)
+	atomic.AddInt64(&ct.bytesRead, int64(len(parts[1])))
 
-	ct.eventFunc(LogEvent{
-		Pod:       &ct.pod,
-		Container: &ct.container,
-		Timestamp: timestamp,
-		Message:   parts[1],
-	})
+	if ct.limiter != nil {
+		now := time.Now()
+		if !ct.limiter.allow(now) {
+			if ct.suppressed == 0 {
+				ct.suppressedAt = now
+			}
+			ct.suppressed++
+			if now.Sub(ct.suppressedAt) >= suppressedReportInterval {
+				ct.reportSuppressed()
+			}
+			return
+		}
+		ct.reportSuppressed()
+	}
+
+	ct.deliver(ct.newEvent(timestamp, parts[1]))
+}
+
+func (ct *ContainerTailer) newEvent(timestamp *time.Time, message string) LogEvent {
+	return LogEvent{
+		Pod:            &ct.pod,
+		Container:      &ct.container,
+		Timestamp:      timestamp,
+		Message:        message,
+		Node:           ct.pod.Spec.NodeName,
+		Labels:         ct.pod.Labels,
+		PodIP:          ct.pod.Status.PodIP,
+		ContainerImage: ct.container.Image,
+
+		ContainerImageID: containerImageID(&ct.pod, &ct.container),
+	}
+}
+
+// reportSuppressed delivers a synthetic event with the number of lines
+// suppressed by rate limiting since the last report, if any.
+func (ct *ContainerTailer) reportSuppressed() {
+	if ct.suppressed == 0 {
+		return
+	}
+	now := time.Now()
+	event := ct.newEvent(&now, formatSuppressed(ct.suppressed))
+	event.Synthetic = true
+	ct.deliver(event)
+	ct.suppressed = 0
+}
+
+// deliver passes the event to the event function, through the buffer if
+// there is one. If the buffer is full, the oldest line in it is dropped.
+func (ct *ContainerTailer) deliver(event LogEvent) {
+	if ct.events == nil {
+		ct.eventFunc(event)
+		return
+	}
+	for {
+		select {
+		case ct.events <- event:
+			return
+		default:
+		}
+		select {
+		case <-ct.events:
+			atomic.AddInt64(&ct.dropped, 1)
+			if ct.onDrop != nil {
+				ct.onDrop()
+			}
+		default:
+		}
+	}
+}
+
+// idleTime returns how long it has been since the tailer started or last
+// received a line.
+func (ct *ContainerTailer) idleTime(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&ct.lastActivity)))
+}
+
+// Counts returns the number of lines read so far, and the number of bytes
+// in their messages. This includes lines that were then dropped, rate
+// limited or filtered out.
+func (ct *ContainerTailer) Counts() (linesRead, bytesRead int64) {
+	return atomic.LoadInt64(&ct.linesRead), atomic.LoadInt64(&ct.bytesRead)
+}
+
+// DroppedLines returns the number of lines dropped because the buffer was
+// full.
+func (ct *ContainerTailer) DroppedLines() int64 {
+	return atomic.LoadInt64(&ct.dropped)
 }
 
 func (ct *ContainerTailer) getStream() (io.ReadCloser, error) {
 	var sinceTime *metav1.Time
+	var sinceSeconds *int64
 	if ct.fromTimestamp != nil {
 		sinceTime = &metav1.Time{
 			Time: *ct.fromTimestamp,
 		}
+	} else {
+		sinceSeconds = ct.options.SinceSeconds
 	}
 
 	boff := &backoff.Backoff{}
-	for {
-		stream, err := ct.clientset.Core().Pods(ct.pod.Namespace).GetLogs(ct.pod.Name, &v1.PodLogOptions{
-			Container:  ct.container.Name,
-			Follow:     true,
-			Timestamps: true,
-			SinceTime:  sinceTime,
-		}).Stream()
+	for attempts := 1; !ct.stopped(); attempts++ {
+		stream, err := ct.openStream(&ct.pod, &v1.PodLogOptions{
+			Container:    ct.container.Name,
+			Follow:       !ct.options.NoFollow && !ct.exited,
+			Timestamps:   true,
+			SinceTime:    sinceTime,
+			SinceSeconds: sinceSeconds,
+			TailLines:    ct.tailLines,
+		})
 		if err == nil {
 			return stream, nil
 		}
@@ -146,12 +552,22 @@ func (ct *ContainerTailer) getStream() (io.ReadCloser, error) {
 			// This will happen if the pod isn't ready for log-reading yet
 			switch status.Status().Code {
 			case http.StatusBadRequest:
-				time.Sleep(boff.Duration())
+				if ct.options.NotReadyRetries > 0 && attempts >= ct.options.NotReadyRetries {
+					return nil, err
+				}
+				ct.sleep(boff.Duration())
 				continue
 			case http.StatusNotFound:
-				return nil, nil
+				// The pod may not be visible to the kubelet yet. If it stays
+				// missing, it is taken to be gone.
+				if attempts >= notFoundRetries(ct.options.NotReadyRetries) {
+					return nil, nil
+				}
+				ct.sleep(boff.Duration())
+				continue
 			}
 		}
 		return nil, err
 	}
+	return nil, nil
 }
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// fakeLogs serves canned log streams to a tailer, and records the options
+// of each request.
+type fakeLogs struct {
+	previous string
+	current  []string // One per request; the last one is repeated
+	requests []v1.PodLogOptions
+	sync.Mutex
+}
+
+func (f *fakeLogs) stream(pod *v1.Pod, options *v1.PodLogOptions) (io.ReadCloser, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, *options)
+	if options.Previous {
+		return ioutil.NopCloser(strings.NewReader(f.previous)), nil
+	}
+	n := len(f.requests) - 1
+	if f.previous != "" {
+		n--
+	}
+	if n >= len(f.current) {
+		n = len(f.current) - 1
+	}
+	return ioutil.NopCloser(strings.NewReader(f.current[n])), nil
+}
+
+func testPod(restarts int32) v1.Pod {
+	return v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1", UID: "uid-1"},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app"}}},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			ContainerStatuses: []v1.ContainerStatus{{
+				Name:         "app",
+				RestartCount: restarts,
+				State:        v1.ContainerState{Running: &v1.ContainerStateRunning{}},
+			}},
+		},
+	}
+}
+
+func logLine(t time.Time, message string) string {
+	return t.Format(time.RFC3339Nano) + " " + message + "\n"
+}
+
+// collectMessages returns an event function appending to messages.
+func collectMessages(messages *[]string) LogEventFunc {
+	var mu sync.Mutex
+	return func(event LogEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		*messages = append(*messages, event.Message)
+	}
+}
+
+func TestContainerTailer_Previous(t *testing.T) {
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	tailLines := int64(2)
+	for _, test := range []struct {
+		name      string
+		restarts  int32
+		wantLines []string
+	}{
+		{"restarted", 1, []string{"crashed", "started"}},
+		{"not restarted", 0, []string{"started"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			logs := &fakeLogs{
+				previous: logLine(start.Add(time.Minute), "crashed"),
+				current:  []string{logLine(start.Add(-time.Minute), "started")},
+			}
+			if test.restarts == 0 {
+				logs.previous = ""
+			}
+			var messages []string
+			pod := testPod(test.restarts)
+			from := start.Add(-time.Hour)
+			tailer := NewContainerTailer(nil, pod, pod.Spec.Containers[0], collectMessages(&messages),
+				&from, TailOptions{Previous: true, NoFollow: true, TailLines: &tailLines})
+			tailer.openStream = logs.stream
+			tailer.Run(func(err error) { t.Errorf("unexpected error: %s", err) })
+
+			if strings.Join(messages, ",") != strings.Join(test.wantLines, ",") {
+				t.Errorf("got lines %q, want %q", messages, test.wantLines)
+			}
+			current := logs.requests[len(logs.requests)-1]
+			if current.Previous {
+				t.Fatalf("last request was for the previous instance")
+			}
+			if current.TailLines == nil || *current.TailLines != tailLines {
+				t.Errorf("current instance requested with TailLines %v, want %d", current.TailLines, tailLines)
+			}
+			if current.SinceTime == nil || !current.SinceTime.Time.Equal(from) {
+				t.Errorf("current instance requested since %v, want %s", current.SinceTime, from)
+			}
+		})
+	}
+}
+
+func TestContainerTailer_Reconnect(t *testing.T) {
+	t0 := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	t1, t2 := t0.Add(time.Second), t0.Add(2*time.Second)
+	for _, test := range []struct {
+		name    string
+		streams []string
+		want    []string
+	}{
+		{"equal timestamps in one stream", []string{
+			logLine(t1, "a") + logLine(t1, "a") + logLine(t1, "b") + logLine(t2, "end"),
+		}, []string{"a", "a", "b", "end"}},
+		{"redelivered lines dropped", []string{
+			logLine(t0, "a") + logLine(t1, "b"),
+			logLine(t0, "a") + logLine(t1, "b") + logLine(t2, "end"),
+		}, []string{"a", "b", "end"}},
+		{"new lines at the last timestamp kept", []string{
+			logLine(t1, "a") + logLine(t1, "b"),
+			logLine(t1, "a") + logLine(t1, "b") + logLine(t1, "c") + logLine(t2, "end"),
+		}, []string{"a", "b", "c", "end"}},
+		{"later lines kept after catching up", []string{
+			logLine(t1, "a"),
+			logLine(t1, "a") + logLine(t2, "b") + logLine(t0, "late") + logLine(t2, "end"),
+		}, []string{"a", "b", "late", "end"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var messages []string
+			pod := testPod(0)
+			var tailer *ContainerTailer
+			collect := collectMessages(&messages)
+			tailer = NewContainerTailer(nil, pod, pod.Spec.Containers[0], func(event LogEvent) {
+				collect(event)
+				if event.Message == "end" {
+					tailer.Stop()
+				}
+			}, nil, TailOptions{})
+			tailer.openStream = (&fakeLogs{current: test.streams}).stream
+			tailer.Run(func(err error) { t.Errorf("unexpected error: %s", err) })
+
+			if strings.Join(messages, ",") != strings.Join(test.want, ",") {
+				t.Errorf("got lines %q, want %q", messages, test.want)
+			}
+		})
+	}
+}
+
+func TestContainerTailer_ReadTimeout(t *testing.T) {
+	t0 := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	var requests int
+	stream := func(pod *v1.Pod, options *v1.PodLogOptions) (io.ReadCloser, error) {
+		requests++
+		if requests > 1 {
+			return ioutil.NopCloser(strings.NewReader(logLine(t0, "a") + logLine(t0.Add(time.Second), "end"))), nil
+		}
+		// Send one line, then stall until closed
+		r, w := io.Pipe()
+		go func() {
+			_, _ = io.WriteString(w, logLine(t0, "a"))
+		}()
+		return r, nil
+	}
+
+	var messages []string
+	pod := testPod(0)
+	var tailer *ContainerTailer
+	collect := collectMessages(&messages)
+	tailer = NewContainerTailer(nil, pod, pod.Spec.Containers[0], func(event LogEvent) {
+		collect(event)
+		if event.Message == "end" {
+			tailer.Stop()
+		}
+	}, nil, TailOptions{ReadTimeout: 50 * time.Millisecond})
+	tailer.openStream = stream
+	var reconnects int
+	tailer.onReconnect = func() { reconnects++ }
+	tailer.Run(func(err error) { t.Errorf("unexpected error: %s", err) })
+
+	if want := []string{"a", "end"}; strings.Join(messages, ",") != strings.Join(want, ",") {
+		t.Errorf("got lines %q, want %q", messages, want)
+	}
+	if requests != 2 || reconnects != 1 {
+		t.Errorf("got %d requests and %d reconnects, want 2 and 1", requests, reconnects)
+	}
+}
+
+func TestContainerTailer_Stop(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		beforeRun    bool
+		wantRequests int
+	}{
+		{"before Run", true, 0},
+		{"while streaming", false, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var requests int
+			// Restarted, so that the previous instance is asked for first
+			pod := testPod(1)
+			tailer := NewContainerTailer(nil, pod, pod.Spec.Containers[0], func(LogEvent) {},
+				nil, TailOptions{Previous: true})
+			tailer.openStream = func(pod *v1.Pod, options *v1.PodLogOptions) (io.ReadCloser, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				requests++
+				return blockingLogs(pod, options)
+			}
+			if test.beforeRun {
+				tailer.Stop()
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				tailer.Run(func(err error) { t.Errorf("unexpected error: %s", err) })
+			}()
+			if !test.beforeRun {
+				waitFor(t, "the stream to open", func() bool {
+					tailer.Lock()
+					defer tailer.Unlock()
+					return tailer.stream != nil
+				})
+				tailer.Stop()
+			}
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("Run did not return after Stop")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if requests != test.wantRequests {
+				t.Errorf("got %d requests, want %d", requests, test.wantRequests)
+			}
+		})
+	}
+}
+
+func TestContainerTailer_BufferOrder(t *testing.T) {
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	const count = 200
+	var logs string
+	for i := 0; i < count; i++ {
+		logs += logLine(start.Add(time.Duration(i)*time.Millisecond), fmt.Sprint(i))
+	}
+	for _, test := range []struct {
+		name       string
+		bufferSize int
+	}{
+		{"unbuffered", 0},
+		{"buffered", 5},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var messages []string
+			collect := collectMessages(&messages)
+			pod := testPod(0)
+			tailer := NewContainerTailer(nil, pod, pod.Spec.Containers[0], func(event LogEvent) {
+				// A congested sink, so that a buffer fills up and drops lines
+				time.Sleep(100 * time.Microsecond)
+				collect(event)
+			}, nil, TailOptions{NoFollow: true, BufferSize: test.bufferSize})
+			tailer.openStream = (&fakeLogs{current: []string{logs}}).stream
+			tailer.Run(func(err error) { t.Errorf("unexpected error: %s", err) })
+
+			last := -1
+			for _, message := range messages {
+				n, err := strconv.Atoi(message)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n <= last {
+					t.Fatalf("got line %d after %d", n, last)
+				}
+				last = n
+			}
+			if last != count-1 {
+				t.Errorf("last line was %d, want %d", last, count-1)
+			}
+			if dropped := int(atomic.LoadInt64(&tailer.dropped)); len(messages)+dropped != count {
+				t.Errorf("got %d lines and %d dropped, want %d in all", len(messages), dropped, count)
+			}
+		})
+	}
+}
+
+func TestContainerTailer_Timestamps(t *testing.T) {
+	logs := &fakeLogs{current: []string{"2017-06-01T12:00:00.123456789Z hello world\n"}}
+	var events []LogEvent
+	pod := testPod(0)
+	tailer := NewContainerTailer(nil, pod, pod.Spec.Containers[0], func(event LogEvent) {
+		events = append(events, event)
+	}, nil, TailOptions{NoFollow: true})
+	tailer.openStream = logs.stream
+	tailer.Run(func(err error) { t.Errorf("unexpected error: %s", err) })
+
+	if !logs.requests[0].Timestamps {
+		t.Error("logs were requested without timestamps")
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	want := time.Date(2017, 6, 1, 12, 0, 0, 123456789, time.UTC)
+	if events[0].Timestamp == nil || !events[0].Timestamp.Equal(want) {
+		t.Errorf("got timestamp %v, want %s", events[0].Timestamp, want)
+	}
+	if events[0].Message != "hello world" {
+		t.Errorf("got message %q, want the line without its timestamp", events[0].Message)
+	}
+}
+
+// failingLogs fails the first requests with the errors, then serves the
+// stream.
+type failingLogs struct {
+	errs     []error
+	stream   logStreamFunc
+	requests int
+	sync.Mutex
+}
+
+func (f *failingLogs) open(pod *v1.Pod, options *v1.PodLogOptions) (io.ReadCloser, error) {
+	f.Lock()
+	n := f.requests
+	f.requests++
+	f.Unlock()
+	if n < len(f.errs) {
+		return nil, f.errs[n]
+	}
+	return f.stream(pod, options)
+}
+
+func TestContainerTailer_NotReady(t *testing.T) {
+	t0 := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	notFound := apierrors.NewNotFound(schema.GroupResource{Resource: "pods"}, "web-1")
+	badRequest := apierrors.NewBadRequest("container \"app\" in pod \"web-1\" is waiting to start")
+	for _, test := range []struct {
+		name     string
+		errs     []error
+		retries  int
+		want     string
+		wantErrs int
+	}{
+		{"not found twice", []error{notFound, notFound}, 0, "a,b", 0},
+		{"bad request twice", []error{badRequest, badRequest}, 0, "a,b", 0},
+		{"not found then bad request", []error{notFound, badRequest}, 3, "a,b", 0},
+		{"pod gone", []error{notFound, notFound}, 2, "", 0},
+		{"never ready", []error{badRequest, badRequest}, 2, "", 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var messages []string
+			pod := testPod(0)
+			logs := &failingLogs{
+				errs:   test.errs,
+				stream: (&fakeLogs{current: []string{logLine(t0, "a") + logLine(t0, "b")}}).stream,
+			}
+			tailer := NewContainerTailer(nil, pod, pod.Spec.Containers[0], collectMessages(&messages),
+				nil, TailOptions{NoFollow: true, NotReadyRetries: test.retries})
+			tailer.openStream = logs.open
+			var errs int
+			tailer.Run(func(err error) {
+				errs++
+				tailer.Stop()
+			})
+
+			if got := strings.Join(messages, ","); got != test.want {
+				t.Errorf("got lines %q, want %q", got, test.want)
+			}
+			if errs != test.wantErrs {
+				t.Errorf("got %d errors, want %d", errs, test.wantErrs)
+			}
+		})
+	}
+}
+
+func TestContainerTailer_EventFields(t *testing.T) {
+	t0 := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	pod := testPod(0)
+	pod.Labels = map[string]string{"app": "web"}
+	pod.Spec.NodeName = "node-1"
+	pod.Spec.Containers[0].Image = "web:1.2"
+	pod.Status.PodIP = "10.0.0.5"
+	pod.Status.ContainerStatuses[0].ImageID = "docker://sha256:abc"
+	pod.Status.ContainerStatuses[0].State = v1.ContainerState{Terminated: &v1.ContainerStateTerminated{}}
+
+	var events []LogEvent
+	tailer := NewContainerTailer(nil, pod, pod.Spec.Containers[0], func(event LogEvent) {
+		events = append(events, event)
+	}, nil, TailOptions{})
+	tailer.openStream = (&fakeLogs{current: []string{logLine(t0, "a") + logLine(t0, "b")}}).stream
+	tailer.Run(func(err error) { t.Errorf("unexpected error: %s", err) })
+
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	for _, event := range events {
+		if event.Pod.Name != "web-1" || event.Container.Name != "app" {
+			t.Errorf("got event for %s/%s, want web-1/app", event.Pod.Name, event.Container.Name)
+		}
+		if event.Timestamp == nil || !event.Timestamp.Equal(t0) {
+			t.Errorf("got timestamp %v, want %s", event.Timestamp, t0)
+		}
+		if event.Node != "node-1" {
+			t.Errorf("got node %q, want node-1", event.Node)
+		}
+		if event.Labels["app"] != "web" {
+			t.Errorf("got labels %v, want app=web", event.Labels)
+		}
+		if event.PodIP != "10.0.0.5" {
+			t.Errorf("got pod IP %q, want 10.0.0.5", event.PodIP)
+		}
+		if event.ContainerImage != "web:1.2" {
+			t.Errorf("got image %q, want web:1.2", event.ContainerImage)
+		}
+		if event.ContainerImageID != "docker://sha256:abc" {
+			t.Errorf("got image ID %q, want docker://sha256:abc", event.ContainerImageID)
+		}
+	}
+}
+
+func TestContainerTailer_SlowSink(t *testing.T) {
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	const count, bufferSize = 100, 10
+	var logs string
+	for i := 0; i < count; i++ {
+		logs += logLine(start.Add(time.Duration(i)*time.Millisecond), fmt.Sprint(i))
+	}
+
+	var messages []string
+	collect := collectMessages(&messages)
+	pod := testPod(0)
+	var tailer *ContainerTailer
+	stuck := true
+	tailer = NewContainerTailer(nil, pod, pod.Spec.Containers[0], func(event LogEvent) {
+		if stuck {
+			stuck = false
+			// Reading must go on while the sink is stuck
+			deadline := time.Now().Add(time.Second)
+			for n, _ := tailer.Counts(); n < count && time.Now().Before(deadline); n, _ = tailer.Counts() {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		collect(event)
+	}, nil, TailOptions{NoFollow: true, BufferSize: bufferSize})
+	tailer.openStream = (&fakeLogs{current: []string{logs}}).stream
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tailer.Run(func(err error) { t.Errorf("unexpected error: %s", err) })
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("tailer deadlocked behind a slow sink")
+	}
+
+	if n, _ := tailer.Counts(); n != count {
+		t.Errorf("got %d lines read, want %d", n, count)
+	}
+	// At most the line held by the sink, the buffer, and the line being
+	// delivered when the sink got going again are kept
+	dropped := int(tailer.DroppedLines())
+	if dropped < count-bufferSize-2 {
+		t.Errorf("got %d lines dropped, want at least %d", dropped, count-bufferSize-2)
+	}
+	if len(messages)+dropped != count {
+		t.Errorf("got %d lines and %d dropped, want %d in all", len(messages), dropped, count)
+	}
+	if len(messages) > 0 && messages[len(messages)-1] != fmt.Sprint(count-1) {
+		t.Errorf("got last line %s, want %d", messages[len(messages)-1], count-1)
+	}
+}
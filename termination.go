@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// terminationWatcher tracks the pods being tailed, to tell when all of them
+// have terminated.
+type terminationWatcher struct {
+	pods       map[string]bool
+	terminated map[string]bool
+	failed     bool
+	sync.Mutex
+}
+
+func newTerminationWatcher() *terminationWatcher {
+	return &terminationWatcher{pods: map[string]bool{}, terminated: map[string]bool{}}
+}
+
+// add starts tracking a pod. A pod that has already terminated is done at
+// once, in which case add returns the same as observe.
+func (w *terminationWatcher) add(pod *v1.Pod) (done, failed bool) {
+	w.Lock()
+	defer w.Unlock()
+	if w.terminated[string(pod.UID)] {
+		return false, w.failed
+	}
+	w.pods[string(pod.UID)] = true
+	if phase := pod.Status.Phase; phase == v1.PodSucceeded || phase == v1.PodFailed {
+		return w.terminate(pod)
+	}
+	return false, w.failed
+}
+
+// observe processes a pod event. It returns true if the event terminated
+// the last tracked pod, and whether any of the pods did not succeed. A pod
+// deleted before it completed counts as failed.
+func (w *terminationWatcher) observe(event PodEventType, pod *v1.Pod) (done, failed bool) {
+	phase := pod.Status.Phase
+	if event != PodDeleted && phase != v1.PodSucceeded && phase != v1.PodFailed {
+		return false, false
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if !w.pods[string(pod.UID)] {
+		return false, w.failed
+	}
+	return w.terminate(pod)
+}
+
+// terminate stops tracking a pod. The caller must hold the lock.
+func (w *terminationWatcher) terminate(pod *v1.Pod) (done, failed bool) {
+	delete(w.pods, string(pod.UID))
+	w.terminated[string(pod.UID)] = true
+	if pod.Status.Phase != v1.PodSucceeded {
+		w.failed = true
+	}
+	return len(w.pods) == 0, w.failed
+}
+
+// remaining returns the number of tracked pods that have not terminated.
+func (w *terminationWatcher) remaining() int {
+	w.Lock()
+	defer w.Unlock()
+	return len(w.pods)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestTerminationWatcher(t *testing.T) {
+	pod := func(uid string, phase v1.PodPhase) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{UID: types.UID(uid)},
+			Status:     v1.PodStatus{Phase: phase},
+		}
+	}
+	type step struct {
+		add        bool
+		event      PodEventType
+		pod        *v1.Pod
+		wantDone   bool
+		wantFailed bool
+	}
+	for _, test := range []struct {
+		name  string
+		steps []step
+	}{
+		{"all succeeded", []step{
+			{add: true, pod: pod("a", v1.PodRunning)},
+			{add: true, pod: pod("b", v1.PodRunning)},
+			{event: PodUpdated, pod: pod("a", v1.PodSucceeded)},
+			{event: PodUpdated, pod: pod("b", v1.PodSucceeded), wantDone: true},
+		}},
+		{"one failed", []step{
+			{add: true, pod: pod("a", v1.PodRunning)},
+			{add: true, pod: pod("b", v1.PodRunning)},
+			{event: PodUpdated, pod: pod("a", v1.PodFailed), wantFailed: true},
+			{event: PodUpdated, pod: pod("b", v1.PodSucceeded), wantDone: true, wantFailed: true},
+		}},
+		{"deleted while running", []step{
+			{add: true, pod: pod("a", v1.PodRunning)},
+			{event: PodDeleted, pod: pod("a", v1.PodRunning), wantDone: true, wantFailed: true},
+		}},
+		{"untracked pod ignored", []step{
+			{add: true, pod: pod("a", v1.PodRunning)},
+			{event: PodUpdated, pod: pod("b", v1.PodSucceeded)},
+		}},
+		{"terminated when added", []step{
+			{event: PodAdded, pod: pod("a", v1.PodSucceeded)},
+			{add: true, pod: pod("a", v1.PodSucceeded), wantDone: true},
+		}},
+		{"second container of a terminated pod", []step{
+			{add: true, pod: pod("a", v1.PodRunning)},
+			{add: true, pod: pod("b", v1.PodFailed), wantFailed: true},
+			{add: true, pod: pod("b", v1.PodFailed), wantFailed: true},
+			{event: PodUpdated, pod: pod("a", v1.PodSucceeded), wantDone: true, wantFailed: true},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := newTerminationWatcher()
+			for i, s := range test.steps {
+				var done, failed bool
+				if s.add {
+					done, failed = w.add(s.pod)
+				} else {
+					done, failed = w.observe(s.event, s.pod)
+				}
+				if done != s.wantDone || failed != s.wantFailed {
+					t.Errorf("step %d: got done %v, failed %v; want %v, %v",
+						i, done, failed, s.wantDone, s.wantFailed)
+				}
+			}
+		})
+	}
+}
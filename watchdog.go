@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchdogThreshold is how long listing or watching pods must keep failing
+// before it is reported, and how often it is reported again after that.
+const watchdogThreshold = 30 * time.Second
+
+// watchdog observes the list and watch requests of the pod informer. The
+// informer retries failed requests on its own; the watchdog makes prolonged
+// failures, and the recovery from them, visible.
+type watchdog struct {
+	threshold    time.Duration
+	onError      func(err error, failingFor time.Duration)
+	onRecover    func(downtime time.Duration)
+	failingSince time.Time
+	lastReport   time.Time
+	sync.Mutex
+}
+
+// wrap returns a ListWatch that reports to the watchdog.
+func (w *watchdog) wrap(lw *cache.ListWatch) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			obj, err := lw.List(options)
+			w.observe(err)
+			return obj, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			watcher, err := lw.Watch(options)
+			w.observe(err)
+			return watcher, err
+		},
+	}
+}
+
+func (w *watchdog) observe(err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	now := time.Now()
+	if err == nil {
+		if !w.failingSince.IsZero() && !w.lastReport.IsZero() {
+			w.onRecover(now.Sub(w.failingSince))
+		}
+		w.failingSince, w.lastReport = time.Time{}, time.Time{}
+		return
+	}
+
+	if w.failingSince.IsZero() {
+		w.failingSince = now
+	}
+	if now.Sub(w.failingSince) >= w.threshold && now.Sub(w.lastReport) >= w.threshold {
+		w.lastReport = now
+		w.onError(err, now.Sub(w.failingSince))
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	failure := fmt.Errorf("connection refused")
+	for _, test := range []struct {
+		name    string
+		results []error       // Observed in order
+		pause   time.Duration // Between results
+		want    string
+	}{
+		{"brief failure", []error{failure, nil}, 0, ""},
+		{"prolonged failure", []error{failure, failure, failure, nil}, 25 * time.Millisecond, "error,error,recover"},
+		{"success", []error{nil, nil}, 25 * time.Millisecond, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var reports []string
+			w := &watchdog{
+				threshold: 20 * time.Millisecond,
+				onError:   func(error, time.Duration) { reports = append(reports, "error") },
+				onRecover: func(time.Duration) { reports = append(reports, "recover") },
+			}
+			for i, err := range test.results {
+				if i > 0 {
+					time.Sleep(test.pause)
+				}
+				w.observe(err)
+			}
+			if got := strings.Join(reports, ","); got != test.want {
+				t.Errorf("got reports %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+)
+
+// WebhookOptions configures a WebhookSink.
+type WebhookOptions struct {
+	URL     string
+	Headers http.Header
+
+	// BatchSize is the maximum number of events per request.
+	BatchSize int
+
+	// FlushInterval is the longest an event is held before being sent.
+	FlushInterval time.Duration
+
+	// MaxQueue bounds the number of pending events. When full, the oldest
+	// events are dropped.
+	MaxQueue int
+
+	// MaxRetries is how many times a failed request is retried.
+	MaxRetries int
+
+	// Encode serializes a batch into a request body. It defaults to a JSON
+	// array of the objects used by the JSON output format.
+	Encode func(events []LogEvent) ([]byte, error)
+
+	// OnError, if set, is called with the error and the number of events
+	// lost whenever a batch could not be sent, after any retries.
+	OnError func(err error, events int)
+}
+
+// WebhookSink POSTs batches of events as JSON arrays to a URL.
+type WebhookSink struct {
+	options WebhookOptions
+	client  *http.Client
+	queue   []LogEvent
+	dropped int64
+	failed  int64
+	lastErr error
+	readyCh chan struct{}
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+	sendMu  sync.Mutex
+	sync.Mutex
+}
+
+func NewWebhookSink(options WebhookOptions) *WebhookSink {
+	if options.BatchSize <= 0 {
+		options.BatchSize = 100
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = time.Second
+	}
+	if options.MaxQueue <= 0 {
+		options.MaxQueue = 10000
+	}
+	if options.Encode == nil {
+		options.Encode = encodeJSONBatch
+	}
+	s := &WebhookSink{
+		options: options,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		readyCh: make(chan struct{}, 1),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Write queues an event. It never blocks on the network.
+func (s *WebhookSink) Write(event LogEvent) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.queue) >= s.options.MaxQueue {
+		s.queue = s.queue[1:]
+		s.dropped++
+	}
+	s.queue = append(s.queue, event)
+	if len(s.queue) >= s.options.BatchSize {
+		select {
+		case s.readyCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Dropped returns the number of events dropped because the queue was full.
+func (s *WebhookSink) Dropped() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.dropped
+}
+
+// Failed returns the number of events that could not be sent, and the last
+// error.
+func (s *WebhookSink) Failed() (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.failed, s.lastErr
+}
+
+// Flush sends all queued events. Batches are taken and sent under one lock,
+// so that concurrent flushes can't send them out of order. A batch that
+// can't be sent is counted as failed, and the remaining batches are still
+// sent. The first error is returned.
+func (s *WebhookSink) Flush() error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	var firstErr error
+	for {
+		batch := s.take()
+		if len(batch) == 0 {
+			return firstErr
+		}
+		if err := s.send(batch); err != nil {
+			s.Lock()
+			s.failed += int64(len(batch))
+			s.lastErr = err
+			s.Unlock()
+			if s.options.OnError != nil {
+				s.options.OnError(err, len(batch))
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+}
+
+func (s *WebhookSink) Close() error {
+	close(s.stopCh)
+	<-s.doneCh
+	return s.Flush()
+}
+
+func (s *WebhookSink) run() {
+	defer close(s.doneCh)
+
+	ticker := time.NewTicker(s.options.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		case <-s.readyCh:
+		}
+		// Failed batches have already been retried, and are counted
+		_ = s.Flush()
+	}
+}
+
+// take removes and returns the next batch from the queue.
+func (s *WebhookSink) take() []LogEvent {
+	s.Lock()
+	defer s.Unlock()
+
+	n := len(s.queue)
+	if n > s.options.BatchSize {
+		n = s.options.BatchSize
+	}
+	batch := make([]LogEvent, n)
+	copy(batch, s.queue)
+	s.queue = s.queue[n:]
+	return batch
+}
+
+// send POSTs a batch, retrying with backoff on network errors and 5xx
+// responses.
+func (s *WebhookSink) send(batch []LogEvent) error {
+	body, err := s.options.Encode(batch)
+	if err != nil {
+		return err
+	}
+
+	boff := &backoff.Backoff{Jitter: true}
+	for attempt := 0; ; attempt++ {
+		err = s.post(body)
+		if err == nil {
+			return nil
+		}
+		if statusErr, ok := err.(*webhookStatusError); ok && !statusErr.retriable() {
+			return err
+		}
+		if attempt >= s.options.MaxRetries {
+			return err
+		}
+		time.Sleep(boff.Duration())
+	}
+}
+
+func (s *WebhookSink) post(body []byte) error {
+	req, err := http.NewRequest("POST", s.options.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range s.options.Headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return &webhookStatusError{code: resp.StatusCode}
+	}
+	return nil
+}
+
+func encodeJSONBatch(events []LogEvent) ([]byte, error) {
+	batch := make([]jsonEvent, len(events))
+	for i, event := range events {
+		batch[i] = newJSONEvent(event)
+	}
+	return json.Marshal(batch)
+}
+
+type webhookStatusError struct {
+	code int
+}
+
+func (err *webhookStatusError) Error() string {
+	return fmt.Sprintf("Webhook returned status %d", err.code)
+}
+
+func (err *webhookStatusError) retriable() bool {
+	return err.code >= 500
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestWebhookSink_Flush(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	for _, test := range []struct {
+		name       string
+		statuses   []int // Response to each request; the last is repeated
+		wantSent   []string
+		wantFailed int64
+		wantErrors int
+	}{
+		{"all sent", []int{200}, []string{"1", "2", "3", "4", "5"}, 0, 0},
+		{"first batch rejected", []int{400, 200}, []string{"3", "4", "5"}, 2, 1},
+		{"retried", []int{503, 200}, []string{"1", "2", "3", "4", "5"}, 0, 0},
+		{"all rejected", []int{400}, nil, 5, 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var requests int
+			var sent []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				status := test.statuses[len(test.statuses)-1]
+				if requests < len(test.statuses) {
+					status = test.statuses[requests]
+				}
+				requests++
+				if status == 200 {
+					var batch []jsonEvent
+					if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+						t.Errorf("invalid request body: %s", err)
+					}
+					for _, event := range batch {
+						sent = append(sent, event.Message)
+					}
+				}
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			var errors int
+			sink := NewWebhookSink(WebhookOptions{
+				URL:           server.URL,
+				BatchSize:     2,
+				FlushInterval: time.Hour,
+				MaxRetries:    1,
+				OnError:       func(error, int) { errors++ },
+			})
+			for _, message := range []string{"1", "2", "3", "4", "5"} {
+				_ = sink.Write(testEvent(pod, "app", time.Now(), message))
+			}
+			// Batches may be sent before Close, so its error isn't checked
+			_ = sink.Close()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(sent) != len(test.wantSent) {
+				t.Fatalf("got %q sent, want %q", sent, test.wantSent)
+			}
+			for i := range sent {
+				if sent[i] != test.wantSent[i] {
+					t.Fatalf("got %q sent, want %q", sent, test.wantSent)
+				}
+			}
+			if failed, _ := sink.Failed(); failed != test.wantFailed {
+				t.Errorf("got %d failed, want %d", failed, test.wantFailed)
+			}
+			if errors != test.wantErrors {
+				t.Errorf("got %d error callbacks, want %d", errors, test.wantErrors)
+			}
+		})
+	}
+}
+
+func TestWebhookSink_Order(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}}
+	const count = 300
+	var mu sync.Mutex
+	var sent []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var batch []jsonEvent
+		if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+			t.Errorf("invalid request body: %s", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, event := range batch {
+			sent = append(sent, event.Message)
+		}
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(WebhookOptions{
+		URL:           server.URL,
+		BatchSize:     7,
+		FlushInterval: time.Millisecond,
+		MaxRetries:    1,
+	})
+	// Flush from several goroutines at once, as a congested sink would
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+					_ = sink.Flush()
+				}
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		_ = sink.Write(testEvent(pod, "app", time.Now(), fmt.Sprint(i)))
+	}
+	close(stopCh)
+	wg.Wait()
+	_ = sink.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != count {
+		t.Fatalf("got %d lines sent, want %d", len(sent), count)
+	}
+	for i, message := range sent {
+		if message != fmt.Sprint(i) {
+			t.Fatalf("got line %s at position %d", message, i)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	batchv1 "k8s.io/client-go/pkg/apis/batch/v1"
+)
+
+// workloadKinds maps the accepted spellings of a workload kind to its
+// canonical name.
+var workloadKinds = map[string]string{
+	"deployment":   "deployment",
+	"deployments":  "deployment",
+	"deploy":       "deployment",
+	"replicaset":   "replicaset",
+	"replicasets":  "replicaset",
+	"rs":           "replicaset",
+	"statefulset":  "statefulset",
+	"statefulsets": "statefulset",
+	"sts":          "statefulset",
+	"daemonset":    "daemonset",
+	"daemonsets":   "daemonset",
+	"ds":           "daemonset",
+	"job":          "job",
+	"jobs":         "job",
+	"cronjob":      "cronjob",
+	"cronjobs":     "cronjob",
+	"cj":           "cronjob",
+}
+
+// parseWorkloadRef parses an argument such as "deployment/myapp". It returns
+// false if the argument does not name a known workload kind.
+func parseWorkloadRef(arg string) (kind, name string, ok bool) {
+	parts := strings.SplitN(arg, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", false
+	}
+	kind, ok = workloadKinds[strings.ToLower(parts[0])]
+	return kind, parts[1], ok
+}
+
+// resolveWorkloadSelector returns the selector a workload uses to match its
+// pods.
+func resolveWorkloadSelector(
+	clientset kubernetes.Interface,
+	namespace, kind, name string) (labels.Selector, error) {
+	var selector *metav1.LabelSelector
+	switch kind {
+	case "deployment":
+		obj, err := clientset.ExtensionsV1beta1().Deployments(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		selector = obj.Spec.Selector
+	case "replicaset":
+		obj, err := clientset.ExtensionsV1beta1().ReplicaSets(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		selector = obj.Spec.Selector
+	case "statefulset":
+		obj, err := clientset.AppsV1beta1().StatefulSets(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		selector = obj.Spec.Selector
+	case "daemonset":
+		obj, err := clientset.ExtensionsV1beta1().DaemonSets(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		selector = obj.Spec.Selector
+	case "job":
+		obj, err := clientset.BatchV1().Jobs(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		selector = obj.Spec.Selector
+	case "cronjob":
+		jobName, err := latestCronJobJob(clientset, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		return resolveWorkloadSelector(clientset, namespace, "job", jobName)
+	default:
+		return nil, fmt.Errorf("Unsupported workload kind %q", kind)
+	}
+	if selector == nil {
+		return nil, fmt.Errorf("%s/%s has no pod selector", kind, name)
+	}
+	return metav1.LabelSelectorAsSelector(selector)
+}
+
+// latestCronJobJob returns the name of the most recent job created by a
+// cron job, preferring one that is active.
+func latestCronJobJob(clientset kubernetes.Interface, namespace, name string) (string, error) {
+	cronJob, err := clientset.BatchV2alpha1().CronJobs(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if n := len(cronJob.Status.Active); n > 0 {
+		return cronJob.Status.Active[n-1].Name, nil
+	}
+
+	jobs, err := clientset.BatchV1().Jobs(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+	var latest *batchv1.Job
+	for i, job := range jobs.Items {
+		for _, ref := range job.OwnerReferences {
+			if ref.Kind == "CronJob" && ref.UID == cronJob.UID {
+				if latest == nil || job.CreationTimestamp.After(latest.CreationTimestamp.Time) {
+					latest = &jobs.Items[i]
+				}
+				break
+			}
+		}
+	}
+	if latest == nil {
+		return "", fmt.Errorf("cronjob/%s has not created any jobs", name)
+	}
+	return latest.Name, nil
+}
+
+// uniquePodLabels are labels set to a different value on each pod of a
+// workload, and so left out when matching a pod's siblings.
+var uniquePodLabels = map[string]bool{
+	"statefulset.kubernetes.io/pod-name": true,
+}
+
+// podSiblingSelector returns a selector matching the pods that have the same
+// labels as the named pod. If keys are given, only those labels are matched.
+func podSiblingSelector(
+	clientset kubernetes.Interface,
+	namespace, name string, keys []string) (labels.Selector, error) {
+	pod, err := clientset.Core().Pods(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	set := labels.Set{}
+	if len(keys) > 0 {
+		for _, key := range keys {
+			value, ok := pod.Labels[key]
+			if !ok {
+				return nil, fmt.Errorf("Pod %s has no label %q", name, key)
+			}
+			set[key] = value
+		}
+	} else {
+		for key, value := range pod.Labels {
+			if !uniquePodLabels[key] {
+				set[key] = value
+			}
+		}
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("Pod %s has no labels to match other pods by", name)
+	}
+	return labels.SelectorFromSet(set), nil
+}
+
+// andSelectors returns a selector matching only labels matched by both a
+// and b.
+func andSelectors(a, b labels.Selector) (labels.Selector, error) {
+	if a.Empty() {
+		return b, nil
+	}
+	if b.Empty() {
+		return a, nil
+	}
+	return labels.Parse(a.String() + "," + b.String())
+}
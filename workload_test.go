@@ -0,0 +1,243 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	appsv1beta1 "k8s.io/client-go/pkg/apis/apps/v1beta1"
+	batchv1 "k8s.io/client-go/pkg/apis/batch/v1"
+	batchv2alpha1 "k8s.io/client-go/pkg/apis/batch/v2alpha1"
+	extensionsv1beta1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+func TestParseWorkloadRef(t *testing.T) {
+	for _, test := range []struct {
+		arg        string
+		kind, name string
+		ok         bool
+	}{
+		{"deployment/web", "deployment", "web", true},
+		{"Deploy/web", "deployment", "web", true},
+		{"sts/db", "statefulset", "db", true},
+		{"cj/nightly", "cronjob", "nightly", true},
+		{"jobs/migrate", "job", "migrate", true},
+		{"pod/web-1", "", "", false},
+		{"deployment/", "", "", false},
+		{"app=web", "", "", false},
+	} {
+		kind, name, ok := parseWorkloadRef(test.arg)
+		if ok != test.ok || (ok && (kind != test.kind || name != test.name)) {
+			t.Errorf("%q: got %q, %q, %v; want %q, %q, %v", test.arg, kind, name, ok, test.kind, test.name, test.ok)
+		}
+	}
+}
+
+// templateOf returns a pod template with the labels.
+func templateOf(set labels.Set) v1.PodTemplateSpec {
+	return v1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: set}}
+}
+
+func TestResolveWorkloadSelector(t *testing.T) {
+	meta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Namespace: "default", Name: name}
+	}
+	web := labels.Set{"app": "web", "tier": "frontend"}
+	db := labels.Set{"app": "db", "tier": "backend"}
+	agent := labels.Set{"app": "agent"}
+	clientset := fake.NewSimpleClientset(
+		&extensionsv1beta1.Deployment{ObjectMeta: meta("web"), Spec: extensionsv1beta1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Template: templateOf(web),
+		}},
+		&extensionsv1beta1.ReplicaSet{ObjectMeta: meta("web-1234"), Spec: extensionsv1beta1.ReplicaSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web", "tier": "frontend"}},
+			Template: templateOf(web),
+		}},
+		&appsv1beta1.StatefulSet{ObjectMeta: meta("db"), Spec: appsv1beta1.StatefulSetSpec{
+			Selector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "tier", Operator: metav1.LabelSelectorOpIn, Values: []string{"backend"}},
+			}},
+			Template: templateOf(db),
+		}},
+		&extensionsv1beta1.DaemonSet{ObjectMeta: meta("agent"), Spec: extensionsv1beta1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "agent"}},
+			Template: templateOf(agent),
+		}},
+		&extensionsv1beta1.Deployment{ObjectMeta: meta("unselected")},
+	)
+	for _, test := range []struct {
+		kind, name string
+		matches    labels.Set
+		others     []labels.Set
+		notFound   bool
+		wantErr    string
+	}{
+		{kind: "deployment", name: "web", matches: web, others: []labels.Set{db, agent}},
+		{kind: "replicaset", name: "web-1234", matches: web, others: []labels.Set{{"app": "web"}, db}},
+		{kind: "statefulset", name: "db", matches: db, others: []labels.Set{web, agent}},
+		{kind: "daemonset", name: "agent", matches: agent, others: []labels.Set{web, db}},
+		{kind: "deployment", name: "missing", notFound: true},
+		{kind: "deployment", name: "unselected", wantErr: "deployment/unselected has no pod selector"},
+	} {
+		sel, err := resolveWorkloadSelector(clientset, "default", test.kind, test.name)
+		if test.notFound {
+			if !apierrors.IsNotFound(err) {
+				t.Errorf("%s/%s: got error %v, want not found", test.kind, test.name, err)
+			}
+			continue
+		}
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("%s/%s: got error %v, want %q", test.kind, test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s/%s: %s", test.kind, test.name, err)
+			continue
+		}
+		if !sel.Matches(test.matches) {
+			t.Errorf("%s/%s: selector %q doesn't match its pod template's labels", test.kind, test.name, sel)
+		}
+		for _, other := range test.others {
+			if sel.Matches(other) {
+				t.Errorf("%s/%s: selector %q matches %v", test.kind, test.name, sel, other)
+			}
+		}
+	}
+}
+
+func TestResolveWorkloadSelector_Jobs(t *testing.T) {
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	job := func(name string, created time.Time, owner *batchv2alpha1.CronJob) *batchv1.Job {
+		j := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         "default",
+				Name:              name,
+				UID:               types.UID("uid-" + name),
+				CreationTimestamp: metav1.NewTime(created),
+			},
+			Spec: batchv1.JobSpec{Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"controller-uid": "uid-" + name},
+			}},
+		}
+		if owner != nil {
+			j.OwnerReferences = []metav1.OwnerReference{{Kind: "CronJob", Name: owner.Name, UID: owner.UID}}
+		}
+		return j
+	}
+	// Each attempt of a job runs in a pod of its own
+	pod := func(name string, job *batchv1.Job) *v1.Pod {
+		p := podWithContainers("main")
+		p.Name, p.UID = name, types.UID("uid-"+name)
+		p.Labels = map[string]string{"controller-uid": string(job.UID), "job-name": job.Name}
+		p.OwnerReferences = []metav1.OwnerReference{{Kind: "Job", Name: job.Name, UID: job.UID}}
+		return &p
+	}
+	nightly := &batchv2alpha1.CronJob{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default", Name: "nightly", UID: "uid-nightly"}}
+	hourly := &batchv2alpha1.CronJob{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default", Name: "hourly", UID: "uid-hourly"}}
+	hourly.Status.Active = []v1.ObjectReference{{Name: "hourly-1"}}
+	idle := &batchv2alpha1.CronJob{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default", Name: "idle", UID: "uid-idle"}}
+	migrate := job("migrate", start, nil)
+	nightly1 := job("nightly-1", start, nightly)
+	nightly2 := job("nightly-2", start.Add(24*time.Hour), nightly)
+	hourly1 := job("hourly-1", start, hourly)
+	hourly2 := job("hourly-2", start.Add(time.Hour), hourly)
+	clientset := fake.NewSimpleClientset(
+		nightly, hourly, idle, migrate, nightly1, nightly2, hourly1, hourly2,
+		pod("migrate-a", migrate), pod("migrate-b", migrate),
+		pod("nightly-1-a", nightly1), pod("nightly-2-a", nightly2),
+		pod("hourly-1-a", hourly1), pod("hourly-2-a", hourly2))
+
+	for _, test := range []struct {
+		kind, name string
+		want       string
+		wantErr    string
+	}{
+		{kind: "job", name: "migrate", want: "migrate-a,migrate-b"},
+		{kind: "cronjob", name: "nightly", want: "nightly-2-a"},
+		// A job that is still running is preferred over a newer one
+		{kind: "cronjob", name: "hourly", want: "hourly-1-a"},
+		{kind: "cronjob", name: "idle", wantErr: "cronjob/idle has not created any jobs"},
+	} {
+		sel, err := resolveWorkloadSelector(clientset, "default", test.kind, test.name)
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("%s/%s: got error %v, want %q", test.kind, test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s/%s: %s", test.kind, test.name, err)
+			continue
+		}
+		ctl := NewControllerWithOptions(clientset, WithNamespace("default"), WithLabelSelector(sel))
+		refs, err := ctl.MatchingContainers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, ref := range refs {
+			names = append(names, ref.Pod.Name)
+		}
+		sort.Strings(names)
+		if got := strings.Join(names, ","); got != test.want {
+			t.Errorf("%s/%s: got pods %s, want %s", test.kind, test.name, got, test.want)
+		}
+	}
+}
+
+func TestPodSiblingSelector(t *testing.T) {
+	pod := func(name string, set map[string]string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: set}}
+	}
+	clientset := fake.NewSimpleClientset(
+		pod("web-xyz", map[string]string{"app": "web", "version": "v2", "pod-template-hash": "1234"}),
+		pod("db-0", map[string]string{"app": "db", "statefulset.kubernetes.io/pod-name": "db-0"}),
+		pod("bare", nil),
+	)
+	for _, test := range []struct {
+		name    string
+		keys    []string
+		want    string
+		wantErr string
+	}{
+		{name: "web-xyz", want: "app=web,pod-template-hash=1234,version=v2"},
+		{name: "web-xyz", keys: []string{"app"}, want: "app=web"},
+		{name: "web-xyz", keys: []string{"app", "version"}, want: "app=web,version=v2"},
+		{name: "web-xyz", keys: []string{"region"}, wantErr: `Pod web-xyz has no label "region"`},
+		// Labels unique to each pod of a workload would match only the pod
+		{name: "db-0", want: "app=db"},
+		{name: "bare", wantErr: "Pod bare has no labels to match other pods by"},
+	} {
+		sel, err := podSiblingSelector(clientset, "default", test.name, test.keys)
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("%s %q: got error %v, want %q", test.name, test.keys, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q: %s", test.name, test.keys, err)
+			continue
+		}
+		if sel.String() != test.want {
+			t.Errorf("%s %q: got selector %q, want %q", test.name, test.keys, sel, test.want)
+		}
+	}
+
+	if _, err := podSiblingSelector(clientset, "default", "missing", nil); !apierrors.IsNotFound(err) {
+		t.Errorf("got error %v for a missing pod, want not found", err)
+	}
+}